@@ -0,0 +1,221 @@
+package app
+
+import(
+	"io"
+	"net"
+	"fmt"
+	"time"
+	"bufio"
+	"errors"
+	"encoding/hex"
+	"encoding/binary"
+	"crypto/subtle"
+)
+
+const (
+	ADMIN_FRAME_HEADER_LEN = 2 //frame length, big endian
+
+	SYS_PKG_PREF_DEVICE byte = 0xFF
+	SYS_PKG_PREF_ALL byte = 0xFE
+)
+
+//Parsed sys package
+type SysCommand struct {
+	AllDevices bool
+	IMEI string
+	Cmd []byte
+	Direct byte
+}
+
+/**
+ * Sys package
+ * prefix 3 bytes specific device command 0xFF 0xFF 0xFF OR all devices command 0xFE 0xFE 0xFE
+ * a.CommandKey
+ *
+ *	Server command
+ *OR
+ * 	IMEI length - 1 byte, IMEI string
+ * 	Command length - 1 byte, Command bytes
+ *	Direct flag - 1 byte
+ *
+ * Returns nil, nil if buffer is not a sys package or CommandKey is not set.
+ */
+func (a *Application) ParseSysPackage(buffer []byte) (*SysCommand, error) {
+	command_key, min_len := a.getCommandKey()
+	if command_key == "" || len(buffer) < min_len {
+		return nil, nil
+	}
+	cmd := &SysCommand{}
+	if buffer[0] == SYS_PKG_PREF_ALL && buffer[1] == SYS_PKG_PREF_ALL && buffer[2] == SYS_PKG_PREF_ALL {
+		cmd.AllDevices = true
+
+	}else if buffer[0] != SYS_PKG_PREF_DEVICE || buffer[1] != SYS_PKG_PREF_DEVICE || buffer[2] != SYS_PKG_PREF_DEVICE {
+		return nil, nil
+	}
+
+	ind := SYS_PKG_PREF_LEN + len(command_key)
+	if subtle.ConstantTimeCompare([]byte(command_key), buffer[SYS_PKG_PREF_LEN : ind]) != 1 {
+		return nil, nil
+	}
+
+	return parseSysCommand(buffer, ind, cmd.AllDevices)
+}
+
+//command part of sys package starting from ind
+func parseSysCommand(buffer []byte, ind int, allDevices bool) (*SysCommand, error) {
+	cmd := &SysCommand{AllDevices: allDevices}
+	var ok bool
+	if !cmd.AllDevices {
+		var imei []byte
+		if imei, ind, ok = readSysField(buffer, ind); !ok {
+			return nil, errors.New("sys package: wrong IMEI length")
+		}
+		cmd.IMEI = string(imei)
+	}
+	if cmd.Cmd, ind, ok = readSysField(buffer, ind); !ok || len(cmd.Cmd) == 0 {
+		return nil, errors.New("sys package: wrong command length")
+	}
+	if !cmd.AllDevices && ind < len(buffer) {
+		cmd.Direct = buffer[ind]
+	}
+	return cmd, nil
+}
+
+//field: length byte + data
+func readSysField(buffer []byte, ind int) ([]byte, int, bool) {
+	if ind >= len(buffer) {
+		return nil, ind, false
+	}
+	field_len := int(buffer[ind])
+	if ind+1+field_len > len(buffer) {
+		return nil, ind, false
+	}
+	return buffer[ind+1 : ind+1+field_len], ind+1+field_len, true
+}
+
+//Executes admin command, returns json string
+func (a *Application) RunSysCommand(cmd *SysCommand) string {
+	if cmd.AllDevices {
+		return a.SrvCMDRunServerCommand(cmd.Cmd[0], "", nil)
+	}
+
+	if cmd.Direct != 1 && cmd.Cmd[0] == CMD_DEV_LOG_LEVEL {
+		return a.SrvCMDSetLogLevel(cmd.IMEI, cmd.Cmd[1:])
+	}
+	if cmd.Direct != 1 && cmd.Cmd[0] == CMD_DEV_SESSIONS {
+		//history does not depend on connection
+		return a.SrvCMDSessions(cmd.IMEI, cmd.Cmd[1:])
+	}
+
+	socket := a.ClientSockets.GetByIMEI(cmd.IMEI)
+	if cmd.Direct != 1 && cmd.Cmd[0] == CMD_DEV_QUEUE {
+		//queue state does not depend on connection
+		return a.SrvCMDRunServerCommand(cmd.Cmd[0], cmd.IMEI, socket)
+
+	}else if socket != nil && cmd.Direct == 1 {
+		//direct device command
+		if err := socket.WriteServCommand(cmd.Cmd); err != nil {
+			a.Logger.Error("device command failed", LOG_KEY_IMEI, cmd.IMEI, LOG_KEY_ERR, err)
+			return a.SrvCMDError(err.Error())
+		}
+		socket.AddSentCommand("")
+		return "OK"
+
+	}else if socket != nil {
+		//indirct device command
+		return a.SrvCMDRunServerCommand(cmd.Cmd[0], cmd.IMEI, socket)
+
+	}else if cmd.Direct == 1 && a.CommandQueue != nil {
+		//device is offline, command is delivered after next handshake
+		return a.SrvCMDQueueCommand(cmd.IMEI, cmd.Cmd)
+	}
+
+	err_s := fmt.Sprintf("IMEI %s, not connected, command=%s", cmd.IMEI, hex.EncodeToString(cmd.Cmd))
+	a.Logger.Error("device command failed", LOG_KEY_IMEI, cmd.IMEI, LOG_KEY_ERR, err_s)
+	return a.SrvCMDError(err_s)
+}
+
+//Admin TCP server, never counted as clients.
+//Before every command server sends {"nonce":"hex"}+"\n",
+//client sends frame: length (2 bytes, big endian) + admin frame (see ParseAdminFrame),
+//response: json string + "\n"
+func (a *Application) RunAdminServer(host string, port int, connLiveSec int, tlsConf *TLSConfig) {
+	srv_addr := fmt.Sprintf("%s:%d",host, port)
+
+	l, err := a.listen(srv_addr, tlsConf)
+	if err != nil {
+		LogFatal(a.Logger, "Admin listen failed", LOG_KEY_ERR, err)
+	}
+	defer l.Close()
+
+	a.init()
+	if !a.addListener(l) {
+		return
+	}
+
+	a.Logger.Info("Admin TCP server started", "addr", srv_addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil && a.IsStopping() {
+			a.Logger.Info("Admin TCP server stopped")
+			return
+
+		}else if err != nil {
+			a.Logger.Error("Admin l.Accept failed", LOG_KEY_ERR, err)
+
+		} else if a.addConn(conn) {
+			go a.handleAdminConnection(conn, connLiveSec)
+		}
+	}
+}
+
+func (a *Application) handleAdminConnection(conn net.Conn, connLiveSec int) {
+	defer a.removeConn(conn)
+	defer conn.Close()
+
+	remote_addr := conn.RemoteAddr().String()
+	logger := a.Logger.With(LOG_KEY_SERVER, "admin", LOG_KEY_REMOTE_ADDR, remote_addr)
+	defer a.recoverConn(conn, logger)
+	reader := bufio.NewReader(conn)
+	header := make([]byte, ADMIN_FRAME_HEADER_LEN)
+	for {
+		//new challenge for every command
+		nonce, err := genNonce()
+		if err != nil {
+			logger.Error("genNonce failed", LOG_KEY_ERR, err)
+			return
+		}
+		if _, err := conn.Write([]byte(fmt.Sprintf(`{"nonce":"%s"}`, hex.EncodeToString(nonce))+"\n")); err != nil {
+			logger.Warn("conn.Write failed", LOG_KEY_ERR, err)
+			return
+		}
+		
+		if connLiveSec > 0 {
+			conn.SetReadDeadline(time.Now().Add(time.Duration(connLiveSec) * time.Second))
+		}
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err != io.EOF {
+				logger.Warn("conn.Read failed", LOG_KEY_ERR, err)
+			}
+			return
+		}
+		frame := make([]byte, binary.BigEndian.Uint16(header))
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			logger.Warn("conn.Read failed", LOG_KEY_ERR, err)
+			return
+		}
+
+		cmd, key, err := a.ParseAdminFrame(frame, nonce)
+		if err != nil {
+			logger.Warn("wrong admin frame, closing", LOG_KEY_ERR, err)
+			conn.Write([]byte(a.SrvCMDError(err.Error())+"\n"))
+			return
+		}
+		a.auditCommand(key, remote_addr, cmd)
+		resp := a.RunSysCommand(cmd)
+		if _, err := conn.Write([]byte(resp+"\n")); err != nil {
+			logger.Warn("conn.Write failed", LOG_KEY_ERR, err)
+			return
+		}
+	}
+}
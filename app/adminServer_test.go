@@ -0,0 +1,188 @@
+package app
+
+import(
+	"io"
+	"bytes"
+	"errors"
+	"testing"
+	"log/slog"
+)
+
+const (
+	TEST_COMMAND_KEY = "key"
+	TEST_READ_KEY = "rk"
+)
+
+var testNonce = bytes.Repeat([]byte{0x5A}, ADMIN_NONCE_LEN)
+
+func newTestAdminApp() *Application {
+	a := &Application{}
+	a.SetAPIKeys(TEST_COMMAND_KEY, []APIKey{{Name: "ro", Key: TEST_READ_KEY, Role: ROLE_READ},
+		{Name: DEF_API_KEY_NAME, Key: TEST_COMMAND_KEY, Role: ROLE_CONTROL},
+		{Name: "empty", Key: "", Role: ROLE_CONTROL},
+	})
+	return a
+}
+
+//sys package of device port: prefix, key, IMEI, command, direct flag
+func sysPackage(pref byte, key string, imei string, cmd []byte, direct byte) []byte {
+	b := []byte{pref, pref, pref}
+	b = append(b, key...)
+	if pref == SYS_PKG_PREF_DEVICE {
+		b = append(b, byte(len(imei)))
+		b = append(b, imei...)
+	}
+	b = append(b, byte(len(cmd)))
+	b = append(b, cmd...)
+	if pref == SYS_PKG_PREF_DEVICE {
+		b = append(b, direct)
+	}
+	return b
+}
+
+//admin frame with signature over frame without signature, see ParseAdminFrame
+func adminFrame(pref byte, keyName string, key string, body []byte) []byte {
+	head := []byte{pref, pref, pref, byte(len(keyName))}
+	head = append(head, keyName...)
+	signed := append(append([]byte(nil), head...), body...)
+	frame := append(head, SignAdminCommand(key, testNonce, signed)...)
+	return append(frame, body...)
+}
+
+//command part of admin frame
+func adminBody(pref byte, imei string, cmd []byte, direct byte) []byte {
+	return sysPackage(pref, "", imei, cmd, direct)[SYS_PKG_PREF_LEN:]
+}
+
+func TestParseSysPackage(t *testing.T) {
+	a := newTestAdminApp()
+	cmd, err := a.ParseSysPackage(sysPackage(SYS_PKG_PREF_DEVICE, TEST_COMMAND_KEY, "865209034412345", []byte{CMD_DEV_LOG_LEVEL, 'd'}, 0))
+	if err != nil || cmd == nil || cmd.IMEI != "865209034412345" || cmd.Cmd[0] != CMD_DEV_LOG_LEVEL {
+		t.Fatalf("device command %+v %v", cmd, err)
+	}
+	if cmd, err := a.ParseSysPackage(sysPackage(SYS_PKG_PREF_DEVICE, "kez", "1", []byte{1}, 0)); cmd != nil || err != nil {
+		t.Fatalf("wrong key accepted %+v %v", cmd, err)
+	}
+	//empty command key matches nothing
+	a.SetAPIKeys("", nil)
+	if cmd, err := a.ParseSysPackage(sysPackage(SYS_PKG_PREF_ALL, "", "", []byte{CMD_STATUS}, 0)); cmd != nil || err != nil {
+		t.Fatalf("empty key accepted %+v %v", cmd, err)
+	}
+}
+
+//direct command write error is returned to administrator
+func TestRunSysCommandDirect(t *testing.T) {
+	a := newTestAdminApp()
+	a.Logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	a.ClientSockets = newClientSocketList()
+	sock := &testSocket{BaseSocket: BaseSocket{App: a}}
+	a.ClientSockets.Append(sock, "1", "test")
+	a.ClientSockets.SetIMEI(sock, "111")
+
+	if resp := a.RunSysCommand(&SysCommand{IMEI: "111", Cmd: []byte{1}, Direct: 1}); resp != "OK" {
+		t.Fatalf("sent command: %s", resp)
+	}
+	sock.writeErr = errors.New("broken pipe")
+	if resp := a.RunSysCommand(&SysCommand{IMEI: "111", Cmd: []byte{1}, Direct: 1}); resp != `{"err":"broken pipe"}` {
+		t.Fatalf("failed command: %s", resp)
+	}
+	if _, ok := sock.PopSentCommand(); !ok {
+		t.Fatal("sent command is not registered")
+	}
+	if _, ok := sock.PopSentCommand(); ok {
+		t.Fatal("failed command is registered")
+	}
+}
+
+func TestParseAdminFrame(t *testing.T) {
+	a := newTestAdminApp()
+	frame := adminFrame(SYS_PKG_PREF_ALL, "ro", TEST_READ_KEY, adminBody(SYS_PKG_PREF_ALL, "", []byte{CMD_STATUS}, 0))
+	cmd, key, err := a.ParseAdminFrame(frame, testNonce)
+	if err != nil || key.Name != "ro" || !cmd.AllDevices || cmd.Cmd[0] != CMD_STATUS {
+		t.Fatalf("status %+v %+v %v", cmd, key, err)
+	}
+	//read key can not send device commands
+	frame = adminFrame(SYS_PKG_PREF_DEVICE, "ro", TEST_READ_KEY, adminBody(SYS_PKG_PREF_DEVICE, "1", []byte{0x01}, 1))
+	if _, _, err := a.ParseAdminFrame(frame, testNonce); err == nil {
+		t.Fatal("control command with read key accepted")
+	}
+	//signature of other nonce
+	frame = adminFrame(SYS_PKG_PREF_ALL, "ro", TEST_READ_KEY, adminBody(SYS_PKG_PREF_ALL, "", []byte{CMD_STATUS}, 0))
+	if _, _, err := a.ParseAdminFrame(frame, make([]byte, ADMIN_NONCE_LEN)); err == nil {
+		t.Fatal("replayed frame accepted")
+	}
+	//key without value
+	frame = adminFrame(SYS_PKG_PREF_ALL, "empty", "", adminBody(SYS_PKG_PREF_ALL, "", []byte{CMD_STATUS}, 0))
+	if _, _, err := a.ParseAdminFrame(frame, testNonce); err == nil {
+		t.Fatal("empty key accepted")
+	}
+}
+
+func FuzzParseSysPackage(f *testing.F) {
+	f.Add(sysPackage(SYS_PKG_PREF_DEVICE, TEST_COMMAND_KEY, "865209034412345", []byte{0x01, 0x07}, 1))
+	f.Add(sysPackage(SYS_PKG_PREF_DEVICE, TEST_COMMAND_KEY, "865209034412345", []byte{CMD_DEV_LOG_LEVEL, 'd', 'e', 'b', 'u', 'g'}, 0))
+	f.Add(sysPackage(SYS_PKG_PREF_DEVICE, TEST_COMMAND_KEY, "865209034412345", []byte{CMD_DEV_SESSIONS}, 0))
+	f.Add(sysPackage(SYS_PKG_PREF_ALL, TEST_COMMAND_KEY, "", []byte{CMD_STATUS}, 0))
+	f.Add(sysPackage(SYS_PKG_PREF_ALL, TEST_COMMAND_KEY, "", []byte{CMD_RELOAD}, 0))
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 'k', 'e', 'y', 0xFF})
+	f.Add([]byte{0xFF, 0x22, 0x2a, 0x46, 0xd6, 0xbe, 0x48, 0x0f, 0x03, 0x00})
+	a := newTestAdminApp()
+	f.Fuzz(func(t *testing.T, buf []byte) {
+		cmd, err := a.ParseSysPackage(buf)
+		if cmd == nil {
+			return
+		}
+		if err != nil {
+			t.Fatalf("command with error %v", err)
+		}
+		if len(cmd.Cmd) == 0 {
+			t.Fatal("empty command")
+		}
+		if !bytes.HasPrefix(buf[SYS_PKG_PREF_LEN:], []byte(TEST_COMMAND_KEY)) {
+			t.Fatal("command without key")
+		}
+		cmd.NeedsControl()
+	})
+}
+
+func FuzzParseAdminFrame(f *testing.F) {
+	f.Add(adminFrame(SYS_PKG_PREF_ALL, "ro", TEST_READ_KEY, adminBody(SYS_PKG_PREF_ALL, "", []byte{CMD_STATUS}, 0)), true)
+	f.Add(adminFrame(SYS_PKG_PREF_ALL, DEF_API_KEY_NAME, TEST_COMMAND_KEY, adminBody(SYS_PKG_PREF_ALL, "", []byte{CMD_RELOAD}, 0)), false)
+	f.Add(adminFrame(SYS_PKG_PREF_DEVICE, DEF_API_KEY_NAME, TEST_COMMAND_KEY, adminBody(SYS_PKG_PREF_DEVICE, "865209034412345", []byte{0x01, 0x07}, 1)), true)
+	f.Add(adminFrame(SYS_PKG_PREF_DEVICE, "ro", TEST_READ_KEY, adminBody(SYS_PKG_PREF_DEVICE, "865209034412345", []byte{CMD_DEV_LOG_LEVEL, 'd'}, 0)), true)
+	f.Add(adminFrame(SYS_PKG_PREF_ALL, "empty", "", adminBody(SYS_PKG_PREF_ALL, "", []byte{CMD_STATUS}, 0)), true)
+	f.Add([]byte{0xFE, 0xFE, 0xFE, 0x02, 'r', 'o'}, true)
+	a := newTestAdminApp()
+	keys := map[string]APIKey{}
+	for _, k := range a.getAPIKeys() {
+		keys[k.Name] = k
+	}
+	f.Fuzz(func(t *testing.T, frame []byte, resign bool) {
+		//frame is signed to reach command parsing
+		if resign && len(frame) > SYS_PKG_PREF_LEN {
+			if name, ind, ok := readSysField(frame, SYS_PKG_PREF_LEN); ok && ind+ADMIN_MAC_LEN <= len(frame) {
+				signed := append(append([]byte(nil), frame[:ind]...), frame[ind+ADMIN_MAC_LEN:]...)
+				copy(frame[ind:], SignAdminCommand(keys[string(name)].Key, testNonce, signed))
+			}
+		}
+		cmd, key, err := a.ParseAdminFrame(frame, testNonce)
+		if cmd == nil {
+			if err == nil {
+				t.Fatal("no command and no error")
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("command with error %v", err)
+		}
+		if key.Key == "" {
+			t.Fatal("command with empty key")
+		}
+		if len(cmd.Cmd) == 0 {
+			t.Fatal("empty command")
+		}
+		if cmd.NeedsControl() && !key.CanControl() {
+			t.Fatal("control command with read key")
+		}
+	})
+}
@@ -0,0 +1,159 @@
+package app
+
+import(
+	"errors"
+	"encoding/hex"
+	"crypto/rand"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+)
+
+const (
+	ROLE_READ = "read" //statistics only
+	ROLE_CONTROL = "control" //statistics and device commands
+
+	DEF_API_KEY_NAME = "default" //commandKey
+
+	ADMIN_NONCE_LEN = 16
+	ADMIN_MAC_LEN = sha256.Size
+)
+
+//Named admin key
+type APIKey struct {
+	Name string `json:"name"`
+	Key string `json:"key"`
+	Role string `json:"role"`
+}
+
+func (k APIKey) CanControl() bool {
+	return k.Role == ROLE_CONTROL
+}
+
+//true if command is sent to device or changes server state
+func (cmd *SysCommand) NeedsControl() bool {
+	return (!cmd.AllDevices && (cmd.Direct == 1 || cmd.Cmd[0] == CMD_DEV_LOG_LEVEL)) ||
+		(cmd.AllDevices && (cmd.Cmd[0] == CMD_RELOAD || cmd.Cmd[0] == CMD_REGISTRY_REFRESH))
+}
+
+//Sets admin keys, can be called while running
+func (a *Application) SetAPIKeys(commandKey string, keys []APIKey) {
+	a.mx.Lock()
+	a.CommandKey = commandKey
+	a.APIKeys = keys
+	a.mx.Unlock()
+}
+
+//key and minimal sys package length, see ParseSysPackage func for package structure
+func (a *Application) getCommandKey() (string, int) {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.CommandKey, SYS_PKG_PREF_LEN + len(a.CommandKey) + 1
+}
+
+func (a *Application) getAPIKeys() []APIKey {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.APIKeys
+}
+
+//keys without value are never matched
+func (a *Application) GetAPIKey(name string) (APIKey, bool) {
+	for _, k := range a.getAPIKeys() {
+		if k.Name == name && k.Key != "" {
+			return k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+//key by HTTP token, see HTTPAdminToken
+func (a *Application) GetAPIKeyByToken(token string) (APIKey, bool) {
+	exp, mac, ok := httpTokenExpires(token)
+	if !ok {
+		return APIKey{}, false
+	}
+	keys := a.getAPIKeys()
+	found := -1
+	for i, k := range keys {
+		//all keys are checked
+		if k.Key != "" && subtle.ConstantTimeCompare([]byte(mac), []byte(httpTokenMAC(k.Key, exp))) == 1 {
+			found = i
+		}
+	}
+	if found < 0 {
+		return APIKey{}, false
+	}
+	return keys[found], true
+}
+
+//Signature of admin command: HMAC-SHA256(nonce + frame without signature)
+func SignAdminCommand(key string, nonce []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(nonce)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func genNonce() ([]byte, error) {
+	b := make([]byte, ADMIN_NONCE_LEN)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+/**
+ * Admin frame on dedicated port
+ * prefix 3 bytes, see ParseSysPackage
+ * Key name length - 1 byte, key name
+ * Signature - 32 bytes, see SignAdminCommand, computed over frame with signature bytes omitted
+ *	Server command
+ *OR
+ * 	IMEI length - 1 byte, IMEI string
+ * 	Command length - 1 byte, Command bytes
+ *	Direct flag - 1 byte
+ */
+func (a *Application) ParseAdminFrame(frame []byte, nonce []byte) (*SysCommand, APIKey, error) {
+	if len(frame) < SYS_PKG_PREF_LEN+1 {
+		return nil, APIKey{}, errors.New("admin frame: too short")
+	}
+	all := false
+	if frame[0] == SYS_PKG_PREF_ALL && frame[1] == SYS_PKG_PREF_ALL && frame[2] == SYS_PKG_PREF_ALL {
+		all = true
+
+	}else if frame[0] != SYS_PKG_PREF_DEVICE || frame[1] != SYS_PKG_PREF_DEVICE || frame[2] != SYS_PKG_PREF_DEVICE {
+		return nil, APIKey{}, errors.New("admin frame: wrong prefix")
+	}
+
+	key_name, ind, ok := readSysField(frame, SYS_PKG_PREF_LEN)
+	if !ok || ind+ADMIN_MAC_LEN > len(frame) {
+		return nil, APIKey{}, errors.New("admin frame: wrong key name length")
+	}
+	key, ok := a.GetAPIKey(string(key_name))
+	if !ok {
+		return nil, APIKey{}, errors.New("admin frame: unknown key "+string(key_name))
+	}
+	mac := frame[ind : ind+ADMIN_MAC_LEN]
+	signed := make([]byte, 0, len(frame)-ADMIN_MAC_LEN)
+	signed = append(signed, frame[:ind]...)
+	signed = append(signed, frame[ind+ADMIN_MAC_LEN:]...)
+	if !hmac.Equal(mac, SignAdminCommand(key.Key, nonce, signed)) {
+		return nil, key, errors.New("admin frame: wrong signature")
+	}
+
+	cmd, err := parseSysCommand(frame, ind+ADMIN_MAC_LEN, all)
+	if err != nil {
+		return nil, key, err
+	}
+	if cmd.NeedsControl() && !key.CanControl() {
+		return nil, key, errors.New("key "+key.Name+" is not allowed to control devices")
+	}
+	return cmd, key, nil
+}
+
+//audit log entry for accepted command
+func (a *Application) auditCommand(key APIKey, remoteAddr string, cmd *SysCommand) {
+	a.Logger.Info("AUDIT", "key", key.Name, "role", key.Role, LOG_KEY_REMOTE_ADDR, remoteAddr,
+		LOG_KEY_IMEI, cmd.IMEI, "cmd", hex.EncodeToString(cmd.Cmd), "direct", cmd.Direct)
+}
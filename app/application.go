@@ -2,23 +2,31 @@ package app
 
 import(
 	"net"
+	"context"
 	"time"
 	"fmt"
 	"crypto/rand"
 	"sync"
-	"encoding/hex"
-	
-	"github.com/labstack/gommon/log"
+	"sync/atomic"
+	"errors"
+	"runtime/debug"
+	"log/slog"
 )
 
 const (
 	SYS_PKG_PREF_LEN = 3
+
+	DUP_IMEI_CLOSE_OLD = "closeOld" //old connections of IMEI are closed on handshake
+	DUP_IMEI_KEEP_BOTH = "keepBoth" //old connections are kept, the newest gets commands
 )
 
 type NewSocketFunc = func() ClientSocketer
 
 type TelematicsData struct {
 	ID string
+	IMEI string //set by CodecSocket, ID is storage ID
+	ServerID string
+	Protocol string
 	GPSTime time.Time
 	ReceivedTime time.Time
 	Lon float32
@@ -41,129 +49,193 @@ type TelematicsData struct {
 
 //Interface for storages
 type Storager interface {
-	Init(string, *log.Logger, int) error
+	Init(string, *slog.Logger, int) error
 	Write(*TelematicsData)
 	GetDescr() string
+	Close(context.Context) (int, error) //flushes data, returns number of spooled queries
+}
+
+//Storage with adjustable number of processes
+type ProcessCountSetter interface {
+	SetProcessCount(int)
 }
 
 //
 
 type Application struct {
-	CommandKey string
-	Logger *log.Logger
+	CommandKey string //legacy key for sys packages on device ports
+	APIKeys []APIKey
+	DisableDeviceSysPackage bool //sys packages on device ports are not checked
+	MetricsAuth bool //metrics endpoint requires API key token
+	SessionHistory bool //session records are written to storage, see endSession
+	ReadySpoolMaxBytes int64 //not ready if storage is not reachable and spool is bigger, 0 - storage must be reachable
+	DuplicateIMEIPolicy string //DUP_IMEI_CLOSE_OLD by default
+	Logger *slog.Logger
+	LogLevels *LogLevels //global level and IMEI overrides of Logger
 	Storage Storager
+	CommandQueue *CommandQueue
+	Devices *DeviceRegistry //nil - all devices are accepted
+	Reloader func() ReloadReport //configuration reload, set by main
 	ClientSockets *ClientSocketList
-	SysPackageMinLen int
+	Servers []*Server
 	StartTime time.Time
 	mx sync.RWMutex
+	initOnce sync.Once
+	stopping atomic.Bool //set under mx, listeners and connections are not added after it
+	listeners []net.Listener
+	conns map[net.Conn]bool
+	capture *CaptureRecorder //raw traffic recorder, nil - disabled
+	deviceState *DeviceStateConfig //nil - device state is not written
+	metrics *Metrics
+	lastStorageCheck storageCheck
+	connWG sync.WaitGroup
 	MaxClientCount int
 	DownloadedBytes uint64
 	UploadedBytes uint64
 	Handshakes uint64	
 }
 
-//, store Connector
-func (a *Application) RunServer(ID string, host string, port int, connLiveSec int, newSocket NewSocketFunc) {
-
-	srv_addr := fmt.Sprintf("%s:%d",host, port)
+//common structures for all servers
+func (a *Application) init() {
+	a.initOnce.Do(func() {
+		a.ClientSockets = newClientSocketList()
+		a.metrics = newMetrics()
+		a.StartTime = time.Now()
+	})
+}
 
-	l, err := net.Listen("tcp", srv_addr)
-	if err != nil {
-		a.Logger.Fatalf("net.Listen: %v", err)
+//Panic in connection handler closes the connection only, server keeps running
+func (a *Application) recoverConn(conn net.Conn, logger *slog.Logger) {
+	if r := recover(); r != nil {
+		a.logPanic(logger, r)
+		conn.Close()
 	}
-	defer l.Close()
+}
 
-	a.ClientSockets = &ClientSocketList{m: make(map[string]ClientSocketer)}	
-	a.SysPackageMinLen = 3 + len(a.CommandKey) + 1 //see IsSysPackage func for package structure
-	a.StartTime = time.Now()
-	
-	a.Logger.Infof("%s TCP server started: %s", ID, srv_addr)
-	for {
-		conn, err := l.Accept()
-		if err != nil {
-			a.Logger.Errorf("l.Accept: %v", err)
-		} else {						
-			go a.HandleConnection(conn, newSocket, connLiveSec)
-		}
-	}
+func (a *Application) logPanic(logger *slog.Logger, r interface{}) {
+	logger.Error("panic", "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
 }
 
-func (a *Application) HandleConnection(conn net.Conn, newSocket NewSocketFunc, connLiveSec int) {
+func (a *Application) HandleConnection(conn net.Conn, newSocket NewSocketFunc, srv *Server) {
+	defer a.removeConn(conn)
+	logger := a.Logger.With(LOG_KEY_SERVER, srv.ID, LOG_KEY_PROTOCOL, srv.Protocol, LOG_KEY_REMOTE_ADDR, conn.RemoteAddr().String())
+	defer a.recoverConn(conn, logger)
+	
 	id, err := genID()
 	if err != nil {
-		a.Logger.Errorf("genID: %v", err)
+		logger.Error("genID failed", LOG_KEY_ERR, err)
 		return
 	}
 	socket := newSocket()
 	socket.SetConn(conn)
 	socket.SetApp(a)	
-	cnt := a.ClientSockets.Append(socket, id)
+	socket.SetLogger(logger.With(LOG_KEY_CONN_ID, id))
+	cnt := a.ClientSockets.Append(socket, id, srv.ID)
+	a.metrics.IncAccepted(srv.ID)
 	a.mx.Lock()
 	if cnt > a.MaxClientCount {
 		a.MaxClientCount = cnt
 	}	
 	a.mx.Unlock()
-	socket.HandleConnection(connLiveSec)
-	a.ClientSockets.Remove(id)
+	defer a.endSession(id, srv, socket)
+	socket.HandleConnection(srv)
 }
 
 /**
- * Sys package
- * prefix 3 bytes specific device command 0xFF 0xFF 0xFF OR all devices command 0xEF 0xEF 0xEF
- * a.CommandKey
- *
- *	Server command
- *OR
- * 	IMEI string - 15 bytes
- * 	Command bytes
+ * Sys package on device port, see ParseSysPackage for package structure
+ * Sender socket is an admin client, it is removed from device list.
  */
 func (a *Application) IsSysPackage(buffer []byte, packageLen int, senderSocket ClientSocketer) bool{	
+	if a.DisableDeviceSysPackage {
+		return false
+	}
+	cmd, err := a.ParseSysPackage(buffer[:packageLen])
+	if cmd == nil && err == nil {
+		return false
+	}
+	
+	//admin connection is not a device
+	a.ClientSockets.RemoveSocket(senderSocket)
+	
+	var resp string
+	if err != nil {
+		senderSocket.GetLogger().Error("ParseSysPackage failed", LOG_KEY_ERR, err)
+		resp = a.SrvCMDError(err.Error())
+	}else{
+		a.auditCommand(APIKey{Name: DEF_API_KEY_NAME, Role: ROLE_CONTROL}, senderSocket.GetDescr(), cmd)
+		resp = a.RunSysCommand(cmd)
+	}
+	senderSocket.Write([]byte(resp+"\n"))
 	
-	if packageLen >= a.SysPackageMinLen && buffer[0] == 0xFF && buffer[1] == 0xFF && buffer[2] == 0xFF &&
-	a.CommandKey == string(buffer[SYS_PKG_PREF_LEN : SYS_PKG_PREF_LEN+len(a.CommandKey)]){
-		//specific device command
-		
-		imei_ind := SYS_PKG_PREF_LEN + byte(len(a.CommandKey))
-		imei_len := buffer[imei_ind : imei_ind + 2][0]
-		imei := string(buffer[imei_ind+1 : imei_ind + 1 + imei_len])
-		
-		cmd_len := buffer[imei_ind+1+imei_len : imei_ind+1+imei_len+2][0]
-		cmd := buffer[imei_ind+1+imei_len+1 : imei_ind+1+imei_len+1 + cmd_len]
-		direct := buffer[imei_ind+1+imei_len+1 + cmd_len : imei_ind+1+imei_len+1 + cmd_len+1][0]
-		
-		socket := a.ClientSockets.GetByIMEI(imei)
-		if socket != nil && direct == 1 {			
-			//direct device command
-			socket.WriteServCommand(cmd)
-			senderSocket.Write([]byte("OK"+"\n"))
-
-		}else if socket != nil && direct != 1 {			
-			//indirct device command
-			resp:= a.SrvCMDRunServerCommand(cmd[0], imei, senderSocket)
-			senderSocket.Write([]byte(resp+"\n"))
-			
+	return true
+}
+
+//Sends queued commands to the device, called after handshake
+func (a *Application) DeliverQueuedCommands(sock ClientSocketer) {
+	if a.CommandQueue != nil {
+		a.CommandQueue.Deliver(sock)
+	}
+}
+
+/**
+ * Called on device handshake.
+ * Maps IMEI to storage ID, returns DEVICE_* identification result.
+ * Accepted socket becomes command target for IMEI, other sockets
+ * of the same IMEI are handled according to DuplicateIMEIPolicy.
+ */
+func (a *Application) IdentifyDevice(sock ClientSocketer, imei string) (string, int) {
+	id, res := imei, DEVICE_ACCEPTED
+	if a.Devices != nil {
+		id, res = a.Devices.Identify(imei)
+	}
+	logger := sock.GetLogger()
+	switch res {
+	case DEVICE_REJECTED:
+		logger.Warn("unknown device rejected")
+		return id, res
+	case DEVICE_QUARANTINED:
+		logger.Warn("unknown device quarantined, data is not stored")
+	}
+	
+	others := a.ClientSockets.SetIMEI(sock, imei)
+	if len(others) > 0 {
+		if a.GetDuplicateIMEIPolicy() == DUP_IMEI_KEEP_BOTH {
+			logger.Warn("reconnected, old connections kept", "old_conns", len(others))
 		}else{
-			cmd_s := hex.EncodeToString(cmd)
-			err_s := fmt.Sprintf("IMEI %s, not connected, command=%s", imei, cmd_s)
-			a.Logger.Error(err_s)
-			resp := a.SrvCMDResponse(err_s,"")
-			senderSocket.Write([]byte(resp+"\n"))
+			logger.Warn("reconnected, closing old connections", "old_conns", len(others))
+			for _, it := range others {
+				a.ClientSockets.Remove(it.ID)
+				it.Socket.SetCloseReason(SESSION_CLOSE_REPLACED)
+				it.Socket.Close()
+			}
 		}
-		
-		return true
-
-	}else if packageLen >= a.SysPackageMinLen && buffer[0] == 0xFE && buffer[1] == 0xFE && buffer[2] == 0xFE &&
-	a.CommandKey == string(buffer[SYS_PKG_PREF_LEN : SYS_PKG_PREF_LEN+len(a.CommandKey)]){
-		//Command for all devices
-		cmd_ind := SYS_PKG_PREF_LEN + byte(len(a.CommandKey))		
-		cmd_len := buffer[cmd_ind : cmd_ind+2][0]
-		cmd := buffer[cmd_ind+1 : cmd_ind+1+cmd_len]		
-		resp:= a.SrvCMDRunServerCommand(cmd[0], "", nil)
-		senderSocket.Write([]byte(resp+"\n"))
-		return true
 	}
-	
-	return false
+	return id, res
+}
+
+func (a *Application) SetDuplicateIMEIPolicy(policy string) error {
+	if policy != DUP_IMEI_CLOSE_OLD && policy != DUP_IMEI_KEEP_BOTH {
+		return errors.New("unknown duplicate IMEI policy "+policy)
+	}
+	a.mx.Lock()
+	a.DuplicateIMEIPolicy = policy
+	a.mx.Unlock()
+	return nil
+}
+
+func (a *Application) GetDuplicateIMEIPolicy() string {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.DuplicateIMEIPolicy
+}
+
+//Device answered a server command, answers to direct commands are not queued
+func (a *Application) SetCommandAnswer(sock ClientSocketer, code byte) {
+	id, ok := sock.PopSentCommand()
+	if !ok || id == "" || a.CommandQueue == nil {
+		return
+	}
+	a.CommandQueue.SetAnswer(sock.GetIMEI(), id, code)
 }
 
 func (a *Application) IncDownloadedBytes(bt uint64){
@@ -219,6 +291,14 @@ func (a *Application) GetHandshakes() uint64{
 	return bt
 }
 
+func (a *Application) GetServers() []*Server {
+	a.mx.Lock()
+	list := make([]*Server, len(a.Servers))
+	copy(list, a.Servers)
+	a.mx.Unlock()
+	return list
+}
+
 func (a *Application) GetDeviceList() []string {
 	var list []string
 	for it := range a.ClientSockets.Iter() {
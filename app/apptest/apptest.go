@@ -0,0 +1,31 @@
+package apptest
+
+/**
+ * Helpers for tests of storages and sinks, imported by test files only.
+ */
+
+import(
+	"io"
+	"time"
+	"testing"
+	"log/slog"
+)
+
+const WAIT_TIMEOUT_SEC = 5
+
+//Logger without output
+func Logger() *slog.Logger {
+	return slog.New(slog.NewTextHandler(io.Discard, nil))
+}
+
+//Polls cond till WAIT_TIMEOUT_SEC, the test fails with descr on timeout
+func WaitFor(t testing.TB, descr string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Duration(WAIT_TIMEOUT_SEC) * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout: " + descr)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
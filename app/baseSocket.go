@@ -0,0 +1,321 @@
+package app
+
+import(
+	"net"
+	"sync"
+	"time"
+	"log/slog"
+)
+
+//Common part of client sockets, embedded by protocol implementations
+type BaseSocket struct {
+	IMEI string
+	DeviceID string //storage ID, see IdentifyDevice
+	Quarantined bool
+	Conn net.Conn
+	App *Application
+	ServerID string //set on read
+	Protocol string //set on read
+	mx sync.RWMutex
+	StartTime time.Time
+	DownloadedBytes uint64
+	UploadedBytes uint64
+	Handshakes uint64
+	Records uint64
+	DecodeErrors uint64
+	closeReason string //SESSION_CLOSE_*, the first reason is kept
+	stateRecord *TelematicsData //device state, see UpdateDeviceState
+	statePosition *TelematicsData
+	stateWritten time.Time
+	connLog *slog.Logger //connection attributes
+	capturePending []CaptureFrame //frames before identification, see capture
+	capturePendingBytes int
+	sentCommands []string //commands waiting for answer in send order, see AddSentCommand
+	log *slog.Logger //connection attributes and IMEI
+}
+
+func (sock *BaseSocket) SetConn(conn net.Conn) {
+	sock.Conn = conn
+}
+
+func (sock *BaseSocket) SetApp(ap *Application) {
+	sock.App = ap
+}
+
+func (sock *BaseSocket) Close() error {
+	return sock.Conn.Close()
+}
+
+//Logger with connection attributes, see Application.HandleConnection
+func (sock *BaseSocket) SetLogger(logger *slog.Logger) {
+	sock.mx.Lock()
+	sock.connLog = logger
+	sock.log = logger
+	sock.mx.Unlock()
+}
+
+//Connection logger, IMEI attribute is added on identification
+func (sock *BaseSocket) GetLogger() *slog.Logger {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	if sock.log == nil {
+		return sock.App.Logger
+	}
+	return sock.log
+}
+
+func (sock *BaseSocket) SetStartTime() {
+	sock.mx.Lock()
+	sock.StartTime = time.Now()
+	sock.mx.Unlock()
+}
+
+func (sock *BaseSocket) SetIMEI(imei string) {
+	sock.mx.Lock()
+	sock.IMEI = imei
+	if sock.connLog != nil {
+		sock.log = sock.connLog.With(LOG_KEY_IMEI, imei)
+	}
+	sock.mx.Unlock()
+	if imei != "" {
+		sock.flushCapture(imei)
+	}
+}
+
+func (sock *BaseSocket) GetIMEI() string {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	return sock.IMEI
+}
+
+//Identification result, see IdentifyDevice
+func (sock *BaseSocket) SetDevice(deviceID string, res int) {
+	sock.mx.Lock()
+	sock.DeviceID = deviceID
+	sock.Quarantined = (res == DEVICE_QUARANTINED)
+	sock.mx.Unlock()
+}
+
+func (sock *BaseSocket) GetDescr() string {
+	if imei := sock.GetIMEI(); imei != "" {
+		return imei
+	}
+	return sock.Conn.RemoteAddr().String()
+}
+
+func (sock *BaseSocket) IncDownloadedBytes(bt uint64) {
+	sock.mx.Lock()
+	sock.DownloadedBytes += bt
+	srv_id := sock.ServerID
+	sock.mx.Unlock()
+	//total bytes
+	sock.App.IncDownloadedBytes(bt)
+	sock.App.metrics.IncBytesIn(srv_id, bt)
+}
+
+func (sock *BaseSocket) IncUploadedBytes(bt uint64) {
+	sock.mx.Lock()
+	sock.UploadedBytes += bt
+	srv_id := sock.ServerID
+	sock.mx.Unlock()
+	//total bytes
+	sock.App.IncUploadedBytes(bt)
+	sock.App.metrics.IncBytesOut(srv_id, bt)
+}
+
+func (sock *BaseSocket) IncHandshakes() {
+	sock.mx.Lock()
+	sock.Handshakes++
+	srv_id := sock.ServerID
+	sock.mx.Unlock()
+	sock.App.IncHandshakes()
+	sock.App.metrics.IncHandshakes(srv_id)
+}
+
+//Decoded records, counted for session and metrics
+func (sock *BaseSocket) IncRecords(cnt int) {
+	sock.mx.Lock()
+	sock.Records += uint64(cnt)
+	srv_id := sock.ServerID
+	sock.mx.Unlock()
+	sock.App.metrics.IncRecords(srv_id, cnt)
+}
+
+func (sock *BaseSocket) IncDecodeErrors(kind string) {
+	sock.mx.Lock()
+	sock.DecodeErrors++
+	srv_id := sock.ServerID
+	sock.mx.Unlock()
+	sock.App.metrics.IncDecodeErrors(srv_id, kind)
+}
+
+func (sock *BaseSocket) SetCloseReason(reason string) {
+	sock.mx.Lock()
+	if sock.closeReason == "" {
+		sock.closeReason = reason
+	}
+	sock.mx.Unlock()
+}
+
+//Session counters, connection ID, server and end time are set by application
+func (sock *BaseSocket) GetSession() Session {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	return Session{IMEI: sock.IMEI,
+		DeviceID: sock.DeviceID,
+		RemoteAddr: sock.Conn.RemoteAddr().String(),
+		Start: sock.StartTime,
+		BytesIn: sock.DownloadedBytes,
+		BytesOut: sock.UploadedBytes,
+		Records: sock.Records,
+		DecodeErrors: sock.DecodeErrors,
+		CloseReason: sock.closeReason,
+	}
+}
+
+func (sock *BaseSocket) GetRunTime() uint64 {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	return uint64(time.Now().Sub(sock.StartTime).Seconds())
+}
+
+func (sock *BaseSocket) GetDownloadedBytes() uint64 {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	return sock.DownloadedBytes
+}
+
+func (sock *BaseSocket) GetUploadedBytes() uint64 {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	return sock.UploadedBytes
+}
+
+func (sock *BaseSocket) GetHandshakes() uint64 {
+	sock.mx.RLock()
+	defer sock.mx.RUnlock()
+	return sock.Handshakes
+}
+
+//Command written to device, id of queued command, empty for direct command
+func (sock *BaseSocket) AddSentCommand(id string) {
+	sock.mx.Lock()
+	if len(sock.sentCommands) >= CMD_SENT_MAX {
+		sock.sentCommands = sock.sentCommands[1:]
+	}
+	sock.sentCommands = append(sock.sentCommands, id)
+	sock.mx.Unlock()
+}
+
+//The oldest command waiting for answer, false if no command was sent
+func (sock *BaseSocket) PopSentCommand() (string, bool) {
+	sock.mx.Lock()
+	defer sock.mx.Unlock()
+	if len(sock.sentCommands) == 0 {
+		return "", false
+	}
+	id := sock.sentCommands[0]
+	sock.sentCommands = sock.sentCommands[1:]
+	return id, true
+}
+
+//direct write, not counted, used for sys package responses
+func (sock *BaseSocket) Write(resp []byte) {
+	sock.Conn.Write(resp)
+}
+
+//Writes data to device, uploaded bytes are counted
+func (sock *BaseSocket) WriteData(data []byte) error {
+	sock.capture(CAPTURE_DIR_OUT, data)
+	n, err := sock.Conn.Write(data)
+	if err != nil {
+		sock.GetLogger().Error("conn.Write failed", LOG_KEY_ERR, err)
+		sock.SetCloseReason(SESSION_CLOSE_WRITE_ERROR)
+	}
+	sock.IncUploadedBytes(uint64(n))
+	return err
+}
+
+//Reads next package, the connection is closed by deadline after conLiveSec of inactivity
+func (sock *BaseSocket) Read(buf []byte, srv *Server) (int, error) {
+	sock.mx.Lock()
+	sock.ServerID = srv.ID
+	sock.Protocol = srv.Protocol
+	sock.mx.Unlock()
+	sock.Conn.SetReadDeadline(time.Now().Add(time.Duration(srv.GetConLiveSec()) * time.Second))
+	n, err := sock.Conn.Read(buf)
+	if n > 0 {
+		sock.IncDownloadedBytes(uint64(n))
+		sock.capture(CAPTURE_DIR_IN, buf[:n])
+	}
+	return n, err
+}
+
+/**
+ * With IMEI filter frames of not identified connection are kept
+ * until identification, see flushCapture.
+ */
+func (sock *BaseSocket) capture(dir string, data []byte) {
+	r := sock.App.getCapture()
+	if r == nil || isSysPackagePrefix(data) {
+		return
+	}
+	sock.mx.Lock()
+	srv_id, imei := sock.ServerID, sock.IMEI
+	if imei == "" && r.NeedsIMEI() {
+		if !r.MatchServer(srv_id) {
+			sock.mx.Unlock()
+			return
+		}
+		if sock.capturePendingBytes + len(data) <= CAPTURE_PENDING_MAX_BYTES {
+			sock.capturePending = append(sock.capturePending, CaptureFrame{Time: time.Now(),
+				Dir: dir,
+				ServerID: srv_id,
+				Remote: sock.Conn.RemoteAddr().String(),
+				Data: append([]byte(nil), data...),
+			})
+			sock.capturePendingBytes += len(data)
+		}
+		sock.mx.Unlock()
+		return
+	}
+	sock.mx.Unlock()
+	r.Record(dir, srv_id, sock.Conn.RemoteAddr().String(), imei, data)
+}
+
+//frames before identification are recorded if IMEI is captured, discarded otherwise
+func (sock *BaseSocket) flushCapture(imei string) {
+	sock.mx.Lock()
+	pending := sock.capturePending
+	sock.capturePending = nil
+	sock.capturePendingBytes = 0
+	sock.mx.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	r := sock.App.getCapture()
+	if r == nil {
+		return
+	}
+	for _, f := range pending {
+		f.IMEI = imei
+		r.RecordFrame(f)
+	}
+}
+
+//Logs the reason of connection end on read error
+func (sock *BaseSocket) LogReadError(err error) {
+	reason := readCloseReason(err, sock.App.IsStopping())
+	sock.SetCloseReason(reason)
+	logger := sock.GetLogger()
+	switch reason {
+	case SESSION_CLOSE_SHUTDOWN:
+		logger.Info("closed on server shutdown")
+	case SESSION_CLOSE_REMOTE:
+		logger.Info("closed by device")
+	case SESSION_CLOSE_TIMEOUT:
+		logger.Warn("closed on timeout")
+	default:
+		logger.Warn("conn.Read failed", LOG_KEY_ERR, err)
+	}
+}
@@ -0,0 +1,185 @@
+package app
+
+import(
+	"os"
+	"io"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"strings"
+	"encoding/hex"
+)
+
+const (
+	CAPTURE_DIR_IN = "in" //device to server
+	CAPTURE_DIR_OUT = "out" //server to device
+
+	CAPTURE_FIELD_SEP = "\t"
+	CAPTURE_FIELD_CNT = 6
+	CAPTURE_MAX_LINE_LEN = 1024 * 1024
+	CAPTURE_PENDING_MAX_BYTES = 64 * 1024 //frames of not identified connection, the rest is not recorded
+)
+
+//Capture parameters, empty lists capture all traffic
+type CaptureConfig struct {
+	File string `json:"file"`
+	Servers []string `json:"servers"`
+	IMEIs []string `json:"imeis"`
+}
+
+/**
+ * Raw traffic recorder, one line per frame, fields are separated by tab:
+ * time (RFC3339Nano), direction (in/out), server ID, remote address, IMEI, data (hex)
+ * IMEI is empty until device is identified. With IMEI filter frames
+ * before identification are kept by the connection and recorded with IMEI
+ * after identification, see BaseSocket.capture.
+ * Sys packages are not recorded, they contain the command key.
+ */
+type CaptureRecorder struct {
+	Conf CaptureConfig
+	mx sync.Mutex
+	file *os.File
+	servers map[string]bool
+	imeis map[string]bool
+}
+
+//Captured frame
+type CaptureFrame struct {
+	Time time.Time
+	Dir string
+	ServerID string
+	Remote string
+	IMEI string
+	Data []byte
+}
+
+func NewCaptureRecorder(conf CaptureConfig) (*CaptureRecorder, error) {
+	if conf.File == "" {
+		return nil, errors.New("capture: file is not set")
+	}
+	file, err := os.OpenFile(conf.File, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	r := &CaptureRecorder{Conf: conf, file: file,
+		servers: make(map[string]bool),
+		imeis: make(map[string]bool),
+	}
+	for _, id := range conf.Servers {
+		r.servers[id] = true
+	}
+	for _, imei := range conf.IMEIs {
+		r.imeis[imei] = true
+	}
+	return r, nil
+}
+
+//IMEI is not known before identification
+func (r *CaptureRecorder) NeedsIMEI() bool {
+	return len(r.imeis) > 0
+}
+
+func (r *CaptureRecorder) MatchServer(serverID string) bool {
+	return len(r.servers) == 0 || r.servers[serverID]
+}
+
+func (r *CaptureRecorder) Match(serverID string, imei string) bool {
+	if !r.MatchServer(serverID) {
+		return false
+	}
+	if len(r.imeis) > 0 && !r.imeis[imei] {
+		return false
+	}
+	return true
+}
+
+func (r *CaptureRecorder) Record(dir string, serverID string, remote string, imei string, data []byte) {
+	r.RecordFrame(CaptureFrame{Time: time.Now(), Dir: dir, ServerID: serverID, Remote: remote, IMEI: imei, Data: data})
+}
+
+//Frame with its own time, filters are applied
+func (r *CaptureRecorder) RecordFrame(f CaptureFrame) {
+	if !r.Match(f.ServerID, f.IMEI) || isSysPackagePrefix(f.Data) {
+		return
+	}
+	line := strings.Join([]string{f.Time.UTC().Format(time.RFC3339Nano), f.Dir, f.ServerID, f.Remote, f.IMEI, hex.EncodeToString(f.Data)},
+		CAPTURE_FIELD_SEP) + "\n"
+
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.file != nil {
+		r.file.WriteString(line)
+	}
+}
+
+func (r *CaptureRecorder) Close() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+//sys package on device port starts with prefix and command key, see ParseSysPackage
+func isSysPackagePrefix(data []byte) bool {
+	if len(data) < SYS_PKG_PREF_LEN {
+		return false
+	}
+	for _, pref := range []byte{SYS_PKG_PREF_DEVICE, SYS_PKG_PREF_ALL} {
+		if data[0] == pref && data[1] == pref && data[2] == pref {
+			return true
+		}
+	}
+	return false
+}
+
+//Reads all frames from capture
+func ReadCapture(rd io.Reader) ([]CaptureFrame, error) {
+	var list []CaptureFrame
+	scanner := bufio.NewScanner(rd)
+	scanner.Buffer(make([]byte, 64 * 1024), CAPTURE_MAX_LINE_LEN)
+	line_n := 0
+	for scanner.Scan() {
+		line_n++
+		line := scanner.Text()
+		if line == "" {
+			continue
+		}
+		fields := strings.Split(line, CAPTURE_FIELD_SEP)
+		if len(fields) != CAPTURE_FIELD_CNT {
+			return nil, fmt.Errorf("capture line %d: %d fields, expected %d", line_n, len(fields), CAPTURE_FIELD_CNT)
+		}
+		tm, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("capture line %d: %v", line_n, err)
+		}
+		data, err := hex.DecodeString(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("capture line %d: %v", line_n, err)
+		}
+		list = append(list, CaptureFrame{Time: tm, Dir: fields[1], ServerID: fields[2], Remote: fields[3], IMEI: fields[4], Data: data})
+	}
+	return list, scanner.Err()
+}
+
+//Sets traffic recorder, old recorder is closed, nil stops capture
+func (a *Application) SetCapture(r *CaptureRecorder) {
+	a.mx.Lock()
+	old := a.capture
+	a.capture = r
+	a.mx.Unlock()
+	if old != nil {
+		old.Close()
+	}
+}
+
+func (a *Application) getCapture() *CaptureRecorder {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.capture
+}
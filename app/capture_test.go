@@ -0,0 +1,80 @@
+package app
+
+import(
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newCaptureSocket(t *testing.T, a *Application) *BaseSocket {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+	return &BaseSocket{App: a, Conn: c1, ServerID: "Arnavi"}
+}
+
+func TestCaptureBeforeIdentification(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "capture.txt")
+	rec, err := NewCaptureRecorder(CaptureConfig{File: file, IMEIs: []string{"111"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Application{}
+	a.SetCapture(rec)
+
+	//captured IMEI: handshake is recorded after identification
+	sock := newCaptureSocket(t, a)
+	sock.capture(CAPTURE_DIR_IN, []byte{0x01})
+	sock.capture(CAPTURE_DIR_IN, []byte{SYS_PKG_PREF_DEVICE, SYS_PKG_PREF_DEVICE, SYS_PKG_PREF_DEVICE, 'k', 'e', 'y'})
+	sock.SetIMEI("111")
+	sock.capture(CAPTURE_DIR_OUT, []byte{0x02})
+
+	//other IMEI: nothing is recorded
+	other := newCaptureSocket(t, a)
+	other.capture(CAPTURE_DIR_IN, []byte{0x03})
+	other.SetIMEI("222")
+	other.capture(CAPTURE_DIR_OUT, []byte{0x04})
+
+	//not identified connection
+	newCaptureSocket(t, a).capture(CAPTURE_DIR_IN, []byte{0x05})
+
+	a.SetCapture(nil)
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	frames, err := ReadCapture(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(frames) != 2 {
+		t.Fatalf("frames %+v", frames)
+	}
+	for i, dir := range []string{CAPTURE_DIR_IN, CAPTURE_DIR_OUT} {
+		if frames[i].IMEI != "111" || frames[i].Dir != dir || len(frames[i].Data) != 1 || frames[i].Data[0] != byte(i+1) {
+			t.Errorf("frame %d: %+v", i, frames[i])
+		}
+	}
+}
+
+func TestCapturePendingLimit(t *testing.T) {
+	rec, err := NewCaptureRecorder(CaptureConfig{File: filepath.Join(t.TempDir(), "capture.txt"), IMEIs: []string{"111"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := &Application{}
+	a.SetCapture(rec)
+	defer a.SetCapture(nil)
+	sock := newCaptureSocket(t, a)
+	data := make([]byte, 1024)
+	for i := 0; i < 2 * CAPTURE_PENDING_MAX_BYTES / len(data); i++ {
+		sock.capture(CAPTURE_DIR_IN, data)
+	}
+	if sock.capturePendingBytes > CAPTURE_PENDING_MAX_BYTES {
+		t.Fatalf("pending %d bytes", sock.capturePendingBytes)
+	}
+}
@@ -3,12 +3,17 @@ package app
 import(
 	"sync"
 	"net"
+	"log/slog"
 )
 
-//Interface for client sockets
-type ClientSocketer interface {
-	HandleConnection(int)
+//Protocol specific socket part: decoder and encoder
+type ProtocolSocketer interface {
+	HandleConnection(*Server)
 	WriteServCommand(payload []byte) error
+}
+
+//Common socket part, implemented by embedded BaseSocket
+type BaseSocketer interface {
 	SetStartTime()
 	Write([]byte)
 	GetRunTime() uint64
@@ -16,80 +21,198 @@ type ClientSocketer interface {
 	GetUploadedBytes() uint64
 	GetHandshakes() uint64
 	GetIMEI() string
+	GetDescr() string
 	SetConn(net.Conn)
 	SetApp(*Application)
+	SetLogger(*slog.Logger)
+	GetLogger() *slog.Logger
+	SetCloseReason(string)
+	GetSession() Session
+	SetOnline(bool)
+	AddSentCommand(string)
+	PopSentCommand() (string, bool)
+	Close() error
+}
+
+//Interface for client sockets
+type ClientSocketer interface {
+	ProtocolSocketer
+	BaseSocketer
 }
 
 type ClientSocketItem struct {
 	ID string
+	ServerID string
+	IMEI string //set on handshake
 	Socket ClientSocketer
 }
 
 //Structure for managing client sockets
 type ClientSocketList struct {
 	mx sync.RWMutex
-	m map[string]ClientSocketer //client connections		
+	m map[string]ClientSocketItem //client connections		
+	sockets map[ClientSocketer]string //socket index, socket ID
+	imei map[string][]string //IMEI index, socket IDs, the newest is the last
+	reconnects map[string]uint64 //handshakes of already connected IMEI, kept while IMEI has connections
+	reconnectsTotal uint64
+}
+
+func newClientSocketList() *ClientSocketList {
+	return &ClientSocketList{m: make(map[string]ClientSocketItem),
+		sockets: make(map[ClientSocketer]string),
+		imei: make(map[string][]string),
+		reconnects: make(map[string]uint64),
+	}
 }
 
-func (l *ClientSocketList) Append(socket ClientSocketer, id string) int{
+func (l *ClientSocketList) Append(socket ClientSocketer, id string, serverID string) int{
 	l.mx.Lock()
 	defer l.mx.Unlock()
 	
-	l.m[id] = socket
+	l.m[id] = ClientSocketItem{ID: id, ServerID: serverID, Socket: socket}
+	l.sockets[socket] = id
 	socket.SetStartTime()
 	return len(l.m)	
 }
 func (l *ClientSocketList) Remove(id string){
 	l.mx.Lock()
-	if _,ok := l.m[id]; ok {
-		delete(l.m,id) 
+	l.removeLocked(id)
+	l.mx.Unlock()
+}
+
+func (l *ClientSocketList) RemoveSocket(socket ClientSocketer){
+	l.mx.Lock()
+	if id, ok := l.sockets[socket]; ok {
+		l.removeLocked(id)
 	}
 	l.mx.Unlock()
 }
 
-func (l *ClientSocketList) Get(id string) ClientSocketer {
+//must be called under lock
+func (l *ClientSocketList) removeLocked(id string) {
+	it, ok := l.m[id]
+	if !ok {
+		return
+	}
+	l.removeIndex(it)
+	delete(l.sockets, it.Socket)
+	delete(l.m, id)
+}
+
+/**
+ * Sets socket IMEI on handshake, the socket becomes command target for IMEI.
+ * Returns other sockets connected with the same IMEI.
+ */
+func (l *ClientSocketList) SetIMEI(socket ClientSocketer, imei string) []ClientSocketItem {
 	l.mx.Lock()
 	defer l.mx.Unlock()
 	
-	if sock,ok := l.m[id]; ok {
-		return sock
+	id, ok := l.sockets[socket]
+	if !ok {
+		return nil
+	}
+	item := l.m[id]
+	l.removeIndex(item)
+	item.IMEI = imei
+	l.m[item.ID] = item
+	
+	var others []ClientSocketItem
+	for _, id := range l.imei[imei] {
+		others = append(others, l.m[id])
+	}
+	if len(others) > 0 {
+		l.reconnects[imei]++
+		l.reconnectsTotal++
+	}
+	l.imei[imei] = append(l.imei[imei], item.ID)
+	return others
+}
+
+//must be called under lock
+func (l *ClientSocketList) removeIndex(it ClientSocketItem) {
+	if it.IMEI == "" {
+		return
+	}
+	ids := l.imei[it.IMEI]
+	for i, id := range ids {
+		if id == it.ID {
+			ids = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		//map size is bounded by connected IMEIs
+		delete(l.imei, it.IMEI)
+		delete(l.reconnects, it.IMEI)
+	}else{
+		l.imei[it.IMEI] = ids
+	}
+}
+
+//reconnects of connected IMEI, total since start if empty
+func (l *ClientSocketList) GetReconnects(imei string) uint64 {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	
+	if imei != "" {
+		return l.reconnects[imei]
+	}
+	return l.reconnectsTotal
+}
+
+func (l *ClientSocketList) Get(id string) ClientSocketer {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	
+	if it,ok := l.m[id]; ok {
+		return it.Socket
 	}
 	return nil
 }
 
+//the newest socket with IMEI
 func (l *ClientSocketList) GetByIMEI(imei string) ClientSocketer {
-	l.mx.Lock()
-	defer l.mx.Unlock()
-	
-	for _, sock := range l.m {
-		if sock.GetIMEI() == imei {
-			return sock
-		}
+	if it, ok := l.GetItemByIMEI(imei); ok {
+		return it.Socket
 	}
 	return nil
 }
 
+func (l *ClientSocketList) GetItemByIMEI(imei string) (ClientSocketItem, bool) {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	
+	ids := l.imei[imei]
+	if len(ids) == 0 {
+		return ClientSocketItem{}, false
+	}
+	return l.m[ids[len(ids)-1]], true
+}
 
-func (l ClientSocketList) Len() int{
-	l.mx.Lock()
-	defer l.mx.Unlock()
+func (l *ClientSocketList) Len() int{
+	l.mx.RLock()
+	defer l.mx.RUnlock()
 	return len(l.m)
 }
 
-// Iterates over the events in the concurrent slice
-func (l *ClientSocketList) Iter() <-chan ClientSocketItem {
-	c := make(chan ClientSocketItem)
-
-	f := func() {
-		l.mx.Lock()
-		defer l.mx.Unlock()
-		for k, v := range l.m {
-			c <- ClientSocketItem{k, v}
-		}
-		close(c)
+//Copy of all items, the list is not locked by the caller
+func (l *ClientSocketList) Snapshot() []ClientSocketItem {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	list := make([]ClientSocketItem, 0, len(l.m))
+	for _, it := range l.m {
+		list = append(list, it)
 	}
-	go f()
+	return list
+}
 
+//Iterates over a snapshot of the list, abandoned channel does not block the list
+func (l *ClientSocketList) Iter() <-chan ClientSocketItem {
+	list := l.Snapshot()
+	c := make(chan ClientSocketItem, len(list))
+	for _, it := range list {
+		c <- it
+	}
+	close(c)
 	return c
 }
-
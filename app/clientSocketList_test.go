@@ -0,0 +1,194 @@
+package app
+
+import(
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+//socket without connection
+type testSocket struct {
+	BaseSocket
+	writeErr error //WriteServCommand result
+}
+
+func (sock *testSocket) HandleConnection(*Server) {}
+
+func (sock *testSocket) WriteServCommand(payload []byte) error {
+	return sock.writeErr
+}
+
+//Run with -race: connect, identify, iterate and disconnect concurrently,
+//readers must not wait for writers longer than a short lock.
+func TestClientSocketListStress(t *testing.T) {
+	const (
+		SOCKETS = 20000
+		IMEIS = 5000 //every IMEI reconnects
+		WORKERS = 16
+		MAX_CALL = 2 * time.Second
+	)
+	l := newClientSocketList()
+	stop := make(chan struct{})
+
+	var readers sync.WaitGroup
+	read_err := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				start := time.Now()
+				switch r {
+				case 0:
+					for it := range l.Iter() {
+						_ = it.Socket.GetIMEI()
+					}
+					//admin command rate, not a busy loop
+					time.Sleep(time.Millisecond)
+				case 1:
+					l.GetByIMEI(fmt.Sprintf("imei%d", i%IMEIS))
+				case 2:
+					l.GetReconnects("")
+					l.Len()
+				case 3:
+					l.Snapshot()
+					time.Sleep(time.Millisecond)
+				}
+				if d := time.Since(start); d > MAX_CALL {
+					read_err <- fmt.Errorf("reader %d blocked for %v", r, d)
+					return
+				}
+			}
+		}(r)
+	}
+
+	//all sockets are connected, then disconnected
+	per_worker := SOCKETS / WORKERS
+	socks := make([][]*testSocket, WORKERS)
+	var writers sync.WaitGroup
+	for w := 0; w < WORKERS; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; i < per_worker; i++ {
+				n := w*per_worker + i
+				sock := &testSocket{}
+				start := time.Now()
+				l.Append(sock, fmt.Sprintf("id%d", n), "srv")
+				l.SetIMEI(sock, fmt.Sprintf("imei%d", n%IMEIS))
+				if d := time.Since(start); d > MAX_CALL {
+					t.Errorf("connect blocked for %v", d)
+					return
+				}
+				socks[w] = append(socks[w], sock)
+			}
+		}(w)
+	}
+	writers.Wait()
+	if n := l.Len(); n != SOCKETS {
+		t.Fatalf("sockets connected: %d", n)
+	}
+	for w := 0; w < WORKERS; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for _, sock := range socks[w] {
+				l.RemoveSocket(sock)
+			}
+		}(w)
+	}
+	writers.Wait()
+	close(stop)
+	readers.Wait()
+	close(read_err)
+	for err := range read_err {
+		t.Fatal(err)
+	}
+
+	if n := l.Len(); n != 0 {
+		t.Fatalf("sockets left: %d", n)
+	}
+	if n := len(l.imei); n != 0 {
+		t.Fatalf("IMEI index not pruned: %d", n)
+	}
+	if n := len(l.reconnects); n != 0 {
+		t.Fatalf("reconnects not pruned: %d", n)
+	}
+	if n := l.GetReconnects(""); n != SOCKETS - IMEIS {
+		t.Fatalf("reconnects total %d, expected %d", n, SOCKETS - IMEIS)
+	}
+}
+
+func TestClientSocketListIMEI(t *testing.T) {
+	l := newClientSocketList()
+	s1, s2 := &testSocket{}, &testSocket{}
+	l.Append(s1, "1", "srv")
+	l.Append(s2, "2", "srv")
+	if others := l.SetIMEI(s1, "imei"); len(others) != 0 {
+		t.Fatalf("others on first handshake: %v", others)
+	}
+	if others := l.SetIMEI(s2, "imei"); len(others) != 1 || others[0].ID != "1" {
+		t.Fatalf("others: %v", others)
+	}
+	if l.GetByIMEI("imei") != s2 {
+		t.Fatal("the newest socket is not command target")
+	}
+	if n := l.GetReconnects("imei"); n != 1 {
+		t.Fatalf("reconnects %d", n)
+	}
+	l.RemoveSocket(s2)
+	if l.GetByIMEI("imei") != s1 {
+		t.Fatal("remaining socket is not command target")
+	}
+	l.Remove("1")
+	if l.GetByIMEI("imei") != nil || l.GetReconnects("imei") != 0 || l.GetReconnects("") != 1 {
+		t.Fatal("IMEI is not removed")
+	}
+}
+
+func fillSocketList(b *testing.B, n int) *ClientSocketList {
+	l := newClientSocketList()
+	for i := 0; i < n; i++ {
+		sock := &testSocket{}
+		l.Append(sock, fmt.Sprintf("id%d", i), "srv")
+		l.SetIMEI(sock, fmt.Sprintf("imei%d", i))
+	}
+	b.ResetTimer()
+	return l
+}
+
+func BenchmarkClientSocketListConnect(b *testing.B) {
+	l := fillSocketList(b, 10000)
+	for i := 0; i < b.N; i++ {
+		sock := &testSocket{}
+		id := fmt.Sprintf("b%d", i)
+		l.Append(sock, id, "srv")
+		l.SetIMEI(sock, fmt.Sprintf("imei%d", i%20000))
+		l.Remove(id)
+	}
+}
+
+func BenchmarkClientSocketListGetByIMEI(b *testing.B) {
+	l := fillSocketList(b, 10000)
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			l.GetByIMEI(fmt.Sprintf("imei%d", i%10000))
+			i++
+		}
+	})
+}
+
+func BenchmarkClientSocketListIter(b *testing.B) {
+	l := fillSocketList(b, 10000)
+	for i := 0; i < b.N; i++ {
+		for range l.Iter() {
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package app
+
+import(
+	"encoding/hex"
+)
+
+const CODEC_READ_BUFFER_LEN = 4096
+
+//Decoded part of device data
+type DecodeResult struct {
+	Frames int //number of decoded packages
+	IMEI string //device identification, not empty on handshake
+	Handshake bool
+	Records []TelematicsData //ID is device IMEI
+	Replies [][]byte //to be sent to device in order
+	Answers []byte //answer codes to server commands
+	Consumed int //bytes used from buffer, the rest is kept for next read
+}
+
+//Protocol decoder and encoder, one instance per connection
+type Codec interface {
+	Decode(buf []byte) (DecodeResult, error) //error is logged, result is processed
+	EncodeCommand(payload []byte) []byte
+}
+
+type NewCodecFunc = func() Codec
+
+//Client socket with generic connection loop over protocol codec
+type CodecSocket struct {
+	BaseSocket
+	Codec Codec
+}
+
+func NewCodecSocket(codec Codec) *CodecSocket {
+	return &CodecSocket{Codec: codec}
+}
+
+func (sock *CodecSocket) WriteServCommand(payload []byte) error {
+	sock.GetLogger().Debug("server command", "payload", hex.EncodeToString(payload))
+	return sock.WriteData(sock.Codec.EncodeCommand(payload))
+}
+
+func (sock *CodecSocket) HandleConnection(srv *Server) {
+	defer sock.Conn.Close()
+
+	buf := make([]byte, CODEC_READ_BUFFER_LEN)
+	data_len := 0 //not consumed bytes at buffer start
+	for {
+		if sock.App.IsStopping() {
+			sock.GetLogger().Info("closed on server shutdown")
+			sock.SetCloseReason(SESSION_CLOSE_SHUTDOWN)
+			return
+		}
+		n, err := sock.Read(buf[data_len:], srv)
+		if err != nil {
+			sock.LogReadError(err)
+			return
+		}
+		sock.GetLogger().Debug("package received", "bytes", n)
+
+		if data_len == 0 && sock.App.IsSysPackage(buf, n, sock) {
+			continue
+		}
+		data_len += n
+
+		res, err := sock.Codec.Decode(buf[:data_len])
+		if err != nil {
+			sock.GetLogger().Warn("decode failed", LOG_KEY_ERR, err)
+			sock.IncDecodeErrors(decodeErrorKind(err))
+		}
+		if len(res.Records) > 0 {
+			sock.IncRecords(len(res.Records))
+		}
+		if !sock.processResult(&res) {
+			return
+		}
+
+		if res.Consumed >= data_len {
+			data_len = 0
+
+		}else if res.Consumed > 0 {
+			copy(buf, buf[res.Consumed:data_len])
+			data_len -= res.Consumed
+
+		}else if data_len == len(buf) {
+			sock.GetLogger().Warn("buffer overflow, data dropped", "bytes", data_len)
+			sock.IncDecodeErrors(DECODE_ERR_OVERFLOW)
+			data_len = 0
+		}
+	}
+}
+
+//returns false if connection must be closed
+func (sock *CodecSocket) processResult(res *DecodeResult) bool {
+	deliver := false
+	if res.IMEI != "" && res.IMEI != sock.GetIMEI() {
+		deliver = (sock.GetIMEI() == "")
+		if !sock.identify(res.IMEI) {
+			return false
+		}
+	}
+
+	for i := range res.Records {
+		rec := &res.Records[i]
+		if rec.ID != sock.GetIMEI() {
+			deliver = deliver || (sock.GetIMEI() == "")
+			if !sock.identify(rec.ID) {
+				return false
+			}
+		}
+		rec.ID = sock.DeviceID
+		rec.IMEI = sock.GetIMEI()
+		rec.ServerID, rec.Protocol = sock.ServerID, sock.Protocol
+		if !sock.Quarantined {
+			sock.App.Storage.Write(rec)
+			sock.UpdateDeviceState(rec)
+		}
+		sock.GetLogger().Debug("packet decoded", "record", *rec)
+	}
+
+	for _, reply := range res.Replies {
+		if sock.WriteData(reply) != nil {
+			return false
+		}
+	}
+
+	for _, code := range res.Answers {
+		sock.GetLogger().Debug("answer to command", "code", code)
+		sock.App.SetCommandAnswer(sock, code)
+	}
+
+	if res.Handshake {
+		sock.IncHandshakes()
+		deliver = true
+	}
+	if deliver {
+		sock.App.DeliverQueuedCommands(sock)
+	}
+	return true
+}
+
+//returns false if device is rejected
+func (sock *CodecSocket) identify(imei string) bool {
+	sock.SetIMEI(imei)
+	dev_id, dev_res := sock.App.IdentifyDevice(sock, imei)
+	if dev_res == DEVICE_REJECTED {
+		sock.SetCloseReason(SESSION_CLOSE_REJECTED)
+		return false
+	}
+	sock.SetDevice(dev_id, dev_res)
+	sock.SetOnline(true)
+	return true
+}
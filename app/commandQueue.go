@@ -0,0 +1,258 @@
+package app
+
+import(
+	"os"
+	"time"
+	"sync"
+	"path/filepath"
+	"encoding/json"
+	"encoding/hex"
+	"io/ioutil"
+	"log/slog"
+)
+
+const (
+	CMD_QUEUE_FILE_NAME = "commands.json"
+	CMD_QUEUE_DEF_TTL_SEC = 86400
+	CMD_QUEUE_KEEP_HOURS = 24 //finished commands are kept for status queries
+	CMD_QUEUE_DEF_MAX_ATTEMPTS = 5 //failed writes before the command is failed
+	CMD_SENT_MAX = 64 //commands waiting for answer on a socket, the oldest are dropped
+
+	CMD_STATE_QUEUED = "queued"
+	CMD_STATE_DELIVERED = "delivered"
+	CMD_STATE_ANSWERED = "answered"
+	CMD_STATE_EXPIRED = "expired"
+	CMD_STATE_FAILED = "failed"
+)
+
+//Command waiting for an offline device
+type QueuedCommand struct {
+	ID string `json:"id"`
+	IMEI string `json:"imei"`
+	Payload string `json:"payload"` //hex
+	State string `json:"state"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	Delivered *time.Time `json:"delivered,omitempty"`
+	Answered *time.Time `json:"answered,omitempty"`
+	AnswerCode *byte `json:"answerCode,omitempty"`
+	Attempts int `json:"attempts,omitempty"` //failed delivery attempts
+	LastError string `json:"lastError,omitempty"`
+	sending bool //write is in progress
+}
+
+//Persistent command queue, stored in a local file.
+//Commands for offline devices are delivered right after the next handshake.
+type CommandQueue struct {
+	FileName string
+	TTLSec int
+	MaxAttempts int //CMD_QUEUE_DEF_MAX_ATTEMPTS by default
+	Logger *slog.Logger
+	mx sync.Mutex
+	commands []*QueuedCommand
+}
+
+func (q *CommandQueue) Init(fileName string, logger *slog.Logger) error {
+	if fileName == "" {
+		fileName = filepath.Dir(os.Args[0]) + "/" + CMD_QUEUE_FILE_NAME
+	}
+	if q.TTLSec == 0 {
+		q.TTLSec = CMD_QUEUE_DEF_TTL_SEC
+	}
+	if q.MaxAttempts <= 0 {
+		q.MaxAttempts = CMD_QUEUE_DEF_MAX_ATTEMPTS
+	}
+	q.FileName = fileName
+	q.Logger = logger
+
+	file, err := ioutil.ReadFile(q.FileName)
+	if os.IsNotExist(err) {
+		return nil
+
+	}else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(file, &q.commands); err != nil {
+		return err
+	}
+	q.Logger.Info("CommandQueue: commands loaded", "commands", len(q.commands), "file", q.FileName)
+	return nil
+}
+
+//Adds command to the queue, returns queued command
+func (q *CommandQueue) Add(imei string, payload []byte) (*QueuedCommand, error) {
+	id, err := genID()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	cmd := &QueuedCommand{ID: id,
+		IMEI: imei,
+		Payload: hex.EncodeToString(payload),
+		State: CMD_STATE_QUEUED,
+		Created: now,
+		Expires: now.Add(time.Duration(q.TTLSec) * time.Second),
+	}
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	q.commands = append(q.commands, cmd)
+	q.save()
+
+	c := *cmd
+	return &c, nil
+}
+
+//Returns queued commands for the IMEI, all commands if imei is empty
+func (q *CommandQueue) List(imei string) []QueuedCommand {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	q.expire()
+	list := make([]QueuedCommand, 0)
+	for _, cmd := range q.commands {
+		if imei == "" || cmd.IMEI == imei {
+			list = append(list, *cmd)
+		}
+	}
+	return list
+}
+
+//number of commands waiting for delivery
+func (q *CommandQueue) QueuedCount() int {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	cnt := 0
+	for _, cmd := range q.commands {
+		if cmd.State == CMD_STATE_QUEUED {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+//Sends all pending commands to the socket.
+//Socket writes are done without lock, a failed command stays queued
+//till MaxAttempts failed writes.
+func (q *CommandQueue) Deliver(sock ClientSocketer) {
+	imei := sock.GetIMEI()
+	if imei == "" {
+		return
+	}
+
+	q.mx.Lock()
+	q.expire()
+	pending := make([]*QueuedCommand, 0)
+	for _, cmd := range q.commands {
+		if cmd.IMEI == imei && cmd.State == CMD_STATE_QUEUED && !cmd.sending {
+			cmd.sending = true
+			pending = append(pending, cmd)
+		}
+	}
+	payloads := make([]string, len(pending))
+	for i, cmd := range pending {
+		payloads[i] = cmd.Payload
+	}
+	q.mx.Unlock()
+
+	if len(pending) == 0 {
+		return
+	}
+	results := make([]error, len(pending))
+	for i, cmd := range pending {
+		payload, err := hex.DecodeString(payloads[i])
+		if err == nil {
+			err = sock.WriteServCommand(payload)
+		}
+		results[i] = err
+		if err != nil {
+			sock.GetLogger().Error("CommandQueue: command delivery failed", "command_id", cmd.ID, LOG_KEY_ERR, err)
+			//next commands would fail on the same socket
+			for j := i + 1; j < len(pending); j++ {
+				results[j] = err
+			}
+			break
+		}
+		sock.AddSentCommand(cmd.ID)
+		sock.GetLogger().Info("CommandQueue: command delivered", "command_id", cmd.ID)
+	}
+
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	now := time.Now()
+	for i, cmd := range pending {
+		cmd.sending = false
+		if cmd.State != CMD_STATE_QUEUED {
+			continue
+		}
+		if results[i] == nil {
+			cmd.State = CMD_STATE_DELIVERED
+			cmd.Delivered = &now
+			continue
+		}
+		cmd.Attempts++
+		cmd.LastError = results[i].Error()
+		if cmd.Attempts >= q.MaxAttempts {
+			sock.GetLogger().Error("CommandQueue: command failed", "command_id", cmd.ID, "attempts", cmd.Attempts)
+			cmd.State = CMD_STATE_FAILED
+		}
+	}
+	q.save()
+}
+
+/**
+ * Marks delivered command as answered. Device answers carry only the result
+ * code, answers are matched to commands in send order, see BaseSocket.PopSentCommand.
+ */
+func (q *CommandQueue) SetAnswer(imei string, id string, code byte) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+
+	for _, cmd := range q.commands {
+		if cmd.ID == id && cmd.IMEI == imei && cmd.State == CMD_STATE_DELIVERED {
+			now := time.Now()
+			cmd.State = CMD_STATE_ANSWERED
+			cmd.Answered = &now
+			cmd.AnswerCode = &code
+			q.save()
+			return
+		}
+	}
+}
+
+//marks expired commands, removes old finished ones
+//must be called under lock
+func (q *CommandQueue) expire() {
+	now := time.Now()
+	keep_from := now.Add(-time.Duration(CMD_QUEUE_KEEP_HOURS) * time.Hour)
+	changed := false
+	list := q.commands[:0]
+	for _, cmd := range q.commands {
+		if cmd.State == CMD_STATE_QUEUED && now.After(cmd.Expires) {
+			cmd.State = CMD_STATE_EXPIRED
+			changed = true
+		}
+		if cmd.State != CMD_STATE_QUEUED && cmd.Expires.Before(keep_from) {
+			changed = true
+			continue
+		}
+		list = append(list, cmd)
+	}
+	q.commands = list
+	if changed {
+		q.save()
+	}
+}
+
+//must be called under lock
+func (q *CommandQueue) save() {
+	cont_b, err := json.Marshal(q.commands)
+	if err == nil {
+		err = ioutil.WriteFile(q.FileName, cont_b, 0644)
+	}
+	if err != nil {
+		q.Logger.Error("CommandQueue save failed", LOG_KEY_ERR, err)
+	}
+}
@@ -0,0 +1,56 @@
+package app
+
+import(
+	"io"
+	"testing"
+	"log/slog"
+	"path/filepath"
+)
+
+func newTestCommandQueue(t *testing.T) *CommandQueue {
+	q := &CommandQueue{}
+	if err := q.Init(filepath.Join(t.TempDir(), CMD_QUEUE_FILE_NAME), slog.New(slog.NewTextHandler(io.Discard, nil))); err != nil {
+		t.Fatal(err)
+	}
+	return q
+}
+
+//answers are matched in send order, answer to direct command does not mark queued command
+func TestCommandAnswer(t *testing.T) {
+	a := &Application{Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	a.CommandQueue = newTestCommandQueue(t)
+	sock := &testSocket{BaseSocket: BaseSocket{App: a}}
+	sock.SetIMEI("111")
+
+	first, _ := a.CommandQueue.Add("111", []byte{1})
+	second, _ := a.CommandQueue.Add("111", []byte{2})
+	a.CommandQueue.Deliver(sock)
+
+	//direct command sent after queued commands
+	sock.AddSentCommand("")
+	a.SetCommandAnswer(sock, 1)
+	a.SetCommandAnswer(sock, 2)
+	a.SetCommandAnswer(sock, 3)
+	//not sent command
+	a.SetCommandAnswer(sock, 4)
+
+	states := make(map[string]QueuedCommand)
+	for _, cmd := range a.CommandQueue.List("111") {
+		states[cmd.ID] = cmd
+	}
+	if cmd := states[first.ID]; cmd.State != CMD_STATE_ANSWERED || *cmd.AnswerCode != 1 {
+		t.Fatalf("first command %s", cmd.State)
+	}
+	if cmd := states[second.ID]; cmd.State != CMD_STATE_ANSWERED || *cmd.AnswerCode != 2 {
+		t.Fatalf("second command %s", cmd.State)
+	}
+
+	//direct command answer comes before queued command answer
+	third, _ := a.CommandQueue.Add("111", []byte{3})
+	sock.AddSentCommand("")
+	a.CommandQueue.Deliver(sock)
+	a.SetCommandAnswer(sock, 5)
+	if cmd := a.CommandQueue.List("111")[2]; cmd.ID != third.ID || cmd.State != CMD_STATE_DELIVERED {
+		t.Fatalf("queued command marked by direct command answer: %s", cmd.State)
+	}
+}
@@ -0,0 +1,175 @@
+package app
+
+import(
+	"time"
+	"sync"
+	"errors"
+	"io/ioutil"
+	"encoding/json"
+	"log/slog"
+)
+
+const (
+	REG_POLICY_ACCEPT = "accept" //unknown devices are accepted, IMEI is used as ID
+	REG_POLICY_QUARANTINE = "quarantine" //unknown devices are connected, data is not stored
+	REG_POLICY_REJECT = "reject" //unknown devices are disconnected
+
+	REG_SOURCE_FILE = "file"
+	REG_SOURCE_STORAGE = "storage"
+)
+
+//Device identification result
+const (
+	DEVICE_ACCEPTED = iota
+	DEVICE_QUARANTINED
+	DEVICE_REJECTED
+)
+
+//Registered device
+type Device struct {
+	IMEI string `json:"imei"`
+	VehicleID string `json:"vehicleId"`
+	Owner string `json:"owner"`
+	Protocol string `json:"protocol"`
+	Timezone string `json:"timezone"`
+}
+
+//Source of registered devices
+type DeviceLoader interface {
+	LoadDevices() ([]Device, error)
+}
+
+//Devices from json file
+type FileDeviceLoader struct {
+	FileName string
+}
+
+func (l *FileDeviceLoader) LoadDevices() ([]Device, error) {
+	file, err := ioutil.ReadFile(l.FileName)
+	if err != nil {
+		return nil, err
+	}
+	var list []Device
+	if err := json.Unmarshal(file, &list); err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+//IMEI allow-list with vehicle mapping
+type DeviceRegistry struct {
+	Policy string
+	Loader DeviceLoader
+	RefreshSec int //0 - no periodic refresh
+	Logger *slog.Logger
+	mx sync.RWMutex
+	devices map[string]Device
+	unknown map[string]time.Time //unknown IMEIs, last connection time
+}
+
+func (r *DeviceRegistry) Init(logger *slog.Logger) error {
+	r.Logger = logger
+	if err := r.SetPolicy(r.Policy); err != nil {
+		return err
+	}
+	r.unknown = make(map[string]time.Time)
+	if err := r.Refresh(); err != nil {
+		return err
+	}
+	if r.RefreshSec > 0 {
+		go func() {
+			for {
+				time.Sleep(time.Duration(r.RefreshSec) * time.Second)
+				if err := r.Refresh(); err != nil {
+					r.Logger.Error("DeviceRegistry Refresh failed", LOG_KEY_ERR, err)
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+//Sets policy for unknown devices, can be called while running
+func (r *DeviceRegistry) SetPolicy(policy string) error {
+	switch policy {
+	case "":
+		policy = REG_POLICY_ACCEPT
+	case REG_POLICY_ACCEPT, REG_POLICY_QUARANTINE, REG_POLICY_REJECT:
+	default:
+		return errors.New("DeviceRegistry: unknown policy "+policy)
+	}
+	r.mx.Lock()
+	r.Policy = policy
+	r.mx.Unlock()
+	return nil
+}
+
+func (r *DeviceRegistry) GetPolicy() string {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return r.Policy
+}
+
+//Reloads devices, old list is kept on error
+func (r *DeviceRegistry) Refresh() error {
+	list, err := r.Loader.LoadDevices()
+	if err != nil {
+		return err
+	}
+	devices := make(map[string]Device, len(list))
+	for _, dev := range list {
+		devices[dev.IMEI] = dev
+	}
+	r.mx.Lock()
+	r.devices = devices
+	r.mx.Unlock()
+	r.Logger.Info("DeviceRegistry: devices loaded", "devices", len(devices), "policy", r.GetPolicy())
+	return nil
+}
+
+func (r *DeviceRegistry) Get(imei string) (Device, bool) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	dev, ok := r.devices[imei]
+	return dev, ok
+}
+
+func (r *DeviceRegistry) Len() int {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return len(r.devices)
+}
+
+//Unknown devices seen since start
+func (r *DeviceRegistry) GetUnknown() map[string]time.Time {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	list := make(map[string]time.Time, len(r.unknown))
+	for imei, tm := range r.unknown {
+		list[imei] = tm
+	}
+	return list
+}
+
+//Returns ID for storage and identification result
+func (r *DeviceRegistry) Identify(imei string) (string, int) {
+	if dev, ok := r.Get(imei); ok {
+		if dev.VehicleID == "" {
+			return imei, DEVICE_ACCEPTED
+		}
+		return dev.VehicleID, DEVICE_ACCEPTED
+	}
+
+	r.mx.Lock()
+	r.unknown[imei] = time.Now()
+	policy := r.Policy
+	r.mx.Unlock()
+
+	switch policy {
+	case REG_POLICY_QUARANTINE:
+		return imei, DEVICE_QUARANTINED
+	case REG_POLICY_REJECT:
+		return imei, DEVICE_REJECTED
+	}
+	return imei, DEVICE_ACCEPTED
+}
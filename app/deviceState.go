@@ -0,0 +1,127 @@
+package app
+
+/**
+ * Current device state for dispatch: online flag, server, last packet,
+ * last valid position and voltage. Written through the storage on device
+ * identification, on records and on disconnect, see DeviceStateWriter.
+ * Record updates of a device are written not more often than ThrottleSec,
+ * online changes are written at once with the last record of the connection.
+ */
+
+import(
+	"time"
+)
+
+//Device state parameters, state is not written if not set
+type DeviceStateConfig struct {
+	ThrottleSec int `json:"throttleSec"` //minimal interval of record updates of a device, 0 - every record
+}
+
+type DeviceState struct {
+	IMEI string
+	DeviceID string //storage ID, see IdentifyDevice
+	Online bool
+	ServerID string
+	Protocol string
+	RemoteAddr string
+	Time time.Time //state time, storage must not overwrite newer state with older one
+	LastRecord *TelematicsData //nil - no records in connection, stored values are kept
+	LastPosition *TelematicsData //record with valid GPS and the latest GPS time, nil - stored position is kept
+}
+
+//Storage keeping current device state
+type DeviceStateWriter interface {
+	WriteDeviceState(*DeviceState)
+}
+
+//nil disables device state
+func (a *Application) SetDeviceStateConfig(conf *DeviceStateConfig) {
+	a.mx.Lock()
+	if conf == nil {
+		a.deviceState = nil
+	}else{
+		c := *conf
+		a.deviceState = &c
+	}
+	a.mx.Unlock()
+}
+
+//storage writer and throttle interval, nil if device state is disabled
+func (a *Application) deviceStateWriter() (DeviceStateWriter, time.Duration) {
+	a.mx.RLock()
+	conf := a.deviceState
+	a.mx.RUnlock()
+	if conf == nil {
+		return nil, 0
+	}
+	w, ok := a.Storage.(DeviceStateWriter)
+	if !ok {
+		return nil, 0
+	}
+	return w, time.Duration(conf.ThrottleSec) * time.Second
+}
+
+//Writes online state of identified device. Offline state is not written
+//while other connection of the same IMEI is alive.
+func (sock *BaseSocket) SetOnline(online bool) {
+	w, _ := sock.App.deviceStateWriter()
+	if w == nil {
+		return
+	}
+	imei := sock.GetIMEI()
+	if imei == "" {
+		return
+	}
+	if !online && sock.App.ClientSockets.GetByIMEI(imei) != nil {
+		return
+	}
+	sock.mx.Lock()
+	if sock.Quarantined || (!online && sock.stateWritten.IsZero()) {
+		//rejected devices are not online
+		sock.mx.Unlock()
+		return
+	}
+	state := sock.deviceStateLocked(online)
+	sock.mx.Unlock()
+	w.WriteDeviceState(&state)
+}
+
+//Keeps decoded record, state is written if throttle interval has passed
+func (sock *BaseSocket) UpdateDeviceState(rec *TelematicsData) {
+	w, throttle := sock.App.deviceStateWriter()
+	if w == nil {
+		return
+	}
+	r := *rec
+	sock.mx.Lock()
+	if sock.Quarantined {
+		sock.mx.Unlock()
+		return
+	}
+	sock.stateRecord = &r
+	if r.GPSValid && (sock.statePosition == nil || !r.GPSTime.Before(sock.statePosition.GPSTime)) {
+		sock.statePosition = &r
+	}
+	if time.Since(sock.stateWritten) < throttle {
+		sock.mx.Unlock()
+		return
+	}
+	state := sock.deviceStateLocked(true)
+	sock.mx.Unlock()
+	w.WriteDeviceState(&state)
+}
+
+//sock.mx must be locked
+func (sock *BaseSocket) deviceStateLocked(online bool) DeviceState {
+	sock.stateWritten = time.Now()
+	return DeviceState{IMEI: sock.IMEI,
+		DeviceID: sock.DeviceID,
+		Online: online,
+		ServerID: sock.ServerID,
+		Protocol: sock.Protocol,
+		RemoteAddr: sock.Conn.RemoteAddr().String(),
+		Time: sock.stateWritten,
+		LastRecord: sock.stateRecord,
+		LastPosition: sock.statePosition,
+	}
+}
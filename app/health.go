@@ -0,0 +1,131 @@
+package app
+
+/**
+ * Liveness and readiness checks for orchestrators, see httpHealth, httpReady.
+ * Health: process is running, device listeners are accepting.
+ * Readiness: healthy, not stopping, storage is reachable or spool is below ReadySpoolMaxBytes.
+ */
+
+import(
+	"fmt"
+	"time"
+	"errors"
+	"context"
+)
+
+const (
+	HEALTH_PATH = "/healthz"
+	READY_PATH = "/readyz"
+
+	HEALTH_STATUS_OK = "ok"
+	HEALTH_STATUS_FAIL = "fail"
+
+	STORAGE_CHECK_TIMEOUT_SEC = 5
+	STORAGE_CHECK_CACHE_SEC = 10 //storage is not checked more often
+)
+
+//Storage with connectivity check
+type StorageChecker interface {
+	CheckStorage(ctx context.Context) error
+}
+
+type HealthCheck struct {
+	Name string `json:"name"`
+	OK bool `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string `json:"status"`
+	Checks []HealthCheck `json:"checks"`
+}
+
+func (r *HealthReport) add(name string, err error) {
+	check := HealthCheck{Name: name, OK: (err == nil)}
+	if err != nil {
+		check.Error = err.Error()
+		r.Status = HEALTH_STATUS_FAIL
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+func (r *HealthReport) OK() bool {
+	return r.Status == HEALTH_STATUS_OK
+}
+
+//last storage check result
+type storageCheck struct {
+	time time.Time
+	err error
+}
+
+//Device listeners are accepting connections
+func (a *Application) CheckHealth() HealthReport {
+	report := HealthReport{Status: HEALTH_STATUS_OK, Checks: make([]HealthCheck, 0)}
+	for _, srv := range a.GetServers() {
+		report.add("server "+srv.ID, srv.GetAcceptErr())
+	}
+	return report
+}
+
+//Health checks, shutdown state and storage
+func (a *Application) CheckReady(ctx context.Context) HealthReport {
+	report := a.CheckHealth()
+	if a.IsStopping() {
+		report.add("shutdown", errors.New("application is stopping"))
+	}
+	if a.Storage != nil {
+		report.add("storage", a.checkStorage(ctx))
+	}
+	return report
+}
+
+//cached storage check, failed storage is accepted while spool is small
+func (a *Application) checkStorage(ctx context.Context) error {
+	checker, ok := a.Storage.(StorageChecker)
+	if !ok {
+		return nil
+	}
+	a.mx.Lock()
+	last := a.lastStorageCheck
+	a.mx.Unlock()
+
+	err := last.err
+	if time.Since(last.time) >= time.Duration(STORAGE_CHECK_CACHE_SEC) * time.Second {
+		check_ctx, cancel := context.WithTimeout(ctx, time.Duration(STORAGE_CHECK_TIMEOUT_SEC) * time.Second)
+		err = checker.CheckStorage(check_ctx)
+		cancel()
+		a.mx.Lock()
+		a.lastStorageCheck = storageCheck{time: time.Now(), err: err}
+		a.mx.Unlock()
+	}
+	if err == nil {
+		return nil
+	}
+
+	spool_max := a.GetReadySpoolMaxBytes()
+	if st, ok := a.Storage.(StorageMetricser); ok && spool_max > 0 {
+		var spool_bytes int64
+		for _, m := range st.GetStorageMetrics() {
+			spool_bytes += m.SpoolBytes
+		}
+		if spool_bytes < spool_max {
+			a.Logger.Debug("storage is not reachable, spool is below threshold", LOG_KEY_ERR, err, "spool_bytes", spool_bytes)
+			return nil
+		}
+		return fmt.Errorf("%v, spool %d bytes", err, spool_bytes)
+	}
+	return err
+}
+
+func (a *Application) SetReadySpoolMaxBytes(v int64) {
+	a.mx.Lock()
+	a.ReadySpoolMaxBytes = v
+	a.mx.Unlock()
+}
+
+func (a *Application) GetReadySpoolMaxBytes() int64 {
+	a.mx.RLock()
+	defer a.mx.RUnlock()
+	return a.ReadySpoolMaxBytes
+}
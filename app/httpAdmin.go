@@ -0,0 +1,364 @@
+package app
+
+import(
+	"fmt"
+	"time"
+	"strings"
+	"strconv"
+	"net/http"
+	"encoding/json"
+	"encoding/hex"
+	"crypto/hmac"
+	"crypto/sha256"
+)
+
+const (
+	HTTP_TOKEN_SALT = "telsrv-http-admin"
+	HTTP_DEVICES_PATH = "/devices"
+	HTTP_SERVERS_PATH = "/servers"
+	HTTP_COMMANDS_PATH = "commands"
+	HTTP_SESSIONS_PATH = "sessions"
+
+	HTTP_TOKEN_MAX_TTL_HOURS = 720 //tokens with later expiration are rejected
+	HTTP_READ_HEADER_TIMEOUT_SEC = 10
+	HTTP_READ_TIMEOUT_SEC = 30
+	HTTP_WRITE_TIMEOUT_SEC = 60 //track queries take up to TRACK_QUERY_TIMEOUT_SEC
+	HTTP_IDLE_TIMEOUT_SEC = 120
+)
+
+type HTTPServerStat struct {
+	ID string `json:"id"`
+	Addr string `json:"addr"`
+	StartTime time.Time `json:"startTime"`
+	ClientCount int `json:"clientCount"`
+}
+
+type HTTPServerList struct {
+	Servers []HTTPServerStat `json:"servers"`
+	ClientCount int `json:"clientCount"`
+	RunTime uint64 `json:"runTime"`
+	MaxClientCount int `json:"maxClientCount"`
+	DownloadedBytes uint64 `json:"downloadedBytes"`
+	UploadedBytes uint64 `json:"uploadedBytes"`
+	Handshakes uint64 `json:"handshakes"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+type HTTPDevice struct {
+	IMEI string `json:"imei"`
+	Server string `json:"server"`
+	RunTime uint64 `json:"runTime"`
+	DownloadedBytes uint64 `json:"downloadedBytes"`
+	UploadedBytes uint64 `json:"uploadedBytes"`
+	Handshakes uint64 `json:"handshakes"`
+	Reconnects uint64 `json:"reconnects"`
+}
+
+type HTTPCommand struct {
+	Payload string `json:"payload"` //hex
+}
+
+type HTTPCommandResult struct {
+	State string `json:"state"`
+	Command *QueuedCommand `json:"command,omitempty"`
+}
+
+type HTTPError struct {
+	Err string `json:"err"`
+}
+
+//Token for HTTP admin API valid till expires: <unix time>.<hex HMAC-SHA256 of salt and time with API key>
+func HTTPAdminToken(key string, expires time.Time) string {
+	exp := strconv.FormatInt(expires.Unix(), 10)
+	return exp + "." + httpTokenMAC(key, exp)
+}
+
+func httpTokenMAC(key string, exp string) string {
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(HTTP_TOKEN_SALT + ":" + exp))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//expiration of token, false if expired or too long-lived
+func httpTokenExpires(token string) (string, string, bool) {
+	exp, mac, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", false
+	}
+	exp_unix, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil {
+		return "", "", false
+	}
+	now := time.Now()
+	expires := time.Unix(exp_unix, 0)
+	if !expires.After(now) || expires.After(now.Add(time.Duration(HTTP_TOKEN_MAX_TTL_HOURS) * time.Hour)) {
+		return "", "", false
+	}
+	return exp, mac, true
+}
+
+//HTTP/JSON admin server
+func (a *Application) RunHTTPAdmin(host string, port int, tlsConf *TLSConfig) {
+	a.init()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(HTTP_SERVERS_PATH, a.httpAuth(a.httpServers))
+	mux.HandleFunc(HTTP_DEVICES_PATH, a.httpAuth(a.httpDevices))
+	mux.HandleFunc(HTTP_DEVICES_PATH+"/", a.httpAuth(a.httpDevice))
+	mux.HandleFunc(HTTP_TRACKS_PATH+"/", a.httpAuth(a.httpTrack))
+	//probes, no authorization
+	mux.HandleFunc(HEALTH_PATH, a.httpHealth)
+	mux.HandleFunc(READY_PATH, a.httpReady)
+	if a.MetricsAuth {
+		mux.HandleFunc(METRICS_PATH, a.httpAuth(a.httpMetrics))
+	}else{
+		mux.HandleFunc(METRICS_PATH, func(w http.ResponseWriter, r *http.Request) {
+			a.httpMetrics(w, r, APIKey{})
+		})
+	}
+
+	srv_addr := fmt.Sprintf("%s:%d",host, port)
+	l, err := a.listen(srv_addr, tlsConf)
+	if err != nil {
+		LogFatal(a.Logger, "HTTP admin listen failed", LOG_KEY_ERR, err)
+	}
+	if !a.addListener(l) {
+		l.Close()
+		return
+	}
+	a.Logger.Info("HTTP admin server started", "addr", srv_addr)
+	srv := &http.Server{Handler: mux,
+		ReadHeaderTimeout: time.Duration(HTTP_READ_HEADER_TIMEOUT_SEC) * time.Second,
+		ReadTimeout: time.Duration(HTTP_READ_TIMEOUT_SEC) * time.Second,
+		WriteTimeout: time.Duration(HTTP_WRITE_TIMEOUT_SEC) * time.Second,
+		IdleTimeout: time.Duration(HTTP_IDLE_TIMEOUT_SEC) * time.Second,
+	}
+	if err := srv.Serve(l); err != nil && !a.IsStopping() {
+		LogFatal(a.Logger, "http.Serve failed", LOG_KEY_ERR, err)
+	}
+	a.Logger.Info("HTTP admin server stopped")
+}
+
+type httpHandlerFunc = func(http.ResponseWriter, *http.Request, APIKey)
+
+//checks Authorization: Bearer <token>, token of any API key
+func (a *Application) httpAuth(next httpHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		auth := r.Header.Get("Authorization")
+		var key APIKey
+		var ok bool
+		if strings.HasPrefix(auth, "Bearer ") {
+			key, ok = a.GetAPIKeyByToken(strings.TrimPrefix(auth, "Bearer "))
+		}
+		if !ok {
+			a.Logger.Warn("HTTP admin: unauthorized request", "method", r.Method, "path", r.URL.Path, LOG_KEY_REMOTE_ADDR, r.RemoteAddr)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			httpWriteError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		a.Logger.Info("AUDIT", "key", key.Name, "role", key.Role, LOG_KEY_REMOTE_ADDR, r.RemoteAddr, "method", r.Method, "path", r.URL.Path)
+		next(w, r, key)
+	}
+}
+
+//GET /servers
+func (a *Application) httpServers(w http.ResponseWriter, r *http.Request, key APIKey) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	srv_clients := make(map[string]int)
+	for it := range a.ClientSockets.Iter() {
+		srv_clients[it.ServerID]++
+	}
+	list := HTTPServerList{Servers: make([]HTTPServerStat, 0),
+		ClientCount: a.ClientSockets.Len(),
+		RunTime: uint64(time.Now().Sub(a.GetStartTime()).Seconds()),
+		MaxClientCount: a.GetMaxClientCount(),
+		DownloadedBytes: a.GetDownloadedBytes(),
+		UploadedBytes: a.GetUploadedBytes(),
+		Handshakes: a.GetHandshakes(),
+		Reconnects: a.ClientSockets.GetReconnects(""),
+	}
+	for _, srv := range a.GetServers() {
+		list.Servers = append(list.Servers, HTTPServerStat{ID: srv.ID,
+			Addr: srv.Addr,
+			StartTime: srv.StartTime,
+			ClientCount: srv_clients[srv.ID],
+		})
+	}
+	httpWriteJSON(w, http.StatusOK, list)
+}
+
+//GET /metrics, Prometheus text format
+func (a *Application) httpMetrics(w http.ResponseWriter, r *http.Request, key APIKey) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", METRICS_CONTENT_TYPE)
+	a.WriteMetrics(w)
+}
+
+//GET /healthz, 503 if a check fails
+func (a *Application) httpHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	httpWriteHealth(w, a.CheckHealth())
+}
+
+//GET /readyz, 503 if a check fails
+func (a *Application) httpReady(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	httpWriteHealth(w, a.CheckReady(r.Context()))
+}
+
+func (a *Application) httpSessions(w http.ResponseWriter, r *http.Request, imei string) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			httpWriteError(w, http.StatusBadRequest, "limit must be positive integer")
+			return
+		}
+	}
+	list, err := a.GetSessions(imei, limit)
+	if err != nil {
+		httpWriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	httpWriteJSON(w, http.StatusOK, list)
+}
+
+func httpWriteHealth(w http.ResponseWriter, report HealthReport) {
+	status := http.StatusOK
+	if !report.OK() {
+		status = http.StatusServiceUnavailable
+	}
+	httpWriteJSON(w, status, report)
+}
+
+//GET /devices
+func (a *Application) httpDevices(w http.ResponseWriter, r *http.Request, key APIKey) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	list := make([]HTTPDevice, 0)
+	for _, it := range a.ClientSockets.Snapshot() {
+		if it.Socket.GetIMEI() == "" {
+			continue
+		}
+		list = append(list, a.newHTTPDevice(it))
+	}
+	httpWriteJSON(w, http.StatusOK, list)
+}
+
+//GET /devices/{imei}
+//GET,POST /devices/{imei}/commands
+//GET /devices/{imei}/sessions?limit=N
+func (a *Application) httpDevice(w http.ResponseWriter, r *http.Request, key APIKey) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, HTTP_DEVICES_PATH), "/"), "/")
+	imei := parts[0]
+	if imei == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != HTTP_COMMANDS_PATH && parts[1] != HTTP_SESSIONS_PATH) {
+		httpWriteError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	if len(parts) == 2 && parts[1] == HTTP_SESSIONS_PATH {
+		a.httpSessions(w, r, imei)
+		return
+	}
+
+	if len(parts) == 1 {
+		if r.Method != http.MethodGet {
+			httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+		it, ok := a.ClientSockets.GetItemByIMEI(imei)
+		if !ok {
+			httpWriteError(w, http.StatusNotFound, fmt.Sprintf("IMEI %s not connected", imei))
+			return
+		}
+		httpWriteJSON(w, http.StatusOK, a.newHTTPDevice(it))
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		list := make([]QueuedCommand, 0)
+		if a.CommandQueue != nil {
+			list = a.CommandQueue.List(imei)
+		}
+		httpWriteJSON(w, http.StatusOK, list)
+
+	case http.MethodPost:
+		if !key.CanControl() {
+			httpWriteError(w, http.StatusForbidden, "key "+key.Name+" is not allowed to control devices")
+			return
+		}
+		var cmd HTTPCommand
+		if err := json.NewDecoder(r.Body).Decode(&cmd); err != nil {
+			httpWriteError(w, http.StatusBadRequest, fmt.Sprintf("json: %v", err))
+			return
+		}
+		payload, err := hex.DecodeString(cmd.Payload)
+		if err != nil || len(payload) == 0 {
+			httpWriteError(w, http.StatusBadRequest, "payload must be non empty hex string")
+			return
+		}
+		if sock := a.ClientSockets.GetByIMEI(imei); sock != nil {
+			if err := sock.WriteServCommand(payload); err != nil {
+				httpWriteError(w, http.StatusBadGateway, err.Error())
+				return
+			}
+			sock.AddSentCommand("")
+			httpWriteJSON(w, http.StatusOK, HTTPCommandResult{State: "sent"})
+
+		}else if a.CommandQueue != nil {
+			q_cmd, err := a.CommandQueue.Add(imei, payload)
+			if err != nil {
+				httpWriteError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			a.Logger.Info("not connected, command queued", LOG_KEY_IMEI, imei, "payload", q_cmd.Payload, "expires", q_cmd.Expires)
+			httpWriteJSON(w, http.StatusAccepted, HTTPCommandResult{State: CMD_STATE_QUEUED, Command: q_cmd})
+
+		}else{
+			httpWriteError(w, http.StatusNotFound, fmt.Sprintf("IMEI %s not connected", imei))
+		}
+
+	default:
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
+
+func (a *Application) newHTTPDevice(it ClientSocketItem) HTTPDevice {
+	return HTTPDevice{IMEI: it.Socket.GetIMEI(),
+		Server: it.ServerID,
+		RunTime: it.Socket.GetRunTime(),
+		DownloadedBytes: it.Socket.GetDownloadedBytes(),
+		UploadedBytes: it.Socket.GetUploadedBytes(),
+		Handshakes: it.Socket.GetHandshakes(),
+		Reconnects: a.ClientSockets.GetReconnects(it.Socket.GetIMEI()),
+	}
+}
+
+func httpWriteJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func httpWriteError(w http.ResponseWriter, status int, errStr string) {
+	httpWriteJSON(w, status, HTTPError{Err: errStr})
+}
@@ -0,0 +1,150 @@
+package app
+
+/**
+ * Structured logging based on log/slog.
+ * Common attribute keys are LOG_KEY_* constants, connection loggers
+ * carry server, protocol, remote_addr, conn_id and imei after identification.
+ * Level can be raised for a single IMEI at runtime, see LogLevels.
+ */
+
+import(
+	"io"
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"context"
+	"strings"
+	"log/slog"
+)
+
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+
+	LOG_KEY_SERVER = "server"
+	LOG_KEY_PROTOCOL = "protocol"
+	LOG_KEY_REMOTE_ADDR = "remote_addr"
+	LOG_KEY_CONN_ID = "conn_id"
+	LOG_KEY_IMEI = "imei"
+	LOG_KEY_ERR = "err"
+)
+
+//Level names of configuration and admin commands
+func ParseLogLevel(s string) (slog.Level, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	}
+	return slog.LevelInfo, fmt.Errorf("unknown log level %s", s)
+}
+
+//Global level and per IMEI overrides
+type LogLevels struct {
+	Level slog.LevelVar
+	mx sync.RWMutex
+	imei map[string]slog.Level
+}
+
+func NewLogLevels(level slog.Level) *LogLevels {
+	l := &LogLevels{imei: make(map[string]slog.Level)}
+	l.Level.Set(level)
+	return l
+}
+
+func (l *LogLevels) SetIMEI(imei string, level slog.Level) {
+	l.mx.Lock()
+	l.imei[imei] = level
+	l.mx.Unlock()
+}
+
+func (l *LogLevels) ResetIMEI(imei string) {
+	l.mx.Lock()
+	delete(l.imei, imei)
+	l.mx.Unlock()
+}
+
+//overrides sorted by IMEI
+func (l *LogLevels) GetIMEIList() []LogLevelOverride {
+	l.mx.RLock()
+	defer l.mx.RUnlock()
+	list := make([]LogLevelOverride, 0, len(l.imei))
+	for imei, lvl := range l.imei {
+		list = append(list, LogLevelOverride{IMEI: imei, Level: strings.ToLower(lvl.String())})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].IMEI < list[j].IMEI })
+	return list
+}
+
+func (l *LogLevels) enabled(imei string, level slog.Level) bool {
+	if imei != "" {
+		l.mx.RLock()
+		lvl, ok := l.imei[imei]
+		l.mx.RUnlock()
+		if ok {
+			return level >= lvl
+		}
+	}
+	return level >= l.Level.Level()
+}
+
+type LogLevelOverride struct {
+	IMEI string `json:"imei"`
+	Level string `json:"level"`
+}
+
+//Handler checks levels, records are written by inner handler
+type logHandler struct {
+	inner slog.Handler
+	levels *LogLevels
+	imei string //from logger attributes
+}
+
+//Logger writing text or JSON to w
+func NewLogger(w io.Writer, format string, levels *LogLevels) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelDebug, AddSource: true}
+	var inner slog.Handler
+	switch format {
+	case LOG_FORMAT_JSON:
+		inner = slog.NewJSONHandler(w, opts)
+	case LOG_FORMAT_TEXT, "":
+		inner = slog.NewTextHandler(w, opts)
+	default:
+		return nil, fmt.Errorf("unknown log format %s", format)
+	}
+	return slog.New(&logHandler{inner: inner, levels: levels}), nil
+}
+
+func (h *logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.levels.enabled(h.imei, level)
+}
+
+func (h *logHandler) Handle(ctx context.Context, r slog.Record) error {
+	return h.inner.Handle(ctx, r)
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	imei := h.imei
+	for _, a := range attrs {
+		if a.Key == LOG_KEY_IMEI {
+			imei = a.Value.String()
+		}
+	}
+	return &logHandler{inner: h.inner.WithAttrs(attrs), levels: h.levels, imei: imei}
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	return &logHandler{inner: h.inner.WithGroup(name), levels: h.levels, imei: h.imei}
+}
+
+//Logs error and exits
+func LogFatal(logger *slog.Logger, msg string, args ...any) {
+	logger.Error(msg, args...)
+	os.Exit(1)
+}
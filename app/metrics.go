@@ -0,0 +1,336 @@
+package app
+
+/**
+ * Metrics in Prometheus text exposition format, see WriteMetrics.
+ * Device IMEIs are not used as labels, series are per server.
+ */
+
+import(
+	"io"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"errors"
+	"strings"
+)
+
+const (
+	METRICS_PATH = "/metrics"
+	METRICS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+	//decode error kinds, see DecodeError
+	DECODE_ERR_LENGTH = "length"
+	DECODE_ERR_STRUCTURE = "structure"
+	DECODE_ERR_CHECKSUM = "checksum"
+	DECODE_ERR_UNKNOWN = "unknown" //unknown package type
+	DECODE_ERR_OVERFLOW = "overflow" //not consumed data dropped on buffer overflow
+	DECODE_ERR_OTHER = "other"
+)
+
+//DB write latency buckets, seconds
+var DB_WRITE_BUCKETS = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+//Codec error with kind, kind is a metrics label
+type DecodeError struct {
+	Kind string
+	Err error
+}
+
+func NewDecodeError(kind string, format string, args ...interface{}) error {
+	return &DecodeError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *DecodeError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+func decodeErrorKind(err error) string {
+	var dec_err *DecodeError
+	if errors.As(err, &dec_err) {
+		return dec_err.Kind
+	}
+	return DECODE_ERR_OTHER
+}
+
+//Cumulative histogram
+type Histogram struct {
+	mx sync.Mutex
+	buckets []float64 //upper bounds, ascending
+	counts []uint64
+	sum float64
+	count uint64
+}
+
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *Histogram) ObserveDuration(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+//Storage with metrics
+type StorageMetrics struct {
+	Storage string //label
+	QueueLen int //data waiting for storage process
+	SpoolBytes int64 //spool file size
+	ReplayedBytes int64 //spool bytes replayed, 0 if replay is not running
+	WriteErrors uint64
+	WriteLatency *Histogram
+}
+
+type StorageMetricser interface {
+	GetStorageMetrics() []StorageMetrics
+}
+
+//counters of one server, kept after server is stopped
+type serverMetrics struct {
+	protocol string
+	accepted uint64
+	bytesIn uint64
+	bytesOut uint64
+	handshakes uint64
+	records uint64
+	decodeErrors map[string]uint64
+}
+
+type Metrics struct {
+	mx sync.Mutex
+	servers map[string]*serverMetrics
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{servers: make(map[string]*serverMetrics)}
+}
+
+//locked by caller
+func (m *Metrics) server(serverID string) *serverMetrics {
+	srv, ok := m.servers[serverID]
+	if !ok {
+		srv = &serverMetrics{decodeErrors: make(map[string]uint64)}
+		m.servers[serverID] = srv
+	}
+	return srv
+}
+
+func (m *Metrics) add(serverID string, f func(*serverMetrics)) {
+	m.mx.Lock()
+	f(m.server(serverID))
+	m.mx.Unlock()
+}
+
+func (m *Metrics) SetProtocol(serverID string, protocol string) {
+	m.add(serverID, func(s *serverMetrics) { s.protocol = protocol })
+}
+
+func (m *Metrics) IncAccepted(serverID string) {
+	m.add(serverID, func(s *serverMetrics) { s.accepted++ })
+}
+
+func (m *Metrics) IncBytesIn(serverID string, bt uint64) {
+	m.add(serverID, func(s *serverMetrics) { s.bytesIn += bt })
+}
+
+func (m *Metrics) IncBytesOut(serverID string, bt uint64) {
+	m.add(serverID, func(s *serverMetrics) { s.bytesOut += bt })
+}
+
+func (m *Metrics) IncHandshakes(serverID string) {
+	m.add(serverID, func(s *serverMetrics) { s.handshakes++ })
+}
+
+func (m *Metrics) IncRecords(serverID string, cnt int) {
+	m.add(serverID, func(s *serverMetrics) { s.records += uint64(cnt) })
+}
+
+func (m *Metrics) IncDecodeErrors(serverID string, kind string) {
+	m.add(serverID, func(s *serverMetrics) { s.decodeErrors[kind]++ })
+}
+
+//Writes all metrics in Prometheus text format
+func (a *Application) WriteMetrics(w io.Writer) {
+	a.init()
+	mw := &metricsWriter{w: w}
+
+	mw.header("telsrv_start_time_seconds", "gauge", "Application start time, unix seconds")
+	mw.value("telsrv_start_time_seconds", "", float64(a.GetStartTime().Unix()))
+
+	//connections by server
+	srv_clients := make(map[string]int)
+	for _, it := range a.ClientSockets.Snapshot() {
+		srv_clients[it.ServerID]++
+	}
+	running := make(map[string]bool)
+	for _, srv := range a.GetServers() {
+		running[srv.ID] = true
+	}
+
+	a.metrics.mx.Lock()
+	srv_ids := make([]string, 0, len(a.metrics.servers))
+	for id := range a.metrics.servers {
+		srv_ids = append(srv_ids, id)
+	}
+	sort.Strings(srv_ids)
+	servers := make([]serverMetrics, len(srv_ids))
+	for i, id := range srv_ids {
+		servers[i] = *a.metrics.servers[id]
+		servers[i].decodeErrors = make(map[string]uint64)
+		for kind, cnt := range a.metrics.servers[id].decodeErrors {
+			servers[i].decodeErrors[kind] = cnt
+		}
+	}
+	a.metrics.mx.Unlock()
+
+	srv_labels := func(i int) string {
+		return labels("server", srv_ids[i], "protocol", servers[i].protocol)
+	}
+	mw.header("telsrv_server_up", "gauge", "1 if server is accepting connections")
+	for i, id := range srv_ids {
+		up := 0.0
+		if running[id] {
+			up = 1
+		}
+		mw.value("telsrv_server_up", srv_labels(i), up)
+	}
+	mw.header("telsrv_connections", "gauge", "Connected clients")
+	for i, id := range srv_ids {
+		mw.value("telsrv_connections", srv_labels(i), float64(srv_clients[id]))
+	}
+	mw.header("telsrv_connections_max", "gauge", "Maximum number of connected clients since start")
+	mw.value("telsrv_connections_max", "", float64(a.GetMaxClientCount()))
+
+	counters := []struct {
+		name string
+		help string
+		value func(s *serverMetrics) uint64
+	}{
+		{"telsrv_connections_accepted_total", "Accepted connections", func(s *serverMetrics) uint64 { return s.accepted }},
+		{"telsrv_received_bytes_total", "Bytes received from clients", func(s *serverMetrics) uint64 { return s.bytesIn }},
+		{"telsrv_sent_bytes_total", "Bytes sent to clients", func(s *serverMetrics) uint64 { return s.bytesOut }},
+		{"telsrv_handshakes_total", "Device handshakes", func(s *serverMetrics) uint64 { return s.handshakes }},
+		{"telsrv_records_total", "Decoded telematics records", func(s *serverMetrics) uint64 { return s.records }},
+	}
+	for _, c := range counters {
+		mw.header(c.name, "counter", c.help)
+		for i := range servers {
+			mw.value(c.name, srv_labels(i), float64(c.value(&servers[i])))
+		}
+	}
+	mw.header("telsrv_decode_errors_total", "counter", "Protocol decode errors by kind")
+	for i := range servers {
+		kinds := make([]string, 0, len(servers[i].decodeErrors))
+		for kind := range servers[i].decodeErrors {
+			kinds = append(kinds, kind)
+		}
+		sort.Strings(kinds)
+		for _, kind := range kinds {
+			mw.value("telsrv_decode_errors_total",
+				labels("server", srv_ids[i], "protocol", servers[i].protocol, "kind", kind),
+				float64(servers[i].decodeErrors[kind]))
+		}
+	}
+	mw.header("telsrv_reconnects_total", "counter", "Connections of already connected IMEIs")
+	mw.value("telsrv_reconnects_total", "", float64(a.ClientSockets.GetReconnects("")))
+
+	if a.Devices != nil {
+		mw.header("telsrv_registry_devices", "gauge", "Devices in registry")
+		mw.value("telsrv_registry_devices", "", float64(a.Devices.Len()))
+		mw.header("telsrv_registry_unknown_devices", "gauge", "Unknown IMEIs seen since start")
+		mw.value("telsrv_registry_unknown_devices", "", float64(len(a.Devices.GetUnknown())))
+	}
+
+	if a.CommandQueue != nil {
+		mw.header("telsrv_command_queue_length", "gauge", "Device commands waiting for delivery")
+		mw.value("telsrv_command_queue_length", "", float64(a.CommandQueue.QueuedCount()))
+	}
+
+	if st, ok := a.Storage.(StorageMetricser); ok {
+		a.writeStorageMetrics(mw, st.GetStorageMetrics())
+	}
+
+	if list := a.GetRetranslationStatus(); len(list) > 0 {
+		a.writeRetranslationMetrics(mw, list)
+	}
+}
+
+func (a *Application) writeStorageMetrics(mw *metricsWriter, list []StorageMetrics) {
+	gauges := []struct {
+		name string
+		tp string
+		help string
+		value func(m *StorageMetrics) float64
+	}{
+		{"telsrv_storage_queue_length", "gauge", "Records waiting for storage process", func(m *StorageMetrics) float64 { return float64(m.QueueLen) }},
+		{"telsrv_storage_spool_bytes", "gauge", "Spool file size", func(m *StorageMetrics) float64 { return float64(m.SpoolBytes) }},
+		{"telsrv_storage_spool_replayed_bytes", "gauge", "Spool bytes replayed by running replay", func(m *StorageMetrics) float64 { return float64(m.ReplayedBytes) }},
+		{"telsrv_storage_write_errors_total", "counter", "Failed storage writes", func(m *StorageMetrics) float64 { return float64(m.WriteErrors) }},
+	}
+	for _, g := range gauges {
+		mw.header(g.name, g.tp, g.help)
+		for i := range list {
+			mw.value(g.name, labels("storage", list[i].Storage), g.value(&list[i]))
+		}
+	}
+	mw.header("telsrv_storage_write_duration_seconds", "histogram", "Storage write latency")
+	for i := range list {
+		if list[i].WriteLatency != nil {
+			mw.histogram("telsrv_storage_write_duration_seconds", "storage", list[i].Storage, list[i].WriteLatency)
+		}
+	}
+}
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (mw *metricsWriter) header(name string, tp string, help string) {
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, tp)
+}
+
+func (mw *metricsWriter) value(name string, lbls string, v float64) {
+	fmt.Fprintf(mw.w, "%s%s %v\n", name, lbls, v)
+}
+
+func (mw *metricsWriter) histogram(name string, labelName string, labelValue string, h *Histogram) {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	for i, b := range h.buckets {
+		mw.value(name+"_bucket", labels(labelName, labelValue, "le", fmt.Sprintf("%v", b)), float64(h.counts[i]))
+	}
+	mw.value(name+"_bucket", labels(labelName, labelValue, "le", "+Inf"), float64(h.count))
+	mw.value(name+"_sum", labels(labelName, labelValue), h.sum)
+	mw.value(name+"_count", labels(labelName, labelValue), float64(h.count))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+//{name="value",...} from name, value pairs
+func labels(pairs ...string) string {
+	var b strings.Builder
+	b.WriteString("{")
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(pairs[i] + `="` + labelEscaper.Replace(pairs[i+1]) + `"`)
+	}
+	b.WriteString("}")
+	return b.String()
+}
@@ -0,0 +1,675 @@
+package app
+
+/**
+ * Fan-out of telematics data, sessions and device state to several named sinks.
+ * Every sink has its own queue and process, so slow or failed sink does not
+ * block other sinks and device connections. Data not fitting the queue
+ * is appended to the sink spool file (json lines), the file is replayed
+ * when the sink is writing again. Delivery is at least once.
+ * Sinks report write errors (RecordWriter, SessionRecordWriter,
+ * DeviceStateRecordWriter), failed records, sessions and states are retried
+ * with exponential backoff and appended to the sink spool. Spool files:
+ *	sink_<name>.jsonl - items not queued or not written by the sink, all sink types
+ *	queries.sql, queries_<name>.sql - StoragePG queries failed after the record
+ *		is accepted by a process, records are written by several processes
+ *	clickhouse_<name>.jsonl - StorageClickHouse batches failed after retries
+ * Sinks implementing BatchRecordWriter (StorageNATS) get queued records
+ * by batches of BatchSize, failed records of batch are retried and spooled.
+ * StoragePG and StorageClickHouse return error for records not accepted
+ * by their writer processes. Sinks implementing only Storager, SessionWriter,
+ * DeviceStateWriter are not retried, they must keep their own spool.
+ */
+
+import(
+	"os"
+	"fmt"
+	"sync"
+	"time"
+	"bufio"
+	"errors"
+	"context"
+	"strings"
+	"sync/atomic"
+	"path/filepath"
+	"encoding/json"
+	"log/slog"
+)
+
+const (
+	SINK_DEF_QUEUE_SIZE = 10000
+	SINK_DEF_BATCH_SIZE = 100
+	SINK_DEF_RETRY_ATTEMPTS = 3
+	SINK_DEF_RETRY_BACKOFF_MS = 1000
+	SINK_DEF_RETRY_MAX_BACKOFF_MS = 30000
+	SINK_SPOOL_REPLAY_SEC = 10 //spool replay check interval
+	SINK_SPOOL_REPLAY_EXT = ".replay"
+	SINK_MAX_LINE_LEN = 1024 * 1024
+)
+
+type SinkRetryConfig struct {
+	Attempts int `json:"attempts"` //write attempts before spooling
+	BackoffMs int `json:"backoffMs"` //pause after the first failure, doubled on next failures
+	MaxBackoffMs int `json:"maxBackoffMs"`
+}
+
+type SinkConfig struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Connection string `json:"connection"` //passed to Storager.Init
+	QueueSize int `json:"queueSize"`
+	BatchSize int `json:"batchSize"` //records of one write, BatchRecordWriter only
+	Retry SinkRetryConfig `json:"retry"`
+	SpoolFile string `json:"spoolFile"` //sink_<name>.jsonl in program directory by default
+	Options json.RawMessage `json:"options"` //storage type parameters
+}
+
+//Storage reporting write result, failed writes are retried and spooled by MultiStorage
+type RecordWriter interface {
+	WriteRecord(ctx context.Context, data *TelematicsData) error
+}
+
+//Storage reporting session write result, see RecordWriter
+type SessionRecordWriter interface {
+	WriteSessionRecord(ctx context.Context, sess *Session) error
+}
+
+//Storage reporting device state write result, see RecordWriter
+type DeviceStateRecordWriter interface {
+	WriteDeviceStateRecord(ctx context.Context, state *DeviceState) error
+}
+
+//Storage writing several records at once, errors are in order of data
+type BatchRecordWriter interface {
+	WriteRecords(ctx context.Context, data []*TelematicsData) []error
+}
+
+//Storage writing records of some devices only, other records are not queued
+type RecordFilter interface {
+	AcceptRecord(data *TelematicsData) bool
+}
+
+//queued data, one of fields is set
+type sinkItem struct {
+	Record *TelematicsData `json:"record,omitempty"`
+	Session *Session `json:"session,omitempty"`
+	State *DeviceState `json:"state,omitempty"`
+}
+
+type storageSink struct {
+	Conf SinkConfig
+	Storage Storager
+	logger *slog.Logger
+	queue chan sinkItem
+	mx sync.RWMutex //closed flag and queue send
+	closed bool
+	done chan struct{} //closed on shutdown
+	stopped chan struct{}
+	writeCtx context.Context //canceled when shutdown deadline is exceeded
+	writeCancel context.CancelFunc
+	spoolMx sync.Mutex
+	replayed int64 //spool bytes replayed, atomic
+	writeErrors uint64 //atomic
+	overflow int32 //queue is full, atomic
+	writeLatency *Histogram //RecordWriter without own metrics only
+}
+
+type MultiStorage struct {
+	sinks []*storageSink
+}
+
+//Sink must be added before Init
+func (m *MultiStorage) AddSink(conf SinkConfig, st Storager) error {
+	if conf.Name == "" {
+		return errors.New("sink name is not set")
+	}
+	for _, s := range m.sinks {
+		if s.Conf.Name == conf.Name {
+			return errors.New("duplicate sink name "+conf.Name)
+		}
+	}
+	if conf.QueueSize <= 0 {
+		conf.QueueSize = SINK_DEF_QUEUE_SIZE
+	}
+	if conf.BatchSize <= 0 {
+		conf.BatchSize = SINK_DEF_BATCH_SIZE
+	}
+	if conf.Retry.Attempts <= 0 {
+		conf.Retry.Attempts = SINK_DEF_RETRY_ATTEMPTS
+	}
+	if conf.Retry.BackoffMs <= 0 {
+		conf.Retry.BackoffMs = SINK_DEF_RETRY_BACKOFF_MS
+	}
+	if conf.Retry.MaxBackoffMs <= 0 {
+		conf.Retry.MaxBackoffMs = SINK_DEF_RETRY_MAX_BACKOFF_MS
+	}
+	if conf.SpoolFile == "" {
+		conf.SpoolFile = filepath.Dir(os.Args[0]) + "/sink_" + conf.Name + ".jsonl"
+	}
+	m.sinks = append(m.sinks, &storageSink{Conf: conf, Storage: st})
+	return nil
+}
+
+func (m *MultiStorage) GetDescr() string {
+	names := make([]string, len(m.sinks))
+	for i, s := range m.sinks {
+		names[i] = s.Conf.Name
+	}
+	return "Multi storage: " + strings.Join(names, ", ")
+}
+
+//Initializes sinks with own connections, connStr is not used
+func (m *MultiStorage) Init(connStr string, logger *slog.Logger, processCount int) error {
+	if len(m.sinks) == 0 {
+		return errors.New("no sinks")
+	}
+	for _, s := range m.sinks {
+		s.logger = logger.With("sink", s.Conf.Name)
+		if err := s.Storage.Init(s.Conf.Connection, s.logger, processCount); err != nil {
+			return fmt.Errorf("sink %s: %v", s.Conf.Name, err)
+		}
+		s.queue = make(chan sinkItem, s.Conf.QueueSize)
+		s.done = make(chan struct{})
+		s.stopped = make(chan struct{})
+		s.writeCtx, s.writeCancel = context.WithCancel(context.Background())
+		_, rec_writer := s.Storage.(RecordWriter)
+		_, own_metrics := s.Storage.(StorageMetricser)
+		if rec_writer && !own_metrics {
+			s.writeLatency = NewHistogram(DB_WRITE_BUCKETS)
+		}
+		go s.run()
+		s.logger.Info("sink started", "type", s.Conf.Type, "storage", s.Storage.GetDescr())
+	}
+	return nil
+}
+
+//the same record is passed to all sinks, sinks must not change it
+func (m *MultiStorage) Write(data *TelematicsData) {
+	rec := *data
+	for _, s := range m.sinks {
+		if f, ok := s.Storage.(RecordFilter); ok && !f.AcceptRecord(&rec) {
+			continue
+		}
+		s.enqueue(sinkItem{Record: &rec})
+	}
+}
+
+func (m *MultiStorage) WriteSession(sess *Session) {
+	for _, s := range m.sinks {
+		_, w := s.Storage.(SessionWriter)
+		_, rec_w := s.Storage.(SessionRecordWriter)
+		if w || rec_w {
+			s.enqueue(sinkItem{Session: sess})
+		}
+	}
+}
+
+func (m *MultiStorage) WriteDeviceState(state *DeviceState) {
+	for _, s := range m.sinks {
+		_, w := s.Storage.(DeviceStateWriter)
+		_, rec_w := s.Storage.(DeviceStateRecordWriter)
+		if w || rec_w {
+			s.enqueue(sinkItem{State: state})
+		}
+	}
+}
+
+//Sessions from the first sink keeping them
+func (m *MultiStorage) GetSessions(ctx context.Context, imei string, limit int) ([]Session, error) {
+	for _, s := range m.sinks {
+		if r, ok := s.Storage.(SessionReader); ok {
+			return r.GetSessions(ctx, imei, limit)
+		}
+	}
+	return nil, errors.New("no sink keeps sessions")
+}
+
+//Track from the first sink returning tracks
+func (m *MultiStorage) GetTrack(ctx context.Context, id string, from, to time.Time, limit int) ([]TrackPoint, error) {
+	for _, s := range m.sinks {
+		if r, ok := s.Storage.(TrackReader); ok {
+			return r.GetTrack(ctx, id, from, to, limit)
+		}
+	}
+	return nil, errors.New("no sink returns tracks")
+}
+
+//Retranslation sinks with sink queue and spool
+func (m *MultiStorage) GetRetranslationStatus() []RetranslationStatus {
+	list := make([]RetranslationStatus, 0)
+	for _, s := range m.sinks {
+		st, ok := s.Storage.(RetranslationStatuser)
+		if !ok {
+			continue
+		}
+		for _, it := range st.GetRetranslationStatus() {
+			it.Target = s.Conf.Name
+			it.QueueLen = len(s.queue)
+			it.SpoolBytes = s.spoolBytes()
+			//storage knows the record being sent only, waiting records are as old as the last acknowledged one at least
+			if (it.QueueLen > 0 || it.SpoolBytes > 0) && !it.LastAckReceived.IsZero() {
+				if lag := time.Since(it.LastAckReceived).Seconds(); lag > it.LagSec {
+					it.LagSec = lag
+				}
+			}
+			list = append(list, it)
+		}
+	}
+	return list
+}
+
+func (m *MultiStorage) SetProcessCount(processCount int) {
+	for _, s := range m.sinks {
+		if st, ok := s.Storage.(ProcessCountSetter); ok {
+			st.SetProcessCount(processCount)
+		}
+	}
+}
+
+//All sinks with connectivity check must be reachable
+func (m *MultiStorage) CheckStorage(ctx context.Context) error {
+	var errs []error
+	for _, s := range m.sinks {
+		if ch, ok := s.Storage.(StorageChecker); ok {
+			if err := ch.CheckStorage(ctx); err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %v", s.Conf.Name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+//One entry per sink: sink queue and spool with storage own values
+func (m *MultiStorage) GetStorageMetrics() []StorageMetrics {
+	list := make([]StorageMetrics, 0, len(m.sinks))
+	for _, s := range m.sinks {
+		sm := StorageMetrics{Storage: s.Conf.Name,
+			QueueLen: len(s.queue),
+			SpoolBytes: s.spoolBytes(),
+			ReplayedBytes: atomic.LoadInt64(&s.replayed),
+			WriteErrors: atomic.LoadUint64(&s.writeErrors),
+			WriteLatency: s.writeLatency,
+		}
+		if st, ok := s.Storage.(StorageMetricser); ok {
+			for _, it := range st.GetStorageMetrics() {
+				sm.QueueLen += it.QueueLen
+				sm.SpoolBytes += it.SpoolBytes
+				sm.ReplayedBytes += it.ReplayedBytes
+				sm.WriteErrors += it.WriteErrors
+				if sm.WriteLatency == nil {
+					sm.WriteLatency = it.WriteLatency
+				}
+			}
+		}
+		list = append(list, sm)
+	}
+	return list
+}
+
+//Stops sinks in parallel, queued data not written till ctx deadline is spooled.
+//Returns number of spooled items and storage queries.
+func (m *MultiStorage) Close(ctx context.Context) (int, error) {
+	var wg sync.WaitGroup
+	var mx sync.Mutex
+	spooled := 0
+	var errs []error
+	for _, s := range m.sinks {
+		wg.Add(1)
+		go func(s *storageSink) {
+			defer wg.Done()
+			cnt, err := s.close(ctx)
+			mx.Lock()
+			spooled += cnt
+			if err != nil {
+				errs = append(errs, fmt.Errorf("sink %s: %v", s.Conf.Name, err))
+			}
+			mx.Unlock()
+		}(s)
+	}
+	wg.Wait()
+	return spooled, errors.Join(errs...)
+}
+
+//never blocks, data is spooled if queue is full or sink is closed
+func (s *storageSink) enqueue(it sinkItem) {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	if !s.closed {
+		select {
+		case s.queue <- it:
+			atomic.StoreInt32(&s.overflow, 0)
+			return
+		default:
+			if atomic.CompareAndSwapInt32(&s.overflow, 0, 1) {
+				s.logger.Warn("sink queue is full, data is spooled")
+			}
+		}
+	}
+	s.toSpool(it)
+}
+
+func (s *storageSink) run() {
+	defer close(s.stopped)
+	s.replaySpool()
+	ticker := time.NewTicker(time.Duration(SINK_SPOOL_REPLAY_SEC) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case it := <-s.queue:
+			s.process(it, s.Conf.Retry.Attempts)
+		case <-ticker.C:
+			if len(s.queue) == 0 {
+				s.replaySpool()
+			}
+		case <-s.done:
+			s.drain()
+			return
+		}
+	}
+}
+
+//writes queue on shutdown, single attempt, spools the rest
+func (s *storageSink) drain() {
+	for {
+		select {
+		case it := <-s.queue:
+			if s.writeCtx.Err() != nil {
+				s.toSpool(it)
+			}else{
+				s.process(it, 1)
+			}
+		default:
+			return
+		}
+	}
+}
+
+//writes queued item, records of BatchRecordWriter are written with records
+//following in queue, failed items are spooled
+func (s *storageSink) process(it sinkItem, attempts int) {
+	w, ok := s.Storage.(BatchRecordWriter)
+	if !ok || it.Record == nil {
+		if err := s.deliver(it, attempts); err != nil {
+			s.toSpool(it)
+		}
+		return
+	}
+	batch := []sinkItem{it}
+collect:
+	for len(batch) < s.Conf.BatchSize {
+		select {
+		case next := <-s.queue:
+			if next.Record == nil {
+				s.deliverBatch(w, batch, attempts)
+				s.process(next, attempts)
+				return
+			}
+			batch = append(batch, next)
+		default:
+			break collect
+		}
+	}
+	s.deliverBatch(w, batch, attempts)
+}
+
+//failed records are retried, then spooled
+func (s *storageSink) deliverBatch(w BatchRecordWriter, batch []sinkItem, attempts int) {
+	backoff := time.Duration(s.Conf.Retry.BackoffMs) * time.Millisecond
+retry:
+	for i := 1; ; i++ {
+		records := make([]*TelematicsData, len(batch))
+		for j, it := range batch {
+			records[j] = it.Record
+		}
+		start := time.Now()
+		errs := w.WriteRecords(s.writeCtx, records)
+		if s.writeLatency != nil {
+			s.writeLatency.ObserveDuration(start)
+		}
+		failed := make([]sinkItem, 0)
+		var last_err error
+		for j, err := range errs {
+			if err != nil {
+				failed = append(failed, batch[j])
+				last_err = err
+			}
+		}
+		if len(failed) == 0 {
+			return
+		}
+		atomic.AddUint64(&s.writeErrors, uint64(len(failed)))
+		s.logger.Error("sink batch write failed", "attempt", i, "failed", len(failed), "records", len(batch), LOG_KEY_ERR, last_err)
+		batch = failed
+		if i >= attempts || s.writeCtx.Err() != nil {
+			break
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			break retry
+		}
+		backoff *= 2
+		if max_backoff := time.Duration(s.Conf.Retry.MaxBackoffMs) * time.Millisecond; backoff > max_backoff {
+			backoff = max_backoff
+		}
+	}
+	for _, it := range batch {
+		s.toSpool(it)
+	}
+}
+
+//writes item to storage, items of sinks reporting errors are retried
+func (s *storageSink) deliver(it sinkItem, attempts int) error {
+	write := s.writer(it)
+	if write == nil {
+		return nil
+	}
+	backoff := time.Duration(s.Conf.Retry.BackoffMs) * time.Millisecond
+	for i := 1; ; i++ {
+		start := time.Now()
+		err := write(s.writeCtx)
+		if s.writeLatency != nil {
+			s.writeLatency.ObserveDuration(start)
+		}
+		if err == nil {
+			return nil
+		}
+		atomic.AddUint64(&s.writeErrors, 1)
+		s.logger.Error("sink write failed", "attempt", i, LOG_KEY_ERR, err)
+		if i >= attempts || s.writeCtx.Err() != nil {
+			return err
+		}
+		select {
+		case <-time.After(backoff):
+		case <-s.done:
+			return err
+		}
+		backoff *= 2
+		if max_backoff := time.Duration(s.Conf.Retry.MaxBackoffMs) * time.Millisecond; backoff > max_backoff {
+			backoff = max_backoff
+		}
+	}
+}
+
+//write of item with result, nil if storage does not report errors
+//(item is passed to storage here)
+func (s *storageSink) writer(it sinkItem) func(ctx context.Context) error {
+	switch {
+	case it.Session != nil:
+		if w, ok := s.Storage.(SessionRecordWriter); ok {
+			return func(ctx context.Context) error {
+				return w.WriteSessionRecord(ctx, it.Session)
+			}
+		}
+		if w, ok := s.Storage.(SessionWriter); ok {
+			w.WriteSession(it.Session)
+		}
+	case it.State != nil:
+		if w, ok := s.Storage.(DeviceStateRecordWriter); ok {
+			return func(ctx context.Context) error {
+				return w.WriteDeviceStateRecord(ctx, it.State)
+			}
+		}
+		if w, ok := s.Storage.(DeviceStateWriter); ok {
+			w.WriteDeviceState(it.State)
+		}
+	case it.Record != nil:
+		if w, ok := s.Storage.(RecordWriter); ok {
+			return func(ctx context.Context) error {
+				return w.WriteRecord(ctx, it.Record)
+			}
+		}
+		s.Storage.Write(it.Record)
+	}
+	return nil
+}
+
+//Storage is closed after sink process exits, writes are canceled on ctx deadline
+func (s *storageSink) close(ctx context.Context) (int, error) {
+	s.mx.Lock()
+	s.closed = true
+	s.mx.Unlock()
+	close(s.done)
+	select {
+	case <-s.stopped:
+	case <-ctx.Done():
+		s.logger.Warn("sink Close: deadline exceeded, canceling writes")
+		s.writeCancel()
+		//the rest of queue is spooled
+		<-s.stopped
+	}
+	s.writeCancel()
+	spooled, err := s.Storage.Close(ctx)
+
+	cnt, cnt_err := s.spoolCount()
+	if err == nil {
+		err = cnt_err
+	}
+	return spooled + cnt, err
+}
+
+func (s *storageSink) toSpool(it sinkItem) {
+	line, err := json.Marshal(it)
+	if err != nil {
+		s.logger.Error("sink spool: json.Marshal failed", LOG_KEY_ERR, err)
+		return
+	}
+	s.appendSpool(line)
+}
+
+func (s *storageSink) appendSpool(line []byte) {
+	s.spoolMx.Lock()
+	defer s.spoolMx.Unlock()
+	file, err := os.OpenFile(s.Conf.SpoolFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		s.logger.Error("sink spool: os.OpenFile failed", LOG_KEY_ERR, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		s.logger.Error("sink spool: file.Write failed", LOG_KEY_ERR, err)
+	}
+}
+
+/**
+ * Spool file is renamed and written to storage, new data is spooled
+ * to a new file meanwhile. Not written lines are returned to spool.
+ * File left by interrupted replay is written first.
+ */
+func (s *storageSink) replaySpool() {
+	replay_name := s.Conf.SpoolFile + SINK_SPOOL_REPLAY_EXT
+	s.spoolMx.Lock()
+	if _, err := os.Stat(replay_name); os.IsNotExist(err) {
+		if err := os.Rename(s.Conf.SpoolFile, replay_name); err != nil {
+			s.spoolMx.Unlock()
+			return
+		}
+	}
+	s.spoolMx.Unlock()
+
+	file, err := os.Open(replay_name)
+	if err != nil {
+		s.logger.Error("sink spool replay: os.Open failed", LOG_KEY_ERR, err)
+		return
+	}
+	s.logger.Warn("sink spool replay started", "file", replay_name)
+	defer atomic.StoreInt64(&s.replayed, 0)
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64 * 1024), SINK_MAX_LINE_LEN)
+	failed := false
+	cnt := 0
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		atomic.AddInt64(&s.replayed, int64(len(line)) + 1)
+		if failed {
+			s.appendSpool(append([]byte(nil), line...))
+			continue
+		}
+		var it sinkItem
+		if err := json.Unmarshal(line, &it); err != nil {
+			s.logger.Error("sink spool replay: bad line skipped", LOG_KEY_ERR, err)
+			continue
+		}
+		select {
+		case <-s.done:
+			failed = true
+		default:
+			failed = (s.deliver(it, 1) != nil)
+		}
+		if failed && cnt == 0 {
+			//nothing is written, file is kept for the next replay
+			file.Close()
+			return
+		}else if failed {
+			s.appendSpool(append([]byte(nil), line...))
+		}else{
+			cnt++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		//file is kept for the next replay
+		file.Close()
+		s.logger.Error("sink spool replay: read failed", LOG_KEY_ERR, err)
+		return
+	}
+	file.Close()
+	if err := os.Remove(replay_name); err != nil {
+		s.logger.Error("sink spool replay: os.Remove failed", LOG_KEY_ERR, err)
+	}
+	s.logger.Warn("sink spool replay finished", "written", cnt, "interrupted", failed)
+}
+
+func (s *storageSink) spoolBytes() int64 {
+	var bytes int64
+	for _, f := range []string{s.Conf.SpoolFile, s.Conf.SpoolFile + SINK_SPOOL_REPLAY_EXT} {
+		if fi, err := os.Stat(f); err == nil {
+			bytes += fi.Size()
+		}
+	}
+	return bytes
+}
+
+//lines in spool file
+func (s *storageSink) spoolCount() (int, error) {
+	s.spoolMx.Lock()
+	defer s.spoolMx.Unlock()
+	cnt := 0
+	for _, f := range []string{s.Conf.SpoolFile, s.Conf.SpoolFile + SINK_SPOOL_REPLAY_EXT} {
+		file, err := os.Open(f)
+		if os.IsNotExist(err) {
+			continue
+		}else if err != nil {
+			return cnt, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64 * 1024), SINK_MAX_LINE_LEN)
+		for scanner.Scan() {
+			cnt++
+		}
+		file.Close()
+		if err := scanner.Err(); err != nil {
+			return cnt, err
+		}
+	}
+	return cnt, nil
+}
@@ -0,0 +1,182 @@
+package app
+
+import(
+	"io"
+	"os"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"testing"
+	"log/slog"
+	"sync/atomic"
+	"path/filepath"
+)
+
+//sink reporting errors for all item kinds
+type testSink struct {
+	mx sync.Mutex
+	fail bool
+	block bool //writes wait for ctx
+	records int
+	sessions int
+	states int
+	writing int32 //writes in progress, atomic
+	closedWriting int32 //writes in progress on Close, -1 before Close
+}
+
+func newTestSink(fail bool) *testSink {
+	return &testSink{fail: fail, closedWriting: -1}
+}
+
+func (s *testSink) Init(string, *slog.Logger, int) error {
+	return nil
+}
+
+func (s *testSink) Write(data *TelematicsData) {
+}
+
+func (s *testSink) GetDescr() string {
+	return "test"
+}
+
+func (s *testSink) Close(context.Context) (int, error) {
+	atomic.StoreInt32(&s.closedWriting, atomic.LoadInt32(&s.writing))
+	return 0, nil
+}
+
+func (s *testSink) write(ctx context.Context, cnt *int) error {
+	atomic.AddInt32(&s.writing, 1)
+	defer atomic.AddInt32(&s.writing, -1)
+	if s.block {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.fail {
+		return errors.New("write failed")
+	}
+	*cnt++
+	return nil
+}
+
+func (s *testSink) WriteRecord(ctx context.Context, data *TelematicsData) error {
+	return s.write(ctx, &s.records)
+}
+
+func (s *testSink) WriteSessionRecord(ctx context.Context, sess *Session) error {
+	return s.write(ctx, &s.sessions)
+}
+
+func (s *testSink) WriteDeviceStateRecord(ctx context.Context, state *DeviceState) error {
+	return s.write(ctx, &s.states)
+}
+
+func (s *testSink) counts() (int, int, int) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.records, s.sessions, s.states
+}
+
+func newTestMultiStorage(t *testing.T, spool string, st Storager) *MultiStorage {
+	m := &MultiStorage{}
+	conf := SinkConfig{Name: "test", SpoolFile: spool, Retry: SinkRetryConfig{Attempts: 2, BackoffMs: 1}}
+	if err := m.AddSink(conf, st); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init("", slog.New(slog.NewTextHandler(io.Discard, nil)), 1); err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+//failed records, sessions and states are spooled and replayed
+func TestSinkSpool(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "sink_test.jsonl")
+	failing := newTestSink(true)
+	m := newTestMultiStorage(t, spool, failing)
+	m.Write(&TelematicsData{IMEI: "111"})
+	m.WriteSession(&Session{IMEI: "111"})
+	m.WriteDeviceState(&DeviceState{IMEI: "111"})
+	cnt, err := m.Close(context.Background())
+	if err != nil || cnt != 3 {
+		t.Fatalf("spooled %d %v", cnt, err)
+	}
+
+	sink := newTestSink(false)
+	m = newTestMultiStorage(t, spool, sink)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		rec, sess, state := sink.counts()
+		if rec == 1 && sess == 1 && state == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("replayed records %d, sessions %d, states %d", rec, sess, state)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if cnt, err := m.Close(context.Background()); err != nil || cnt != 0 {
+		t.Fatalf("spooled after replay %d %v", cnt, err)
+	}
+	if _, err := os.Stat(spool); !os.IsNotExist(err) {
+		t.Fatalf("spool file left: %v", err)
+	}
+}
+
+//storage is closed after blocked write is canceled
+func TestSinkCloseDeadline(t *testing.T) {
+	spool := filepath.Join(t.TempDir(), "sink_test.jsonl")
+	sink := newTestSink(false)
+	sink.block = true
+	m := newTestMultiStorage(t, spool, sink)
+	m.Write(&TelematicsData{IMEI: "111"})
+	m.Write(&TelematicsData{IMEI: "111"})
+	for atomic.LoadInt32(&sink.writing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50 * time.Millisecond)
+	defer cancel()
+	cnt, err := m.Close(ctx)
+	if err != nil || cnt != 2 {
+		t.Fatalf("spooled %d %v", cnt, err)
+	}
+	if w := atomic.LoadInt32(&sink.closedWriting); w != 0 {
+		t.Fatalf("writes in progress on storage Close: %d", w)
+	}
+}
+
+//retranslation sink, the last acknowledged record was received 10 seconds ago
+type testRetranslationSink struct {
+	*testSink
+}
+
+func (s testRetranslationSink) GetRetranslationStatus() []RetranslationStatus {
+	return []RetranslationStatus{{Protocol: "test", LastAckReceived: time.Now().Add(-10 * time.Second)}}
+}
+
+//lag is kept while records wait in queue, nothing waits - no lag
+func TestRetranslationLag(t *testing.T) {
+	sink := newTestSink(false)
+	sink.block = true
+	m := newTestMultiStorage(t, filepath.Join(t.TempDir(), "sink_test.jsonl"), testRetranslationSink{sink})
+	for i := 0; i < 3; i++ {
+		m.Write(&TelematicsData{IMEI: "111"})
+	}
+	for atomic.LoadInt32(&sink.writing) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if st := m.GetRetranslationStatus()[0]; st.QueueLen == 0 || st.LagSec < 10 {
+		t.Fatalf("queue %d, lag %v", st.QueueLen, st.LagSec)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Millisecond)
+	defer cancel()
+	m.Close(ctx)
+
+	m = newTestMultiStorage(t, filepath.Join(t.TempDir(), "sink_test.jsonl"), testRetranslationSink{newTestSink(false)})
+	defer m.Close(context.Background())
+	if st := m.GetRetranslationStatus()[0]; st.LagSec != 0 {
+		t.Fatalf("lag without records %v", st.LagSec)
+	}
+}
@@ -0,0 +1,24 @@
+package app
+
+//Result of configuration reload
+type ReloadReport struct {
+	Applied []string `json:"applied"`
+	RestartRequired []string `json:"restartRequired"`
+	Errors []string `json:"errors"`
+}
+
+func (r *ReloadReport) AddApplied(s string) {
+	r.Applied = append(r.Applied, s)
+}
+
+func (r *ReloadReport) AddRestartRequired(s string) {
+	r.RestartRequired = append(r.RestartRequired, s)
+}
+
+func (r *ReloadReport) AddError(s string) {
+	r.Errors = append(r.Errors, s)
+}
+
+func NewReloadReport() ReloadReport {
+	return ReloadReport{Applied: make([]string, 0), RestartRequired: make([]string, 0), Errors: make([]string, 0)}
+}
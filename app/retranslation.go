@@ -0,0 +1,73 @@
+package app
+
+/**
+ * Status of retranslation sinks forwarding data to remote servers,
+ * see CMD_RETRANSLATION, CMD_STATUS and telsrv_retranslation_* metrics.
+ */
+
+import(
+	"fmt"
+	"time"
+	"encoding/json"
+)
+
+type RetranslationStatus struct {
+	Target string `json:"target"` //sink name, set by MultiStorage
+	Protocol string `json:"protocol"`
+	Connected bool `json:"connected"` //session with remote server is established
+	LastAck time.Time `json:"lastAck"` //zero - nothing acknowledged since start
+	LagSec float64 `json:"lagSec"` //age of the record being sent or, while records wait in queue or spool, of the last acknowledged record, 0 - nothing waits
+	LastAckReceived time.Time `json:"lastAckReceived"` //received time of the last acknowledged record
+	Sent uint64 `json:"sent"` //acknowledged records
+	QueueLen int `json:"queueLen"`
+	SpoolBytes int64 `json:"spoolBytes"`
+}
+
+type RetranslationStatuser interface {
+	GetRetranslationStatus() []RetranslationStatus
+}
+
+//nil if storage does not retranslate
+func (a *Application) GetRetranslationStatus() []RetranslationStatus {
+	st, ok := a.Storage.(RetranslationStatuser)
+	if !ok {
+		return nil
+	}
+	return st.GetRetranslationStatus()
+}
+
+func (app *Application) SrvCMDRetranslation() string {
+	list := app.GetRetranslationStatus()
+	if list == nil {
+		list = []RetranslationStatus{}
+	}
+	list_b, err := json.Marshal(list)
+	if err != nil {
+		return `"retranslation":[]`
+	}
+	return fmt.Sprintf(`"retranslation":%s`, string(list_b))
+}
+
+func (a *Application) writeRetranslationMetrics(mw *metricsWriter, list []RetranslationStatus) {
+	gauges := []struct {
+		name string
+		tp string
+		help string
+		value func(s *RetranslationStatus) float64
+	}{
+		{"telsrv_retranslation_connected", "gauge", "Session with retranslation target is established", func(s *RetranslationStatus) float64 {
+			if s.Connected {
+				return 1
+			}
+			return 0
+		}},
+		{"telsrv_retranslation_lag_seconds", "gauge", "Age of the record being sent or of the last acknowledged record while records wait", func(s *RetranslationStatus) float64 { return s.LagSec }},
+		{"telsrv_retranslation_sent_total", "counter", "Records acknowledged by retranslation target", func(s *RetranslationStatus) float64 { return float64(s.Sent) }},
+	}
+	for _, g := range gauges {
+		mw.header(g.name, g.tp, g.help)
+		for i := range list {
+			mw.value(g.name, labels("target", list[i].Target, "protocol", list[i].Protocol), g.value(&list[i]))
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package app
+
+/**
+ * systemd service notifications, Type=notify and WatchdogSec= units.
+ * Nothing is sent when NOTIFY_SOCKET is not set.
+ */
+
+import(
+	"os"
+	"net"
+	"time"
+	"strconv"
+)
+
+const (
+	SD_READY = "READY=1"
+	SD_STOPPING = "STOPPING=1"
+	SD_WATCHDOG = "WATCHDOG=1"
+)
+
+//Sends state to systemd, returns false if notifications are not supported
+func SdNotify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	//abstract namespace
+	if addr[0] == '@' {
+		addr = "\x00" + addr[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+//Watchdog interval from WATCHDOG_USEC, 0 if watchdog is disabled
+func sdWatchdogInterval() time.Duration {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond
+}
+
+//Notifies readiness, sends watchdog keep-alive at half of watchdog interval
+//while health check passes, so systemd restarts unhealthy process.
+func (a *Application) RunSdNotify() {
+	if _, err := SdNotify(SD_READY); err != nil {
+		a.Logger.Error("sd_notify failed", "state", SD_READY, LOG_KEY_ERR, err)
+	}
+	interval := sdWatchdogInterval()
+	if interval == 0 {
+		return
+	}
+	a.Logger.Info("systemd watchdog enabled", "interval", interval.String())
+	go func() {
+		ticker := time.NewTicker(interval / 2)
+		defer ticker.Stop()
+		for range ticker.C {
+			if a.IsStopping() {
+				return
+			}
+			report := a.CheckHealth()
+			if !report.OK() {
+				a.Logger.Warn("health check failed, watchdog keep-alive is not sent", "checks", report.Checks)
+				continue
+			}
+			if _, err := SdNotify(SD_WATCHDOG); err != nil {
+				a.Logger.Error("sd_notify failed", "state", SD_WATCHDOG, LOG_KEY_ERR, err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package app
+
+import(
+	"net"
+	"fmt"
+	"time"
+	"sync"
+)
+
+//Running TCP server
+type Server struct {
+	ID string
+	Protocol string
+	Addr string
+	StartTime time.Time
+	mx sync.RWMutex
+	conLiveSec int
+	listener net.Listener
+	stopped bool
+	acceptErr error //last Accept error, nil after successful Accept
+}
+
+//connection idle timeout, can be changed while running
+func (s *Server) GetConLiveSec() int {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.conLiveSec
+}
+
+func (s *Server) SetConLiveSec(sec int) {
+	s.mx.Lock()
+	s.conLiveSec = sec
+	s.mx.Unlock()
+}
+
+func (s *Server) setAcceptErr(err error) {
+	s.mx.Lock()
+	s.acceptErr = err
+	s.mx.Unlock()
+}
+
+//nil if server is accepting connections
+func (s *Server) GetAcceptErr() error {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.acceptErr
+}
+
+func (s *Server) isStopped() bool {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return s.stopped
+}
+
+//Starts TCP server for devices, returns after listener is created
+func (a *Application) StartServer(ID string, protocol string, host string, port int, connLiveSec int, newSocket NewSocketFunc, tlsConf *TLSConfig) error {
+
+	srv_addr := fmt.Sprintf("%s:%d",host, port)
+
+	l, err := a.listen(srv_addr, tlsConf)
+	if err != nil {
+		return err
+	}
+
+	a.init()
+	if !a.addListener(l) {
+		l.Close()
+		return fmt.Errorf("%s: application is stopping", ID)
+	}
+	srv := &Server{ID: ID, Protocol: protocol, Addr: srv_addr, StartTime: time.Now(), conLiveSec: connLiveSec, listener: l}
+	a.mx.Lock()
+	a.Servers = append(a.Servers, srv)
+	a.mx.Unlock()
+	a.metrics.SetProtocol(ID, protocol)
+
+	a.Logger.Info("TCP server started", LOG_KEY_SERVER, ID, LOG_KEY_PROTOCOL, protocol, "addr", srv_addr)
+	go func() {
+		defer l.Close()
+		for {
+			conn, err := l.Accept()
+			if err != nil && (a.IsStopping() || srv.isStopped()) {
+				a.Logger.Info("TCP server stopped", LOG_KEY_SERVER, ID)
+				return
+
+			}else if err != nil {
+				a.Logger.Error("l.Accept failed", LOG_KEY_SERVER, ID, LOG_KEY_ERR, err)
+				srv.setAcceptErr(err)
+
+			} else {
+				srv.setAcceptErr(nil)
+				if a.addConn(conn) {
+					go a.HandleConnection(conn, newSocket, srv)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+//Stops accepting connections, connected devices are served till disconnect
+func (a *Application) StopServer(ID string) bool {
+	a.mx.Lock()
+	var srv *Server
+	for i, s := range a.Servers {
+		if s.ID == ID {
+			srv = s
+			a.Servers = append(a.Servers[:i], a.Servers[i+1:]...)
+			break
+		}
+	}
+	if srv != nil {
+		for i, l := range a.listeners {
+			if l == srv.listener {
+				a.listeners = append(a.listeners[:i], a.listeners[i+1:]...)
+				break
+			}
+		}
+	}
+	a.mx.Unlock()
+
+	if srv == nil {
+		return false
+	}
+	srv.mx.Lock()
+	srv.stopped = true
+	srv.mx.Unlock()
+	srv.listener.Close()
+	return true
+}
+
+func (a *Application) GetServer(ID string) *Server {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	for _, s := range a.Servers {
+		if s.ID == ID {
+			return s
+		}
+	}
+	return nil
+}
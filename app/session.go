@@ -0,0 +1,117 @@
+package app
+
+/**
+ * Device connection history. Session record is written through the storage
+ * when identified device disconnects, see Application.endSession.
+ */
+
+import(
+	"io"
+	"net"
+	"time"
+	"errors"
+	"context"
+)
+
+const (
+	//close reasons
+	SESSION_CLOSE_REMOTE = "remote" //closed by device
+	SESSION_CLOSE_TIMEOUT = "timeout" //no data for conLiveSec
+	SESSION_CLOSE_SHUTDOWN = "shutdown"
+	SESSION_CLOSE_READ_ERROR = "readError"
+	SESSION_CLOSE_WRITE_ERROR = "writeError"
+	SESSION_CLOSE_REJECTED = "rejected" //unknown device, see DeviceRegistry
+	SESSION_CLOSE_REPLACED = "replaced" //new connection of the same IMEI, see DUP_IMEI_CLOSE_OLD
+	SESSION_CLOSE_SERVER_STOPPED = "serverStopped"
+	SESSION_CLOSE_PANIC = "panic"
+
+	SESSION_DEF_LIMIT = 20 //sessions returned by admin command
+	SESSION_QUERY_TIMEOUT_SEC = 10
+)
+
+type Session struct {
+	ConnID string `json:"connId"`
+	IMEI string `json:"imei"`
+	DeviceID string `json:"deviceId"` //storage ID, see IdentifyDevice
+	ServerID string `json:"serverId"`
+	Protocol string `json:"protocol"`
+	RemoteAddr string `json:"remoteAddr"`
+	Start time.Time `json:"start"`
+	End time.Time `json:"end"`
+	BytesIn uint64 `json:"bytesIn"`
+	BytesOut uint64 `json:"bytesOut"`
+	Records uint64 `json:"records"`
+	DecodeErrors uint64 `json:"decodeErrors"`
+	CloseReason string `json:"closeReason"`
+}
+
+//Storage keeping session records
+type SessionWriter interface {
+	WriteSession(*Session)
+}
+
+//Storage returning recent sessions, the newest first
+type SessionReader interface {
+	GetSessions(ctx context.Context, imei string, limit int) ([]Session, error)
+}
+
+//close reason of read error
+func readCloseReason(err error, stopping bool) string {
+	var net_err net.Error
+	if stopping {
+		return SESSION_CLOSE_SHUTDOWN
+	}else if err == io.EOF {
+		return SESSION_CLOSE_REMOTE
+	}else if errors.As(err, &net_err) && net_err.Timeout() {
+		return SESSION_CLOSE_TIMEOUT
+	}
+	return SESSION_CLOSE_READ_ERROR
+}
+
+//Deferred by HandleConnection: recovers protocol handler panic,
+//removes socket from the list, writes offline state and session of identified device
+func (a *Application) endSession(id string, srv *Server, socket ClientSocketer) {
+	if r := recover(); r != nil {
+		a.logPanic(socket.GetLogger(), r)
+		socket.SetCloseReason(SESSION_CLOSE_PANIC)
+		socket.Close()
+	}
+	a.ClientSockets.Remove(id)
+	socket.SetOnline(false)
+
+	sess := socket.GetSession()
+	if sess.IMEI == "" {
+		//not a device or not identified
+		return
+	}
+	sess.ConnID = id
+	sess.ServerID = srv.ID
+	sess.Protocol = srv.Protocol
+	sess.End = time.Now()
+	if sess.CloseReason == "" && srv.isStopped() {
+		sess.CloseReason = SESSION_CLOSE_SERVER_STOPPED
+	}
+	socket.GetLogger().Info("session closed", "close_reason", sess.CloseReason,
+		"bytes_in", sess.BytesIn, "bytes_out", sess.BytesOut, "records", sess.Records, "decode_errors", sess.DecodeErrors)
+	if w, ok := a.Storage.(SessionWriter); ok && a.SessionHistory {
+		w.WriteSession(&sess)
+	}
+}
+
+//Recent sessions of IMEI from storage, the newest first
+func (a *Application) GetSessions(imei string, limit int) ([]Session, error) {
+	reader, ok := a.Storage.(SessionReader)
+	if !ok {
+		return nil, errors.New("storage does not keep sessions")
+	}
+	if limit <= 0 {
+		limit = SESSION_DEF_LIMIT
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(SESSION_QUERY_TIMEOUT_SEC) * time.Second)
+	defer cancel()
+	list, err := reader.GetSessions(ctx, imei, limit)
+	if err != nil {
+		a.Logger.Error("GetSessions failed", LOG_KEY_IMEI, imei, LOG_KEY_ERR, err)
+	}
+	return list, err
+}
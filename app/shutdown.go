@@ -0,0 +1,132 @@
+package app
+
+import(
+	"net"
+	"time"
+	"context"
+)
+
+const SHUTDOWN_CONN_CHECK_MS = 200
+
+//Graceful shutdown: stops accepting connections, lets connected sockets
+//finish current package within drainTimeout, flushes storage within storageTimeout.
+//Storage flush has its own deadline: records of slow connections are not
+//spooled because draining took the whole time.
+//Returns process exit code: 1 if data had to be spooled or storage failed.
+func (a *Application) Shutdown(drainTimeout, storageTimeout time.Duration) int {
+	a.mx.Lock()
+	a.stopping.Store(true)
+	listeners := a.listeners
+	a.listeners = nil
+	a.mx.Unlock()
+
+	if _, err := SdNotify(SD_STOPPING); err != nil {
+		a.Logger.Error("sd_notify failed", "state", SD_STOPPING, LOG_KEY_ERR, err)
+	}
+	a.Logger.Info("Shutdown: closing listeners", "listeners", len(listeners))
+	for _, l := range listeners {
+		l.Close()
+	}
+
+	drain_ctx, drain_cancel := context.WithTimeout(context.Background(), drainTimeout)
+	a.drainConnections(drain_ctx)
+	drain_cancel()
+
+	exit_code := 0
+	if a.Storage != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), storageTimeout)
+		defer cancel()
+		spooled, err := a.Storage.Close(ctx)
+		if err != nil {
+			a.Logger.Error("Shutdown: storage Close failed", "storage", a.Storage.GetDescr(), LOG_KEY_ERR, err)
+			exit_code = 1
+		}
+		if spooled > 0 {
+			a.Logger.Warn("Shutdown: queries left in spool", "storage", a.Storage.GetDescr(), "queries", spooled)
+			exit_code = 1
+		}
+	}
+	a.SetCapture(nil)
+	a.Logger.Info("Shutdown: done", "exit_code", exit_code)
+	return exit_code
+}
+
+//called by every socket after a package, does not take a.mx
+func (a *Application) IsStopping() bool {
+	return a.stopping.Load()
+}
+
+//interrupts blocking reads until all sockets are closed or ctx is done
+func (a *Application) drainConnections(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		a.connWG.Wait()
+		close(done)
+	}()
+
+	tick := time.NewTicker(time.Duration(SHUTDOWN_CONN_CHECK_MS) * time.Millisecond)
+	defer tick.Stop()
+	for {
+		//socket checks IsStopping after current package
+		for _, conn := range a.getConns() {
+			conn.SetReadDeadline(time.Now())
+		}
+		select {
+		case <-done:
+			a.Logger.Info("Shutdown: all connections closed")
+			return
+		case <-ctx.Done():
+			conns := a.getConns()
+			a.Logger.Warn("Shutdown: timeout, closing connections", "connections", len(conns))
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return
+		case <-tick.C:
+		}
+	}
+}
+
+//false if application is stopping
+func (a *Application) addListener(l net.Listener) bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if a.stopping.Load() {
+		return false
+	}
+	a.listeners = append(a.listeners, l)
+	return true
+}
+
+//false if application is stopping, connection is closed
+func (a *Application) addConn(conn net.Conn) bool {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if a.stopping.Load() {
+		conn.Close()
+		return false
+	}
+	if a.conns == nil {
+		a.conns = make(map[net.Conn]bool)
+	}
+	a.conns[conn] = true
+	a.connWG.Add(1)
+	return true
+}
+
+func (a *Application) removeConn(conn net.Conn) {
+	a.mx.Lock()
+	delete(a.conns, conn)
+	a.mx.Unlock()
+	a.connWG.Done()
+}
+
+func (a *Application) getConns() []net.Conn {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	list := make([]net.Conn, 0, len(a.conns))
+	for conn := range a.conns {
+		list = append(list, conn)
+	}
+	return list
+}
@@ -3,6 +3,9 @@ package app
 import(
 	"fmt"	
 	"time"
+	"strings"
+	"log/slog"
+	"encoding/json"
 )
 
 const (
@@ -13,15 +16,39 @@ const (
 	CMD_UPLOADED_BYTES byte = 0x05
 	CMD_LIST byte = 0x06
 	CMD_HANDSHAKES byte = 0x07
+	CMD_QUEUE byte = 0x08
+	CMD_RELOAD byte = 0x09
+	CMD_REGISTRY byte = 0x0A
+	CMD_REGISTRY_REFRESH byte = 0x0B
+	CMD_RECONNECTS byte = 0x0C
+	CMD_LOG_LEVELS byte = 0x0D
+	CMD_RETRANSLATION byte = 0x0E
 	CMD_STATUS byte = 0xFF
 	
 	CMD_DEV_RUN_TIME byte = 0x82
 	CMD_DEV_DOWNLOADED_BYTES byte = 0x84	
 	CMD_DEV_UPLOADED_BYTES byte = 0x85
 	CMD_DEV_HANDSHAKES byte = 0x87
+	CMD_DEV_QUEUE byte = 0x88
+	CMD_DEV_RECONNECTS byte = 0x8C
+	CMD_DEV_LOG_LEVEL byte = 0x8D //second command byte is LOG_LVL_*
+	CMD_DEV_SESSIONS byte = 0x8E //optional second command byte is session count
 	CMD_DEV_STATUS byte = 0xFE
+
+	//levels of CMD_DEV_LOG_LEVEL
+	LOG_LVL_RESET byte = 0x00 //global level is used
+	LOG_LVL_DEBUG byte = 0x01
+	LOG_LVL_INFO byte = 0x02
+	LOG_LVL_WARN byte = 0x03
+	LOG_LVL_ERROR byte = 0x04
 )
 
+var logLevelCodes = map[byte]slog.Level{LOG_LVL_DEBUG: slog.LevelDebug,
+	LOG_LVL_INFO: slog.LevelInfo,
+	LOG_LVL_WARN: slog.LevelWarn,
+	LOG_LVL_ERROR: slog.LevelError,
+}
+
 func (app *Application) SrvCMDError(errStr string) string {
 	return app.SrvCMDResponse(errStr, "")
 }
@@ -35,7 +62,7 @@ func (app *Application) SrvCMDResponse(errStr string, objects string) string {
 }	
 
 func (app *Application) SrvCMDClientCount() string {
-	return fmt.Sprintf(`"clientCount":%d`, (app.ClientSockets.Len() - 1))
+	return fmt.Sprintf(`"clientCount":%d`, app.ClientSockets.Len())
 }
 
 func (app *Application) SrvCMDRunTime() string {
@@ -59,8 +86,139 @@ func (app *Application) SrvCMDHandshakes() string {
 	return fmt.Sprintf(`"handshakes":%d`, app.GetHandshakes())
 }
 
+func (app *Application) SrvCMDReconnects() string {
+	return fmt.Sprintf(`"reconnects":%d`, app.ClientSockets.GetReconnects(""))
+}
+
+func (app *Application) SrvCMDQueue(imei string) string {
+	var list []QueuedCommand
+	if app.CommandQueue != nil {
+		list = app.CommandQueue.List(imei)
+	}else{
+		list = make([]QueuedCommand, 0)
+	}
+	list_b, err := json.Marshal(list)
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDResponse("", fmt.Sprintf(`"queue":%s`, string(list_b)))
+}
+
+//puts command for offline device to the queue
+func (app *Application) SrvCMDQueueCommand(imei string, cmd []byte) string {
+	q_cmd, err := app.CommandQueue.Add(imei, cmd)
+	if err != nil {
+		app.Logger.Error("CommandQueue.Add failed", LOG_KEY_IMEI, imei, LOG_KEY_ERR, err)
+		return app.SrvCMDError(err.Error())
+	}
+	app.Logger.Info("not connected, command queued", LOG_KEY_IMEI, imei, "payload", q_cmd.Payload, "expires", q_cmd.Expires)
+	cmd_b, err := json.Marshal(q_cmd)
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDResponse("", fmt.Sprintf(`"queued":%s`, string(cmd_b)))
+}
+
+func (app *Application) SrvCMDReload() string {
+	if app.Reloader == nil {
+		return app.SrvCMDError("configuration reload is not supported")
+	}
+	report_b, err := json.Marshal(app.Reloader())
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDResponse("", fmt.Sprintf(`"reload":%s`, string(report_b)))
+}
+
+//registry state with unknown devices
+func (app *Application) SrvCMDRegistry() string {
+	if app.Devices == nil {
+		return app.SrvCMDError("device registry is not configured")
+	}
+	unknown_b, err := json.Marshal(app.Devices.GetUnknown())
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDResponse("", fmt.Sprintf(`"registry":{"policy":"%s","deviceCount":%d,"unknown":%s}`,
+		app.Devices.GetPolicy(), app.Devices.Len(), string(unknown_b)))
+}
+
+func (app *Application) SrvCMDRegistryRefresh() string {
+	if app.Devices == nil {
+		return app.SrvCMDError("device registry is not configured")
+	}
+	if err := app.Devices.Refresh(); err != nil {
+		app.Logger.Error("DeviceRegistry Refresh failed", LOG_KEY_ERR, err)
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDRegistry()
+}
+
+//recent sessions, args: optional count
+func (app *Application) SrvCMDSessions(imei string, args []byte) string {
+	limit := 0
+	if len(args) > 0 {
+		limit = int(args[0])
+	}
+	list, err := app.GetSessions(imei, limit)
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	list_b, err := json.Marshal(list)
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDResponse("", fmt.Sprintf(`"imei":"%s","sessions":%s`, imei, string(list_b)))
+}
+
+//IMEI log level overrides
+func (app *Application) SrvCMDLogLevels() string {
+	list_b, err := json.Marshal(app.LogLevels.GetIMEIList())
+	if err != nil {
+		return app.SrvCMDError(err.Error())
+	}
+	return app.SrvCMDResponse("", fmt.Sprintf(`"logLevels":{"level":"%s","imei":%s}`,
+		strings.ToLower(app.LogLevels.Level.Level().String()), string(list_b)))
+}
+
+//sets or resets log level of IMEI, device does not have to be connected
+func (app *Application) SrvCMDSetLogLevel(imei string, args []byte) string {
+	if app.LogLevels == nil {
+		return app.SrvCMDError("log levels are not configured")
+	}
+	if len(args) == 0 {
+		return app.SrvCMDError("log level code is missing")
+	}
+	if args[0] == LOG_LVL_RESET {
+		app.LogLevels.ResetIMEI(imei)
+		app.Logger.Info("log level override removed", LOG_KEY_IMEI, imei)
+		return app.SrvCMDLogLevels()
+	}
+	lvl, ok := logLevelCodes[args[0]]
+	if !ok {
+		return app.SrvCMDError(fmt.Sprintf("unknown log level code %d", args[0]))
+	}
+	app.LogLevels.SetIMEI(imei, lvl)
+	app.Logger.Info("log level override set", LOG_KEY_IMEI, imei, "log_level", lvl.String())
+	return app.SrvCMDLogLevels()
+}
+
+//commands reading connected socket statistics
+func needsSocket(cmd byte) bool {
+	switch cmd {
+	case CMD_DEV_RUN_TIME, CMD_DEV_DOWNLOADED_BYTES, CMD_DEV_UPLOADED_BYTES, CMD_DEV_HANDSHAKES, CMD_DEV_STATUS:
+		return true
+	}
+	return false
+}
+
 //returns json string
 func (app *Application) SrvCMDRunServerCommand(cmd byte, imei string, sock ClientSocketer) string {
+	if sock == nil && needsSocket(cmd) {
+		t := fmt.Sprintf("Device command %d requires connected device", cmd)
+		app.Logger.Error(t, LOG_KEY_IMEI, imei)
+		return app.SrvCMDResponse(t, "")
+	}
 	switch cmd {
 		case CMD_CLIENT_CNT:
 			return app.SrvCMDResponse("",app.SrvCMDClientCount())
@@ -93,10 +251,34 @@ func (app *Application) SrvCMDRunServerCommand(cmd byte, imei string, sock Clien
 			}
 			return app.SrvCMDResponse("",fmt.Sprintf(`"list":[%s]`, list_s))
 
+		case CMD_QUEUE:
+			return app.SrvCMDQueue("")
+
+		case CMD_RELOAD:
+			return app.SrvCMDReload()
+
+		case CMD_RECONNECTS:
+			return app.SrvCMDResponse("",app.SrvCMDReconnects())
+
+		case CMD_REGISTRY:
+			return app.SrvCMDRegistry()
+
+		case CMD_REGISTRY_REFRESH:
+			return app.SrvCMDRegistryRefresh()
+
+		case CMD_LOG_LEVELS:
+			if app.LogLevels == nil {
+				return app.SrvCMDError("log levels are not configured")
+			}
+			return app.SrvCMDLogLevels()
+
+		case CMD_RETRANSLATION:
+			return app.SrvCMDResponse("", app.SrvCMDRetranslation())
+
 		case CMD_STATUS:
-			status := fmt.Sprintf(`{"status":{%s,%s,%s,%s,%s,%s}}`, app.SrvCMDClientCount(),
+			status := fmt.Sprintf(`{"status":{%s,%s,%s,%s,%s,%s,%s,%s}}`, app.SrvCMDClientCount(),
 				app.SrvCMDRunTime(), app.SrvCMDClientMaxCount(), app.SrvCMDDownloadedBytes(), app.SrvCMDUploadedBytes(),
-				app.SrvCMDHandshakes())
+				app.SrvCMDHandshakes(), app.SrvCMDReconnects(), app.SrvCMDRetranslation())
 			return app.SrvCMDResponse("", status)
 		
 		case CMD_DEV_RUN_TIME:
@@ -111,6 +293,12 @@ func (app *Application) SrvCMDRunServerCommand(cmd byte, imei string, sock Clien
 		case CMD_DEV_HANDSHAKES:
 			return app.SrvCMDResponse("", fmt.Sprintf(`"imei":"%s","handshakes":%d`,imei,sock.GetHandshakes()))
 			
+		case CMD_DEV_RECONNECTS:
+			return app.SrvCMDResponse("", fmt.Sprintf(`"imei":"%s","reconnects":%d`,imei,app.ClientSockets.GetReconnects(imei)))
+
+		case CMD_DEV_QUEUE:
+			return app.SrvCMDQueue(imei)
+
 		case CMD_DEV_STATUS:
 			return app.SrvCMDResponse("", fmt.Sprintf(`"imei":"%s",status:{"runTime":%d,"downloadedBytes":%d,"uploadedBytes":%d}`,
 				imei, sock.GetRunTime(), sock.GetDownloadedBytes(), sock.GetUploadedBytes()))
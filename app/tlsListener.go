@@ -0,0 +1,110 @@
+package app
+
+import(
+	"os"
+	"net"
+	"time"
+	"sync"
+	"errors"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
+	"log/slog"
+)
+
+const TLS_RELOAD_CHECK_SEC = 5 //certificate files are checked for changes not more often
+
+//TLS parameters of a listener
+type TLSConfig struct {
+	CertFile string `json:"certFile"`
+	KeyFile string `json:"keyFile"`
+	ClientCAFile string `json:"clientCAFile"` //mutual TLS if set
+}
+
+//Reloads certificate and client CA when files are changed
+type certReloader struct {
+	conf TLSConfig
+	logger *slog.Logger
+	mx sync.Mutex
+	tlsConf *tls.Config
+	modTime time.Time
+	lastCheck time.Time
+}
+
+//Listener with TLS if tlsConf is set
+func (a *Application) listen(addr string, tlsConf *TLSConfig) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || tlsConf == nil || tlsConf.CertFile == "" {
+		return l, err
+	}
+	r := &certReloader{conf: *tlsConf, logger: a.Logger}
+	if err := r.load(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return tls.NewListener(l, &tls.Config{GetConfigForClient: r.getConfigForClient}), nil
+}
+
+func (r *certReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+
+	if time.Since(r.lastCheck) >= time.Duration(TLS_RELOAD_CHECK_SEC) * time.Second {
+		r.lastCheck = time.Now()
+		if r.filesModTime().After(r.modTime) {
+			if err := r.loadLocked(); err != nil {
+				//old certificate is used
+				r.logger.Error("TLS reload failed", "file", r.conf.CertFile, LOG_KEY_ERR, err)
+			}else{
+				r.logger.Info("TLS certificate reloaded", "file", r.conf.CertFile)
+			}
+		}
+	}
+	return r.tlsConf, nil
+}
+
+func (r *certReloader) load() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.loadLocked()
+}
+
+//must be called under lock
+func (r *certReloader) loadLocked() error {
+	mod_time := r.filesModTime()
+	cert, err := tls.LoadX509KeyPair(r.conf.CertFile, r.conf.KeyFile)
+	if err != nil {
+		return err
+	}
+	conf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if r.conf.ClientCAFile != "" {
+		ca, err := ioutil.ReadFile(r.conf.ClientCAFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return errors.New("no certificates in "+r.conf.ClientCAFile)
+		}
+		conf.ClientCAs = pool
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	r.tlsConf = conf
+	r.modTime = mod_time
+	r.lastCheck = time.Now()
+	return nil
+}
+
+//latest modification time of all files
+func (r *certReloader) filesModTime() time.Time {
+	var tm time.Time
+	for _, f := range []string{r.conf.CertFile, r.conf.KeyFile, r.conf.ClientCAFile} {
+		if f == "" {
+			continue
+		}
+		if st, err := os.Stat(f); err == nil && st.ModTime().After(tm) {
+			tm = st.ModTime()
+		}
+	}
+	return tm
+}
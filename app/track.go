@@ -0,0 +1,121 @@
+package app
+
+/**
+ * Track reading from storage, see TrackReader and GET /tracks/{id}.
+ * Period and points of one request are limited, the rest of period
+ * is requested from TRACK_NEXT_FROM_HEADER time.
+ */
+
+import(
+	"time"
+	"errors"
+	"context"
+	"strconv"
+	"strings"
+	"net/http"
+)
+
+const (
+	HTTP_TRACKS_PATH = "/tracks"
+	TRACK_DEF_PERIOD_HOURS = 24 //period if from is not set
+	TRACK_MAX_PERIOD_HOURS = 31 * 24
+	TRACK_DEF_LIMIT = 10000 //points of one request
+	TRACK_MAX_LIMIT = 100000
+	TRACK_QUERY_TIMEOUT_SEC = 30
+	TRACK_NEXT_FROM_HEADER = "X-Track-Next-From" //set if track is truncated by limit
+)
+
+//returned by TrackReader for period start before storage retention
+var ErrTrackRetention = errors.New("from is before retention period")
+
+type TrackPoint struct {
+	ID string `json:"id"` //storage ID, see IdentifyDevice
+	GPSTime time.Time `json:"gpsTime"`
+	ReceivedTime time.Time `json:"receivedTime"`
+	Lon float32 `json:"lon"`
+	Lat float32 `json:"lat"`
+	Speed int `json:"speed"`
+	Heading int `json:"heading"`
+	SatNum byte `json:"satNum"`
+	Odometer uint32 `json:"odometer"`
+	Voltage int16 `json:"voltage"`
+	GPSValid bool `json:"gpsValid"`
+	FromMemory bool `json:"fromMemory"`
+}
+
+//Storage returning track points of device ID for GPS time range, ordered by GPS time,
+//not more than limit points from the beginning of range
+type TrackReader interface {
+	GetTrack(ctx context.Context, id string, from, to time.Time, limit int) ([]TrackPoint, error)
+}
+
+func (a *Application) GetTrack(id string, from, to time.Time, limit int) ([]TrackPoint, error) {
+	reader, ok := a.Storage.(TrackReader)
+	if !ok {
+		return nil, errors.New("storage does not return tracks")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(TRACK_QUERY_TIMEOUT_SEC) * time.Second)
+	defer cancel()
+	return reader.GetTrack(ctx, id, from, to, limit)
+}
+
+//GET /tracks/{id}?from=RFC3339&to=RFC3339&limit=N, the last TRACK_DEF_PERIOD_HOURS by default.
+//Truncated track has TRACK_NEXT_FROM_HEADER with from of the next request.
+func (a *Application) httpTrack(w http.ResponseWriter, r *http.Request, key APIKey) {
+	if r.Method != http.MethodGet {
+		httpWriteError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, HTTP_TRACKS_PATH), "/")
+	if id == "" || strings.Contains(id, "/") {
+		httpWriteError(w, http.StatusNotFound, "not found")
+		return
+	}
+	to := time.Now()
+	if v := r.URL.Query().Get("to"); v != "" {
+		var err error
+		if to, err = time.Parse(time.RFC3339, v); err != nil {
+			httpWriteError(w, http.StatusBadRequest, "to must be RFC3339 time")
+			return
+		}
+	}
+	from := to.Add(-time.Duration(TRACK_DEF_PERIOD_HOURS) * time.Hour)
+	if v := r.URL.Query().Get("from"); v != "" {
+		var err error
+		if from, err = time.Parse(time.RFC3339, v); err != nil {
+			httpWriteError(w, http.StatusBadRequest, "from must be RFC3339 time")
+			return
+		}
+	}
+	if to.Before(from) {
+		httpWriteError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	if to.Sub(from) > time.Duration(TRACK_MAX_PERIOD_HOURS) * time.Hour {
+		httpWriteError(w, http.StatusBadRequest, "period must not exceed "+strconv.Itoa(TRACK_MAX_PERIOD_HOURS)+" hours")
+		return
+	}
+	limit := TRACK_DEF_LIMIT
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 || limit > TRACK_MAX_LIMIT {
+			httpWriteError(w, http.StatusBadRequest, "limit must be 1.."+strconv.Itoa(TRACK_MAX_LIMIT))
+			return
+		}
+	}
+	//one more point tells that track is truncated
+	track, err := a.GetTrack(id, from, to, limit + 1)
+	if errors.Is(err, ErrTrackRetention) {
+		httpWriteError(w, http.StatusBadRequest, err.Error())
+		return
+	}else if err != nil {
+		a.Logger.Error("GetTrack failed", "id", id, LOG_KEY_ERR, err)
+		httpWriteError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if len(track) > limit {
+		track = track[:limit]
+		w.Header().Set(TRACK_NEXT_FROM_HEADER, track[limit-1].GPSTime.Add(time.Nanosecond).Format(time.RFC3339Nano))
+	}
+	httpWriteJSON(w, http.StatusOK, track)
+}
@@ -0,0 +1,79 @@
+package app
+
+import(
+	"io"
+	"time"
+	"context"
+	"testing"
+	"net/http"
+	"log/slog"
+	"encoding/json"
+	"net/http/httptest"
+)
+
+//point every minute from start
+type testTrackStorage struct {
+	testSink
+	start time.Time
+}
+
+func (s *testTrackStorage) GetTrack(ctx context.Context, id string, from, to time.Time, limit int) ([]TrackPoint, error) {
+	if from.Before(s.start) {
+		return nil, ErrTrackRetention
+	}
+	track := make([]TrackPoint, 0)
+	for tm := from.Truncate(time.Minute); !tm.After(to) && len(track) < limit; tm = tm.Add(time.Minute) {
+		if !tm.Before(from) {
+			track = append(track, TrackPoint{ID: id, GPSTime: tm})
+		}
+	}
+	return track, nil
+}
+
+func getTestTrack(a *Application, query string) (*httptest.ResponseRecorder, []TrackPoint) {
+	w := httptest.NewRecorder()
+	a.httpTrack(w, httptest.NewRequest(http.MethodGet, HTTP_TRACKS_PATH+"/1?"+query, nil), APIKey{})
+	var track []TrackPoint
+	if w.Code == http.StatusOK {
+		json.Unmarshal(w.Body.Bytes(), &track)
+	}
+	return w, track
+}
+
+func TestHTTPTrackPages(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := &Application{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Storage: &testTrackStorage{start: start}}
+
+	//10 points by pages of 4
+	from := start.Format(time.RFC3339Nano)
+	to := start.Add(9 * time.Minute).Format(time.RFC3339)
+	cnt, pages := 0, 0
+	for from != "" {
+		w, track := getTestTrack(a, "limit=4&to="+to+"&from="+from)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d %s", w.Code, w.Body.String())
+		}
+		for _, p := range track {
+			if !p.GPSTime.Equal(start.Add(time.Duration(cnt) * time.Minute)) {
+				t.Fatalf("point %d: %v", cnt, p.GPSTime)
+			}
+			cnt++
+		}
+		pages++
+		from = w.Header().Get(TRACK_NEXT_FROM_HEADER)
+	}
+	if cnt != 10 || pages != 3 {
+		t.Fatalf("points %d, pages %d", cnt, pages)
+	}
+
+	for _, query := range []string{
+		"from=2024-01-01T00:00:00Z&to=2024-03-01T00:00:00Z",
+		"from=2023-12-31T00:00:00Z&to=2024-01-01T00:00:00Z",
+		"from=2024-01-01T00:00:00Z&to=2024-01-01T01:00:00Z&limit=0",
+		"from=2024-01-01T00:00:00Z&to=2024-01-01T01:00:00Z&limit=1000000",
+	} {
+		if w, _ := getTestTrack(a, query); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: status %d", query, w.Code)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+package arnavi
+
+import(
+	"bytes"
+	"encoding/binary"
+	"time"
+	"math"
+	"strconv"
+	"encoding/hex"
+	"fmt"
+	
+	"telsrv/app"
+)
+
+const (
+	INIT_PACKAGE_LEN = 10
+	DATA_PACKAGE_LEN = 4096 //longer package is dropped, see app.CODEC_READ_BUFFER_LEN
+	
+	INIT_PACKAGE_PREF = 0xFF	
+	HEADER_PROT1 = 0x22
+	HEADER_PROT2 = 0x23
+	HEADER_PROT3 = 0x24
+	
+	DATA_PACKAGE_PREF = 0x5B
+	DATA_PACKAGE_POSTF = 0x5D
+	DATA_PACKAGE_TYPE_ANSWER = 0xFD
+	DATA_PACKAGE_MAX_PARCEL = 0xFB
+	
+	PACKET_HEADER_LEN = 7 //type(1),len(2),unixTime(4)
+	PACKET_PING = 0x00
+	
+	PACKET_TAGS = 0x01
+	PACKET_TAGS_LEN = 5
+	TAG_VAR_VOLT = 1
+	TAG_VAR_ID = 2
+	TAG_VAR_LAT = 3
+	TAG_VAR_LON = 4
+	TAG_VAR_ATTRS = 5 //speed (high), satellites, height, course (least significant byte)
+	TAG_VAR_PIN = 6
+	TAG_VAR_SIM1_ATTRS = 7 //local area code(2), cell ID (2)
+	TAG_VAR_SIM1_ATTRS2 = 8
+	TAG_VAR_DEVICE_STAT = 9
+	
+	PACKET_TEXT = 0x03
+	PACKET_FILE = 0x04
+	PACKET_BINARY = 0x06
+	PACKET_CONFIRM = 0x08
+	PACKET_CONFIRM_BY_TOKEN = 0x09
+	
+	SERV_RESP_PREF = 0x7B
+	SERV_RESP_POSTF = 0x7D
+	HEADER_PARCEL = 0x00
+	
+	SERV_CMD_PARCEL = 0xFF	
+)
+
+
+func Float32frombytes(bytes []byte) float32 {
+    bits := binary.LittleEndian.Uint32(bytes)
+    float := math.Float32frombits(bits)
+    return float
+}
+
+func calcCheckSum(bf []byte) (sm byte) {
+	for i:=0; i<len(bf); i++{
+		sm += bf[i]; 	
+	}
+	return sm
+}
+
+//Arnavi protocol codec, data packages are accepted after init package
+type ArnaviCodec struct {
+	imei string
+}
+
+func NewCodec() app.Codec {
+	return &ArnaviCodec{}
+}
+
+//Prefix(1),Length(1),parcelNum(1),checkSum(1),payload(n),Potfix(1) 4 bytes with no payload
+func encodeServResponse(payload []byte, parcelNum byte) []byte {
+	var payload_n byte
+	var payload_inc byte;
+	if payload != nil {
+		payload_n = byte(len(payload))		
+		payload_inc = 5 //check sum!
+	}else{
+		payload_inc = 4
+	}
+	resp := make([]byte, payload_n + payload_inc)
+	resp[0] = SERV_RESP_PREF
+	resp[1] = payload_n
+	resp[2] = parcelNum
+	
+	if payload != nil {
+		resp[3] = calcCheckSum(payload)
+		var i byte
+		for i = 0; i < payload_n; i++{
+			resp[i + 4] = payload[i]
+		}
+	}
+	
+	resp[payload_n + payload_inc - 1] = SERV_RESP_POSTF
+	return resp
+}
+
+func (c *ArnaviCodec) EncodeCommand(payload []byte) []byte {
+	return encodeServResponse(payload, SERV_CMD_PARCEL)
+}
+
+/**
+ * Complete frames are decoded, incomplete frame is kept for next read.
+ * Init: Pref(0xFF),Protocol(1),ID(8)
+ * Data: Pref(0x5B),parcelNum(1),packets,Postf(0x5D)
+ * packet: type(1),len(2),unixTime(4),data(len),checkSum(1)
+ * Answer: Pref(0x5B),0xFD,code(1)...,Postf(0x5D)
+ * Data package is confirmed with its parcel number if all packets are decoded,
+ * the device resends unconfirmed package.
+ */
+func (c *ArnaviCodec) Decode(buf []byte) (app.DecodeResult, error) {
+	var res app.DecodeResult
+	var err error
+	for res.Consumed < len(buf) {
+		frame_len, frame_err := c.decodeFrame(buf[res.Consumed:], &res)
+		if frame_err != nil {
+			err = frame_err
+		}
+		if frame_len == 0 {
+			break
+		}
+		res.Consumed += frame_len
+	}
+	return res, err
+}
+
+/**
+ * Returns frame length, 0 if frame is incomplete.
+ * Not a frame start: bytes are skipped up to the next frame start.
+ */
+func (c *ArnaviCodec) decodeFrame(buf []byte, res *app.DecodeResult) (int, error) {
+	if len(buf) < 2 {
+		if buf[0] == INIT_PACKAGE_PREF || buf[0] == DATA_PACKAGE_PREF {
+			return 0, nil
+		}
+		return len(buf), app.NewDecodeError(app.DECODE_ERR_UNKNOWN, "unknown package, package_buf[0]=%d", buf[0])
+	}
+	
+	//init package 0-Pref, 1-Protocol, 2-9 IMEI
+	if buf[0] == INIT_PACKAGE_PREF && (buf[1] == HEADER_PROT1 || buf[1] == HEADER_PROT2) {
+		if len(buf) < INIT_PACKAGE_LEN {
+			return 0, nil
+		}
+		//IMEI/ID 8 bytes uint64
+		c.imei = strconv.FormatUint(binary.LittleEndian.Uint64(buf[2:INIT_PACKAGE_LEN]), 10)
+		res.IMEI = c.imei
+		res.Handshake = true
+		res.Frames++
+		
+		if buf[1] == HEADER_PROT1 {
+			//empty payload
+			res.Replies = append(res.Replies, encodeServResponse(nil, 0))
+			
+		}else{
+			//payload = unix timestamp
+			payload := make([]byte, 4)
+			binary.LittleEndian.PutUint32(payload, uint32(time.Now().UTC().Unix()))
+			res.Replies = append(res.Replies, encodeServResponse(payload, HEADER_PARCEL))
+		}
+		return INIT_PACKAGE_LEN, nil
+		
+	}else if buf[0] == DATA_PACKAGE_PREF && buf[1] == DATA_PACKAGE_TYPE_ANSWER {
+		//answer to server command
+		end := bytes.IndexByte(buf[2:], DATA_PACKAGE_POSTF)
+		if end < 0 {
+			if len(buf) >= DATA_PACKAGE_LEN {
+				return skipToFrame(buf), app.NewDecodeError(app.DECODE_ERR_LENGTH, "answer package without end, %d bytes", len(buf))
+			}
+			return 0, nil
+		}
+		frame_len := end + 3
+		if end == 0 {
+			return frame_len, app.NewDecodeError(app.DECODE_ERR_LENGTH, "answer package too short, %d bytes", frame_len)
+		}
+		if c.imei != "" {
+			res.Frames++
+			res.Answers = append(res.Answers, buf[2])
+		}
+		return frame_len, nil
+		
+	}else if buf[0] == DATA_PACKAGE_PREF && buf[1] <= DATA_PACKAGE_MAX_PARCEL {
+		frame_len, err := dataFrameLen(buf)
+		if err != nil {
+			return skipToFrame(buf), err
+		}
+		if frame_len == 0 {
+			return 0, nil
+		}
+		if c.imei == "" {
+			//no init package, device is not confirmed and has to reconnect
+			return frame_len, nil
+		}
+		res.Frames++
+		rec_cnt := len(res.Records)
+		if err := c.decodePackets(buf[2:frame_len-1], res); err != nil {
+			//not confirmed, records are resent
+			res.Records = res.Records[:rec_cnt]
+			return frame_len, err
+		}
+		res.Replies = append(res.Replies, encodeServResponse(nil, 1))
+		return frame_len, nil
+	}
+	
+	return skipToFrame(buf), app.NewDecodeError(app.DECODE_ERR_UNKNOWN, "unknown package, package_buf[0]=%d, package_buf[1]=%d", buf[0], buf[1])
+}
+
+//length of data package up to postfix, 0 if incomplete
+func dataFrameLen(buf []byte) (int, error) {
+	pos := 2
+	for pos < len(buf) {
+		if buf[pos] == DATA_PACKAGE_POSTF {
+			return pos + 1, nil
+		}
+		if pos+3 > len(buf) {
+			return 0, nil
+		}
+		pos += PACKET_HEADER_LEN + int(binary.LittleEndian.Uint16(buf[pos+1:pos+3])) + 1
+		if pos >= DATA_PACKAGE_LEN {
+			return 0, app.NewDecodeError(app.DECODE_ERR_LENGTH, "data package exceeds %d bytes", DATA_PACKAGE_LEN)
+		}
+	}
+	return 0, nil
+}
+
+//bytes before the next possible frame start
+func skipToFrame(buf []byte) int {
+	for i := 1; i < len(buf); i++ {
+		if buf[i] == INIT_PACKAGE_PREF || buf[i] == DATA_PACKAGE_PREF {
+			return i
+		}
+	}
+	return len(buf)
+}
+
+//packets of framed data package without prefix, parcel number and postfix
+func (c *ArnaviCodec) decodePackets(packets []byte, res *app.DecodeResult) error {
+	for len(packets) > 0 {
+		data_len := int(binary.LittleEndian.Uint16(packets[1:3]))
+		packet_len := PACKET_HEADER_LEN + data_len + 1
+		unix_time := binary.LittleEndian.Uint32(packets[3:7])
+		data := packets[PACKET_HEADER_LEN : PACKET_HEADER_LEN+data_len]
+		check_sum := packets[packet_len-1]
+		calc_check_sum := calcCheckSum(packets[3 : packet_len-1])
+		if calc_check_sum != check_sum {
+			return app.NewDecodeError(app.DECODE_ERR_CHECKSUM, "Data package checksum error, packet type %d, %d<>%d", packets[0], calc_check_sum, check_sum)
+		}
+		
+		switch packets[0] {
+		case PACKET_TAGS:
+			if data_len % PACKET_TAGS_LEN != 0 {
+				return app.NewDecodeError(app.DECODE_ERR_LENGTH, "TAGS packet length %d is not multiple of %d", data_len, PACKET_TAGS_LEN)
+			}
+			res.Records = append(res.Records, c.decodeTags(time.Unix(int64(unix_time), 0), data))
+			
+		case PACKET_PING, PACKET_TEXT, PACKET_FILE, PACKET_BINARY, PACKET_CONFIRM, PACKET_CONFIRM_BY_TOKEN:
+			//not stored
+			
+		default:
+			return app.NewDecodeError(app.DECODE_ERR_UNKNOWN, "Data package unknown, Data=%s", hex.EncodeToString(packets[:packet_len]))
+		}
+		packets = packets[packet_len:]
+	}
+	return nil
+}
+
+//tag decode, PACKET_TAGS_LEN bytes each
+func (c *ArnaviCodec) decodeTags(packetTime time.Time, data []byte) app.TelematicsData {
+	tel_data := app.TelematicsData{ID: c.imei,
+			GPSTime: packetTime,
+			ReceivedTime: time.Now(),
+			GPSValid: true,
+		}
+	tag_n := len(data) / PACKET_TAGS_LEN
+	var num_ind int
+	for tag_i :=0 ;tag_i < tag_n; tag_i++ {
+		num_ind = tag_i * PACKET_TAGS_LEN
+		tag_var_num := data[num_ind]
+		tag_var_val := data[num_ind + 1 : (tag_i+1) * PACKET_TAGS_LEN]
+		switch tag_var_num {
+		case TAG_VAR_VOLT:
+			tel_data.VoltExt = int16(binary.LittleEndian.Uint16(tag_var_val[0:2]))
+			tel_data.VoltInt = int16(binary.LittleEndian.Uint16(tag_var_val[2:4]))
+			
+		case TAG_VAR_ID:
+			
+			
+		case TAG_VAR_LAT:
+			tel_data.Lat = Float32frombytes(tag_var_val)
+			
+		case TAG_VAR_LON:
+			tel_data.Lon = Float32frombytes(tag_var_val)
+			
+		case TAG_VAR_ATTRS:
+			tel_data.Speed = int(float32(tag_var_val[3]) * 1.852)
+			tel_data.SattlliteNum =  tag_var_val[2]
+			tel_data.Height = int(tag_var_val[1]) * 10
+			tel_data.Heading = int(tag_var_val[0]) * 2
+		
+		//case TAG_VAR_SIM1_ATTRS:
+			
+		case TAG_VAR_SIM1_ATTRS2:	
+			tel_data.SignalLevel = tag_var_val[0]
+			
+		//case TAG_VAR_DEVICE_STAT: Tabel 2
+			
+		}
+	}
+	
+	lat_deg, lat_min, lat_min_dec := convertFloatToDegree(tel_data.Lat)
+	tel_data.Lat_s = coordSign(tel_data.Lat) + fmt.Sprintf("%d%02d.%d", lat_deg, lat_min, lat_min_dec)
+	
+	lon_deg, lon_min, lon_min_dec := convertFloatToDegree(tel_data.Lon)
+	tel_data.Lon_s = coordSign(tel_data.Lon) + fmt.Sprintf("%03d%02d.%d", lon_deg, lon_min, lon_min_dec)
+	return tel_data
+}
+
+//"-" for negative coordinate, the string format is kept for stored data
+func coordSign(coord float32) string {
+	if coord < 0 {
+		return "-"
+	}
+	return ""
+}
+
+//returns degree, minutes of coordinate, minute decimal part (5 digits without leading zeros)
+//of absolute coordinate value
+func convertFloatToDegree(coord float32) (int, int, int) {	
+	if coord == 0.0 || math.IsNaN(float64(coord)) || math.IsInf(float64(coord), 0) {
+		return 0,0,0
+	}
+	abs := math.Abs(float64(coord))
+	min, min_dec := math.Modf(abs * 60.0)
+	min_dec_s := fmt.Sprintf("%.5f", min_dec)	
+	if len(min_dec_s) >= 3 {
+		//0. - skeep
+		if i, err := strconv.Atoi(min_dec_s[2:]); err == nil {
+			return int(abs), int(min), i
+		}		
+	}
+	return 0,0,0
+}
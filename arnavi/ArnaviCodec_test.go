@@ -0,0 +1,207 @@
+package arnavi
+
+import(
+	"math"
+	"time"
+	"bytes"
+	"encoding/hex"
+	"encoding/binary"
+	"testing"
+
+	"telsrv/app"
+)
+
+//Synthetic frames built by the protocol description for IMEI 861230043907626,
+//not captured from a device
+const (
+	PKT_INIT = "ff222a46d6be480f0300"
+	PKT_INIT_TIME = "ff232a46d6be480f0300"
+	//parcel 1: TAGS volt 12500/4100, lat 55.75, lon 37.625, heading 90, height 150, 9 satellites, speed 30 knots, signal 21
+	PKT_DATA1 = "5b0101190000f1536501d43004100300005f420400801642052d0f091e0815000000c75d"
+	//parcel 2: TAGS, TEXT "hello", TAGS
+	PKT_DATA2 = "5b020119000af1536501d43004100300005f420400801642052d0f091e0815000000d10305000af1536568656c6c6fc701190014f1536501d43004100300005f420400801642052d0f091e0815000000db5d"
+	PKT_DATA1_BAD_CS = "5b0101190000f1536501d43004100300005f420400801642052d0f091e0815000000c65d"
+	PKT_ANSWER = "5bfd015d"
+
+	ACK_INIT = "7b00007d"
+	ACK_DATA = "7b00017d" //data packages are confirmed with parcel number 1
+)
+
+type decodeTotal struct {
+	records []app.TelematicsData
+	replies []string
+	answers []byte
+	imei string
+	frames int
+	errors int
+	pending int //not consumed bytes after the last read
+}
+
+//reads are decoded the same way as app.CodecSocket does
+func decodeReads(t *testing.T, reads ...string) decodeTotal {
+	t.Helper()
+	codec := NewCodec()
+	var tot decodeTotal
+	var buf []byte
+	for _, r := range reads {
+		b, err := hex.DecodeString(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, b...)
+		res, err := codec.Decode(buf)
+		if err != nil {
+			tot.errors++
+		}
+		if res.Consumed < 0 || res.Consumed > len(buf) {
+			t.Fatalf("consumed %d of %d bytes", res.Consumed, len(buf))
+		}
+		buf = buf[res.Consumed:]
+		tot.records = append(tot.records, res.Records...)
+		for _, reply := range res.Replies {
+			tot.replies = append(tot.replies, hex.EncodeToString(reply))
+		}
+		tot.answers = append(tot.answers, res.Answers...)
+		if res.IMEI != "" {
+			tot.imei = res.IMEI
+		}
+		tot.frames += res.Frames
+	}
+	tot.pending = len(buf)
+	return tot
+}
+
+func TestArnaviDecode(t *testing.T) {
+	cases := []struct {
+		name string
+		reads []string
+		records int
+		replies []string
+		answers []byte
+		errors int
+		pending int
+	}{
+		{"init", []string{PKT_INIT}, 0, []string{ACK_INIT}, nil, 0, 0},
+		{"init split", []string{PKT_INIT[:6], PKT_INIT[6:]}, 0, []string{ACK_INIT}, nil, 0, 0},
+		{"init and data", []string{PKT_INIT, PKT_DATA1}, 1, []string{ACK_INIT, ACK_DATA}, nil, 0, 0},
+		{"concatenated", []string{PKT_INIT + PKT_DATA1 + PKT_DATA2}, 3, []string{ACK_INIT, ACK_DATA, ACK_DATA}, nil, 0, 0},
+		{"data split in header", []string{PKT_INIT, PKT_DATA1[:4], PKT_DATA1[4:]}, 1, []string{ACK_INIT, ACK_DATA}, nil, 0, 0},
+		{"data split in tags", []string{PKT_INIT, PKT_DATA1[:30], PKT_DATA1[30:]}, 1, []string{ACK_INIT, ACK_DATA}, nil, 0, 0},
+		{"data split before postfix", []string{PKT_INIT, PKT_DATA2[:len(PKT_DATA2)-2], PKT_DATA2[len(PKT_DATA2)-2:]}, 2, []string{ACK_INIT, ACK_DATA}, nil, 0, 0},
+		{"data and next part", []string{PKT_INIT + PKT_DATA1 + PKT_DATA2[:20], PKT_DATA2[20:]}, 3, []string{ACK_INIT, ACK_DATA, ACK_DATA}, nil, 0, 0},
+		{"incomplete", []string{PKT_INIT, PKT_DATA2[:50]}, 0, []string{ACK_INIT}, nil, 0, 25},
+		{"checksum error not confirmed", []string{PKT_INIT, PKT_DATA1_BAD_CS + PKT_DATA2}, 2, []string{ACK_INIT, ACK_DATA}, nil, 1, 0},
+		{"data before init", []string{PKT_DATA1, PKT_INIT}, 0, []string{ACK_INIT}, nil, 0, 0},
+		{"garbage before init", []string{"0102030405" + PKT_INIT}, 0, []string{ACK_INIT}, nil, 1, 0},
+		{"answer", []string{PKT_INIT, PKT_ANSWER}, 0, []string{ACK_INIT}, []byte{1}, 0, 0},
+		{"answer split", []string{PKT_INIT + PKT_ANSWER[:4], PKT_ANSWER[4:] + PKT_DATA1}, 1, []string{ACK_INIT, ACK_DATA}, []byte{1}, 0, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tot := decodeReads(t, tc.reads...)
+			if len(tot.records) != tc.records {
+				t.Errorf("records %d, expected %d", len(tot.records), tc.records)
+			}
+			if !equalStrings(tot.replies, tc.replies) {
+				t.Errorf("replies %v, expected %v", tot.replies, tc.replies)
+			}
+			if !bytes.Equal(tot.answers, tc.answers) {
+				t.Errorf("answers %v, expected %v", tot.answers, tc.answers)
+			}
+			if tot.errors != tc.errors {
+				t.Errorf("errors %d, expected %d", tot.errors, tc.errors)
+			}
+			if tot.pending != tc.pending {
+				t.Errorf("pending %d bytes, expected %d", tot.pending, tc.pending)
+			}
+		})
+	}
+}
+
+func TestArnaviDecodeRecord(t *testing.T) {
+	tot := decodeReads(t, PKT_INIT, PKT_DATA1)
+	if tot.imei != "861230043907626" {
+		t.Fatalf("IMEI %s", tot.imei)
+	}
+	if len(tot.records) != 1 {
+		t.Fatalf("records %d", len(tot.records))
+	}
+	r := tot.records[0]
+	if r.ID != tot.imei || r.GPSTime.Unix() != 1700000000 || !r.GPSValid {
+		t.Errorf("record header %+v", r)
+	}
+	if r.Lat != 55.75 || r.Lon != 37.625 || r.Lat_s != "553345.0" || r.Lon_s != "0372257.50000" {
+		t.Errorf("position %v %v %s %s", r.Lat, r.Lon, r.Lat_s, r.Lon_s)
+	}
+	if r.VoltExt != 12500 || r.VoltInt != 4100 || r.Heading != 90 || r.Height != 150 ||
+	r.SattlliteNum != 9 || r.Speed != 55 || r.SignalLevel != 21 {
+		t.Errorf("attributes %+v", r)
+	}
+}
+
+//latitude and longitude tags
+func coordTags(lat, lon float32) []byte {
+	tags := make([]byte, 2 * PACKET_TAGS_LEN)
+	tags[0] = TAG_VAR_LAT
+	binary.LittleEndian.PutUint32(tags[1:5], math.Float32bits(lat))
+	tags[PACKET_TAGS_LEN] = TAG_VAR_LON
+	binary.LittleEndian.PutUint32(tags[PACKET_TAGS_LEN+1:], math.Float32bits(lon))
+	return tags
+}
+
+//stored string format: degrees, minutes of coordinate, minute decimal part without leading zeros
+func TestArnaviCoordString(t *testing.T) {
+	cases := []struct {
+		lat, lon float32
+		lat_s, lon_s string
+	}{
+		{55.75, 37.625, "553345.0", "0372257.50000"},
+		{0.5, 0.001, "030.0", "00000.6000"},
+		{-55.75, -37.625, "-553345.0", "-0372257.50000"},
+		{0, 0, "000.0", "00000.0"},
+	}
+	for _, tc := range cases {
+		r := NewCodec().(*ArnaviCodec).decodeTags(time.Unix(0, 0), coordTags(tc.lat, tc.lon))
+		if r.Lat_s != tc.lat_s || r.Lon_s != tc.lon_s {
+			t.Errorf("%v %v: %s %s, expected %s %s", tc.lat, tc.lon, r.Lat_s, r.Lon_s, tc.lat_s, tc.lon_s)
+		}
+	}
+}
+
+func TestArnaviInitTime(t *testing.T) {
+	tot := decodeReads(t, PKT_INIT_TIME)
+	if len(tot.replies) != 1 || len(tot.replies[0]) != 18 || tot.replies[0][:6] != "7b0400" {
+		t.Fatalf("replies %v", tot.replies)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func FuzzArnaviDecode(f *testing.F) {
+	for _, seed := range []string{PKT_INIT + PKT_DATA1, PKT_INIT_TIME + PKT_DATA2, PKT_INIT + PKT_DATA1_BAD_CS + PKT_ANSWER, PKT_INIT + PKT_DATA2[:50], "0102" + PKT_INIT} {
+		b, _ := hex.DecodeString(seed)
+		f.Add(b, 7)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		whole := decodeReads(t, hex.EncodeToString(data))
+		if split < 0 || split > len(data) || len(data) >= DATA_PACKAGE_LEN {
+			return
+		}
+		//the same result if data comes in two reads
+		parts := decodeReads(t, hex.EncodeToString(data[:split]), hex.EncodeToString(data[split:]))
+		if len(whole.records) != len(parts.records) || !equalStrings(whole.replies, parts.replies) ||
+		!bytes.Equal(whole.answers, parts.answers) || whole.pending != parts.pending {
+			t.Fatalf("whole %+v, split at %d %+v", whole, split, parts)
+		}
+	})
+}
@@ -5,9 +5,19 @@ import (
 	"fmt"
 	"net"
 	"time"
+	"strconv"
 	"context"
 	"net/textproto"
 	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"crypto/tls"
+	"crypto/x509"
 )
 
 const (
@@ -17,6 +27,9 @@ const (
 	PAR_IMEI = 4
 	
 	PREF_LEN = 3
+	
+	HTTP_TOKEN_SALT = "telsrv-http-admin"
+	CMD_HTTP_TOKEN = "httpToken"
 )
 
 type Command struct {
@@ -29,24 +42,47 @@ type CommandList map[string]Command
 //./client 192.168.1.3:52053 eg419rh4t14mn4s54tgr7g1 clientCount
 //./client 192.168.1.3:52053 eg419rh4t14mn4s54tgr7g1 transmitCoords 888888888888888
 //./client 192.168.1.77:52053 eg419rh4t14mn4s54tgr7g1 status
+//./client -ttl 8 - eg419rh4t14mn4s54tgr7g1 httpToken
+//./client -admin 192.168.1.77:52054 eg419rh4t14mn4s54tgr7g1 status
+//./client -admin -keyName monitoring 192.168.1.77:52054 MONITORING_KEY status
+//./client -admin -tls -ca ca.pem -cert client.pem -key client.key srv.example.com:52054 eg419rh4t14mn4s54tgr7g1 status
 
 func main() {
 
+	admin := flag.Bool("admin", false, "dedicated admin port framing")
+	keyName := flag.String("keyName", "default", "admin key name")
+	useTLS := flag.Bool("tls", false, "TLS connection")
+	caFile := flag.String("ca", "", "server CA certificate file, system pool if empty")
+	certFile := flag.String("cert", "", "client certificate file for mutual TLS")
+	keyFile := flag.String("key", "", "client key file for mutual TLS")
+	tokenTTL := flag.Int("ttl", 24, "HTTP token lifetime, hours")
+	flag.Parse()
+	args := append([]string{os.Args[0]}, flag.Args()...)
+
 	//1) obligatory argument IP:port
-	if len(os.Args)<PAR_HOST+1 {
+	if len(args)<PAR_HOST+1 {
 		panic("IP:port is missing")
 	}
 
 	//2) obligatory argument key
-	if len(os.Args)<PAR_KEY+1 {
+	if len(args)<PAR_KEY+1 {
 		panic("key is missing")
 	}
 	
 	//3) command argument
-	if len(os.Args)<PAR_CMD+1 {
+	if len(args)<PAR_CMD+1 {
 		panic("Command param is missing")
 	}
 
+	//token for HTTP admin API, no connection needed
+	if args[PAR_CMD] == CMD_HTTP_TOKEN {
+		exp := strconv.FormatInt(time.Now().Add(time.Duration(*tokenTTL) * time.Hour).Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(args[PAR_KEY]))
+		mac.Write([]byte(HTTP_TOKEN_SALT + ":" + exp))
+		fmt.Println(exp + "." + hex.EncodeToString(mac.Sum(nil)))
+		return
+	}
+	
 	//all commands
 	commands := make(CommandList)
 	commands["clientCount"] = Command{NeedIMEI: false, Seq: []byte{0x01}}
@@ -56,6 +92,13 @@ func main() {
 	commands["uploadedBytes"] = Command{NeedIMEI: false, Seq: []byte{0x05}}
 	commands["list"] = Command{NeedIMEI: false, Seq: []byte{0x06}}
 	commands["handshakes"] = Command{NeedIMEI: false, Seq: []byte{0x07}}
+	commands["queue"] = Command{NeedIMEI: false, Seq: []byte{0x08}}
+	commands["reload"] = Command{NeedIMEI: false, Seq: []byte{0x09}}
+	commands["registry"] = Command{NeedIMEI: false, Seq: []byte{0x0A}}
+	commands["registryRefresh"] = Command{NeedIMEI: false, Seq: []byte{0x0B}}
+	commands["reconnects"] = Command{NeedIMEI: false, Seq: []byte{0x0C}}
+	commands["logLevels"] = Command{NeedIMEI: false, Seq: []byte{0x0D}}
+	commands["retranslation"] = Command{NeedIMEI: false, Seq: []byte{0x0E}}
 	commands["status"] = Command{NeedIMEI: false, Seq: []byte{0xFF}}
 	
 	//specific, arnavi
@@ -71,12 +114,22 @@ func main() {
 	commands["imeiDownloadedBytes"] = Command{NeedIMEI: true, Seq: []byte{0x84}, Direct:0}
 	commands["imeiUploadedBytes"] = Command{NeedIMEI: true, Seq: []byte{0x85}, Direct:0}
 	commands["imeiHandshakes"] = Command{NeedIMEI: false, Seq: []byte{0x87}}
+	commands["imeiQueue"] = Command{NeedIMEI: true, Seq: []byte{0x88}, Direct:0}
+	commands["imeiReconnects"] = Command{NeedIMEI: true, Seq: []byte{0x8C}, Direct:0}
 	commands["imeiStatus"] = Command{NeedIMEI: true, Seq: []byte{0xFE}, Direct:0}
+	commands["imeiSessions"] = Command{NeedIMEI: true, Seq: []byte{0x8E}, Direct:0}
+	
+	//log level of one device
+	commands["imeiLogDebug"] = Command{NeedIMEI: true, Seq: []byte{0x8D,0x01}, Direct:0}
+	commands["imeiLogInfo"] = Command{NeedIMEI: true, Seq: []byte{0x8D,0x02}, Direct:0}
+	commands["imeiLogWarn"] = Command{NeedIMEI: true, Seq: []byte{0x8D,0x03}, Direct:0}
+	commands["imeiLogError"] = Command{NeedIMEI: true, Seq: []byte{0x8D,0x04}, Direct:0}
+	commands["imeiLogReset"] = Command{NeedIMEI: true, Seq: []byte{0x8D,0x00}, Direct:0}
 	
 	cmd_found := false
 	var cur_cmd *Command
 	for nm, cmd := range commands {
-		if nm == os.Args[PAR_CMD] {
+		if nm == args[PAR_CMD] {
 			cmd_found = true
 			cur_cmd = &cmd
 			break
@@ -87,23 +140,51 @@ func main() {
 	}
 	
 	var imei string
-	if cur_cmd.NeedIMEI && len(os.Args)<PAR_IMEI+1 {
+	if cur_cmd.NeedIMEI && len(args)<PAR_IMEI+1 {
 		panic("Command needs IMEI")
 		
 	}else if cur_cmd.NeedIMEI {
-		imei = os.Args[PAR_IMEI]
+		imei = args[PAR_IMEI]
 	}
 	
-	var d net.Dialer
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
 	
-	conn, err := d.DialContext(ctx, "tcp", os.Args[PAR_HOST])
+	var conn net.Conn
+	var err error
+	if *useTLS {
+		tls_conf := &tls.Config{}
+		if *caFile != "" {
+			ca, err := ioutil.ReadFile(*caFile)
+			if err != nil {
+				panic(err)
+			}
+			tls_conf.RootCAs = x509.NewCertPool()
+			if !tls_conf.RootCAs.AppendCertsFromPEM(ca) {
+				panic("No certificates in "+*caFile)
+			}
+		}
+		if *certFile != "" {
+			cert, err := tls.LoadX509KeyPair(*certFile, *keyFile)
+			if err != nil {
+				panic(err)
+			}
+			tls_conf.Certificates = []tls.Certificate{cert}
+		}
+		d := tls.Dialer{Config: tls_conf}
+		conn, err = d.DialContext(ctx, "tcp", args[PAR_HOST])
+	}else{
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", args[PAR_HOST])
+	}
 	if err != nil {
 		panic(fmt.Sprintf("Failed to dial: %v", err))
 	}
 	defer conn.Close()
 
+	reader := bufio.NewReader(conn)
+	tp := textproto.NewReader(reader)
+
 	buf := make([]byte, 3)
 	if imei != "" {
 		buf[0] = 0xFF
@@ -114,24 +195,57 @@ func main() {
 		buf[1] = 0xFE
 		buf[2] = 0xFE
 	}
-	buf = append(buf, []byte(os.Args[PAR_KEY])...)
+	if *admin {
+		buf = append(buf, byte(len(*keyName)))
+		buf = append(buf, []byte(*keyName)...)
+	}else{
+		buf = append(buf, []byte(args[PAR_KEY])...)
+	}
+	body := make([]byte, 0)
 	if imei != "" {
-		buf = append(buf, byte(len(imei)))
-		buf = append(buf, []byte(imei)...)
+		body = append(body, byte(len(imei)))
+		body = append(body, []byte(imei)...)
+	}
+	body = append(body, byte(len(cur_cmd.Seq)))
+	body = append(body, cur_cmd.Seq...)
+	body = append(body, cur_cmd.Direct)
+	if *admin {
+		//server challenge
+		line, err := tp.ReadLine()
+		if err != nil {
+			panic(err)
+		}
+		var challenge struct {
+			Nonce string `json:"nonce"`
+		}
+		if err := json.Unmarshal([]byte(line), &challenge); err != nil {
+			panic(fmt.Sprintf("Wrong challenge %s: %v", line, err))
+		}
+		nonce, err := hex.DecodeString(challenge.Nonce)
+		if err != nil {
+			panic(err)
+		}
+		mac := hmac.New(sha256.New, []byte(args[PAR_KEY]))
+		mac.Write(nonce)
+		mac.Write(buf)
+		mac.Write(body)
+		buf = append(buf, mac.Sum(nil)...)
+		buf = append(buf, body...)
+		
+		//length prefixed frame
+		frame := make([]byte, 2)
+		binary.BigEndian.PutUint16(frame, uint16(len(buf)))
+		buf = append(frame, buf...)
+	}else{
+		buf = append(buf, body...)
+		buf = append(buf, 0x0A)
 	}
-	buf = append(buf, byte(len(cur_cmd.Seq)))
-	buf = append(buf, cur_cmd.Seq...)
-	buf = append(buf, cur_cmd.Direct)
-	buf = append(buf, 0x0A)
 	
-	fmt.Printf("Sending command %s\n",os.Args[PAR_CMD])	
+	fmt.Printf("Sending command %s\n",args[PAR_CMD])	
 	if _, err := conn.Write(buf); err != nil {
 		panic(err)
 	}
 	
-	reader := bufio.NewReader(conn)
-	tp := textproto.NewReader(reader)
-	
 	line, err := tp.ReadLine()
 	if err != nil {
 		panic(err)
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"math"
+	"time"
+	"encoding/binary"
+
+	"telsrv/arnavi"
+	"telsrv/reportsyst"
+)
+
+//current device state
+type position struct {
+	Lat float64
+	Lon float64
+	Speed int //km/h
+	Heading int
+	Time time.Time
+}
+
+//Packet layouts, the same as decoders expect
+type deviceProtocol interface {
+	handshake(imei uint64) []byte //nil if protocol has no handshake
+	data(imei uint64, pos position, corrupt bool) []byte
+	ackLen() int //fixed length server acknowledgement
+	corruptAcked() bool //server acknowledges corrupt data
+}
+
+var protocols = map[string]func() deviceProtocol{
+	"arnavi": func() deviceProtocol {
+		return &arnaviDevice{}
+	},
+	"reportsyst": func() deviceProtocol {
+		return &reportSysDevice{}
+	},
+}
+
+//Arnavi: init package, tag data packages, confirmation on every decoded package
+type arnaviDevice struct {
+	parcel byte
+}
+
+func (d *arnaviDevice) handshake(imei uint64) []byte {
+	pkg := []byte{arnavi.INIT_PACKAGE_PREF, arnavi.HEADER_PROT1}
+	return binary.LittleEndian.AppendUint64(pkg, imei)
+}
+
+func (d *arnaviDevice) data(imei uint64, pos position, corrupt bool) []byte {
+	d.parcel++
+	if d.parcel > arnavi.DATA_PACKAGE_MAX_PARCEL {
+		d.parcel = 1
+	}
+	var tags []byte
+	tags = append(tags, arnavi.TAG_VAR_VOLT)
+	tags = binary.LittleEndian.AppendUint16(tags, 12500)
+	tags = binary.LittleEndian.AppendUint16(tags, 4100)
+	tags = append(tags, arnavi.TAG_VAR_LAT)
+	tags = binary.LittleEndian.AppendUint32(tags, math.Float32bits(float32(pos.Lat)))
+	tags = append(tags, arnavi.TAG_VAR_LON)
+	tags = binary.LittleEndian.AppendUint32(tags, math.Float32bits(float32(pos.Lon)))
+	tags = append(tags, arnavi.TAG_VAR_ATTRS, byte(pos.Heading / 2), 15, 9, byte(float64(pos.Speed) / 1.852))
+
+	body := binary.LittleEndian.AppendUint32(nil, uint32(pos.Time.Unix()))
+	body = append(body, tags...)
+	check_sum := checkSum(body)
+	if corrupt {
+		check_sum++
+	}
+
+	pkg := []byte{arnavi.DATA_PACKAGE_PREF, d.parcel, arnavi.PACKET_TAGS}
+	pkg = binary.LittleEndian.AppendUint16(pkg, uint16(len(tags)))
+	pkg = append(pkg, body...)
+	return append(pkg, check_sum, arnavi.DATA_PACKAGE_POSTF)
+}
+
+func (d *arnaviDevice) ackLen() int {
+	return 4
+}
+
+func (d *arnaviDevice) corruptAcked() bool {
+	return false
+}
+
+func checkSum(bf []byte) (sm byte) {
+	for _, b := range bf {
+		sm += b
+	}
+	return sm
+}
+
+//Report Systems: fixed length text packets, back report frames are acknowledged
+type reportSysDevice struct {
+}
+
+func (d *reportSysDevice) handshake(imei uint64) []byte {
+	return nil
+}
+
+func (d *reportSysDevice) data(imei uint64, pos position, corrupt bool) []byte {
+	p := make([]byte, reportsyst.DATA_PACKAGE_LEN)
+	for i := range p {
+		p[i] = 0x20
+	}
+	set := func(ind int, v int) {
+		p[ind] = byte(v + 0x20)
+	}
+	p[0], p[1] = 0xAF, 0x84
+	if corrupt {
+		p[1] = 0x00
+	}
+	set(2, reportsyst.BACK_REPORT_CADR)
+
+	tm := pos.Time.UTC()
+	set(4, tm.Hour())
+	set(5, tm.Minute())
+	set(6, tm.Second())
+	set(7, tm.Day())
+	set(8, int(tm.Month()))
+	set(9, tm.Year() - reportsyst.YEAR_START)
+	set(10, reportsyst.COORD_STATUS_NE)
+
+	lat_deg, lat_min, lat_min_dec := degreeParts(pos.Lat)
+	set(11, lat_deg)
+	set(12, lat_min)
+	set(13, lat_min_dec / 100)
+	set(14, lat_min_dec % 100)
+
+	lon_deg, lon_min, lon_min_dec := degreeParts(pos.Lon)
+	set(15, lon_deg / 100)
+	set(16, lon_deg % 100)
+	set(17, lon_min)
+	set(18, lon_min_dec / 100)
+	set(19, lon_min_dec % 100)
+
+	speed := pos.Speed * 10
+	set(20, speed / 100)
+	set(21, speed % 100)
+	set(22, pos.Heading / 100)
+	set(23, pos.Heading % 100)
+
+	for i := 0; i < 5; i++ {
+		set(28 - i, int(imei % 100))
+		imei /= 100
+	}
+	set(47, 12)
+
+	p[reportsyst.DATA_PACKAGE_LEN-2], p[reportsyst.DATA_PACKAGE_LEN-1] = 0x0D, 0x0A
+	return p
+}
+
+func (d *reportSysDevice) ackLen() int {
+	return 5
+}
+
+func (d *reportSysDevice) corruptAcked() bool {
+	return false
+}
+
+//degrees, minutes, 4 digits of minute fraction
+func degreeParts(coord float64) (int, int, int) {
+	coord = math.Abs(coord)
+	deg := int(coord)
+	min := (coord - float64(deg)) * 60
+	return deg, int(min), int((min - math.Floor(min)) * 10000)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"os"
+	"math"
+	"errors"
+	"encoding/xml"
+)
+
+const EARTH_RADIUS_KM = 6371.0
+
+type routePoint struct {
+	Lat float64 `xml:"lat,attr"`
+	Lon float64 `xml:"lon,attr"`
+}
+
+type gpxFile struct {
+	Tracks []struct {
+		Segments []struct {
+			Points []routePoint `xml:"trkpt"`
+		} `xml:"trkseg"`
+	} `xml:"trk"`
+	Routes []struct {
+		Points []routePoint `xml:"rtept"`
+	} `xml:"rte"`
+}
+
+//closed route, devices move from point to point
+type route []routePoint
+
+//all track and route points of GPX file
+func loadGPX(fileName string) (route, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var gpx gpxFile
+	if err := xml.NewDecoder(file).Decode(&gpx); err != nil {
+		return nil, err
+	}
+	var r route
+	for _, trk := range gpx.Tracks {
+		for _, seg := range trk.Segments {
+			r = append(r, seg.Points...)
+		}
+	}
+	for _, rte := range gpx.Routes {
+		r = append(r, rte.Points...)
+	}
+	if len(r) < 2 {
+		return nil, errors.New("GPX: less than 2 points in "+fileName)
+	}
+	return r, nil
+}
+
+//circle around center
+func circleRoute(lat float64, lon float64, radiusKm float64, pointCount int) route {
+	r := make(route, pointCount)
+	d_lat := radiusKm / EARTH_RADIUS_KM * 180 / math.Pi
+	d_lon := d_lat / math.Cos(lat * math.Pi / 180)
+	for i := range r {
+		a := 2 * math.Pi * float64(i) / float64(pointCount)
+		r[i] = routePoint{Lat: lat + d_lat * math.Sin(a), Lon: lon + d_lon * math.Cos(a)}
+	}
+	return r
+}
+
+func (r route) point(i int) routePoint {
+	return r[i % len(r)]
+}
+
+func distanceKm(p1 routePoint, p2 routePoint) float64 {
+	lat1, lat2 := p1.Lat * math.Pi / 180, p2.Lat * math.Pi / 180
+	d_lat := lat2 - lat1
+	d_lon := (p2.Lon - p1.Lon) * math.Pi / 180
+	a := math.Sin(d_lat/2) * math.Sin(d_lat/2) + math.Cos(lat1) * math.Cos(lat2) * math.Sin(d_lon/2) * math.Sin(d_lon/2)
+	return 2 * EARTH_RADIUS_KM * math.Atan2(math.Sqrt(a), math.Sqrt(1-a))
+}
+
+//degrees from north, clockwise
+func bearing(p1 routePoint, p2 routePoint) float64 {
+	lat1, lat2 := p1.Lat * math.Pi / 180, p2.Lat * math.Pi / 180
+	d_lon := (p2.Lon - p1.Lon) * math.Pi / 180
+	y := math.Sin(d_lon) * math.Cos(lat2)
+	x := math.Cos(lat1) * math.Sin(lat2) - math.Sin(lat1) * math.Cos(lat2) * math.Cos(d_lon)
+	return math.Mod(math.Atan2(y, x) * 180 / math.Pi + 360, 360)
+}
@@ -0,0 +1,323 @@
+package main
+
+/**
+ * Virtual devices for load and regression testing.
+ * Devices connect to telsrv, move along a route and send data packets,
+ * acknowledgement latency and loss are reported.
+ * Acknowledgement is not a proof of storage, simulator_test.go checks
+ * acknowledged packets against records written to storage.
+ */
+
+import (
+	"os"
+	"io"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+	"flag"
+	"context"
+	"math/rand"
+)
+
+const (
+	ROUTE_POINT_CNT = 360
+	FRAGMENT_PAUSE_MS = 20
+	REPORT_INTERVAL_SEC = 10
+)
+
+type simConfig struct {
+	addr string
+	protocol string
+	devices int
+	imeiStart uint64
+	interval time.Duration
+	jitter float64
+	rampUp time.Duration
+	duration time.Duration
+	ackTimeout time.Duration
+	fragment float64
+	split int //every packet is written in chunks of split bytes, 0 - off
+	corrupt float64
+	route route
+}
+
+//counters of all devices
+type simStat struct {
+	mx sync.Mutex
+	connected int
+	connErrors int
+	sent int
+	acked int
+	lost int
+	corruptSent int
+	corruptAcked int
+	fragmented int
+	ackedIMEI map[uint64]int
+	latencies []time.Duration
+}
+
+func main() {
+	conf := simConfig{}
+	flag.StringVar(&conf.addr, "addr", "127.0.0.1:55000", "server address host:port")
+	flag.StringVar(&conf.protocol, "protocol", "arnavi", "device protocol (arnavi/reportsyst)")
+	flag.IntVar(&conf.devices, "devices", 10, "number of devices")
+	imei_start := flag.Uint64("imeiStart", 860000000, "IMEI of the first device, others are incremented")
+	flag.DurationVar(&conf.interval, "interval", 10 * time.Second, "data interval of a device")
+	flag.Float64Var(&conf.jitter, "jitter", 0.2, "random interval deviation, fraction of interval")
+	flag.DurationVar(&conf.rampUp, "rampUp", 10 * time.Second, "devices are connected during this period")
+	flag.DurationVar(&conf.duration, "duration", time.Minute, "test duration")
+	flag.DurationVar(&conf.ackTimeout, "ackTimeout", 5 * time.Second, "acknowledgement timeout, packet is lost after it")
+	flag.Float64Var(&conf.fragment, "fragment", 0, "probability of packet split into two TCP writes")
+	flag.IntVar(&conf.split, "split", 0, "every packet is written in chunks of this size, bytes")
+	flag.Float64Var(&conf.corrupt, "corrupt", 0, "probability of corrupt packet")
+	gpx := flag.String("gpx", "", "GPX file with route, circle route if empty")
+	lat := flag.Float64("lat", 55.75, "circle route center latitude")
+	lon := flag.Float64("lon", 37.61, "circle route center longitude")
+	radius := flag.Float64("radiusKm", 5, "circle route radius")
+	flag.Parse()
+
+	conf.imeiStart = *imei_start
+	if _, ok := protocols[conf.protocol]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown protocol %s\n", conf.protocol)
+		os.Exit(2)
+	}
+	if *gpx != "" {
+		r, err := loadGPX(*gpx)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			os.Exit(1)
+		}
+		conf.route = r
+	}else{
+		conf.route = circleRoute(*lat, *lon, *radius, ROUTE_POINT_CNT)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), conf.duration)
+	defer cancel()
+
+	stat := newSimStat()
+	fmt.Printf("%d %s devices -> %s, %d route points, duration %v\n", conf.devices, conf.protocol, conf.addr, len(conf.route), conf.duration)
+
+	var wg sync.WaitGroup
+	for i := 0; i < conf.devices; i++ {
+		wg.Add(1)
+		go func(ind int) {
+			defer wg.Done()
+			runDevice(ctx, conf, ind, stat)
+		}(i)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	ticker := time.NewTicker(time.Duration(REPORT_INTERVAL_SEC) * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			stat.print(false)
+		case <-done:
+			stat.print(true)
+			return
+		}
+	}
+}
+
+func runDevice(ctx context.Context, conf simConfig, ind int, stat *simStat) {
+	imei := conf.imeiStart + uint64(ind)
+	rnd := rand.New(rand.NewSource(time.Now().UnixNano() + int64(ind)))
+	if conf.rampUp > 0 && conf.devices > 1 {
+		if !sleepCtx(ctx, conf.rampUp * time.Duration(ind) / time.Duration(conf.devices)) {
+			return
+		}
+	}
+
+	prot := protocols[conf.protocol]()
+	point_ind := rnd.Intn(len(conf.route))
+	var conn net.Conn
+	for {
+		if conn == nil {
+			var err error
+			conn, err = connect(ctx, conf, prot, imei)
+			if err != nil {
+				stat.add(func(s *simStat) { s.connErrors++ })
+				if !sleepCtx(ctx, conf.interval) {
+					return
+				}
+				continue
+			}
+			stat.add(func(s *simStat) { s.connected++ })
+		}
+
+		p1, p2 := conf.route.point(point_ind), conf.route.point(point_ind + 1)
+		point_ind++
+		pos := position{Lat: p2.Lat, Lon: p2.Lon,
+			Speed: int(distanceKm(p1, p2) / conf.interval.Hours()),
+			Heading: int(bearing(p1, p2)),
+			Time: time.Now(),
+		}
+		corrupt := rnd.Float64() < conf.corrupt
+		if !sendPacket(conn, conf, imei, prot.data(imei, pos, corrupt), prot, corrupt, rnd, stat) {
+			conn.Close()
+			conn = nil
+			stat.add(func(s *simStat) { s.connected-- })
+		}
+
+		wait := conf.interval
+		if conf.jitter > 0 {
+			wait += time.Duration((rnd.Float64() * 2 - 1) * conf.jitter * float64(conf.interval))
+		}
+		if !sleepCtx(ctx, wait) {
+			break
+		}
+	}
+	if conn != nil {
+		conn.Close()
+		stat.add(func(s *simStat) { s.connected-- })
+	}
+}
+
+func connect(ctx context.Context, conf simConfig, prot deviceProtocol, imei uint64) (net.Conn, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", conf.addr)
+	if err != nil {
+		return nil, err
+	}
+	if pkg := prot.handshake(imei); pkg != nil {
+		if _, err := conn.Write(pkg); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if _, err := readAck(conn, prot.ackLen(), conf.ackTimeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+//returns false if connection must be reopened
+func sendPacket(conn net.Conn, conf simConfig, imei uint64, pkg []byte, prot deviceProtocol, corrupt bool, rnd *rand.Rand, stat *simStat) bool {
+	start := time.Now()
+	err := writePacket(conn, conf, pkg, rnd, stat)
+
+	if corrupt {
+		stat.add(func(s *simStat) { s.corruptSent++ })
+		if err != nil {
+			return false
+		}
+		if !prot.corruptAcked() {
+			return true
+		}
+		if _, err := readAck(conn, prot.ackLen(), conf.ackTimeout); err != nil {
+			return false
+		}
+		stat.add(func(s *simStat) { s.corruptAcked++ })
+		return true
+	}
+
+	stat.add(func(s *simStat) { s.sent++ })
+	if err == nil {
+		_, err = readAck(conn, prot.ackLen(), conf.ackTimeout)
+	}
+	if err != nil {
+		stat.add(func(s *simStat) { s.lost++ })
+		return false
+	}
+	latency := time.Since(start)
+	stat.add(func(s *simStat) {
+		s.acked++
+		s.ackedIMEI[imei]++
+		s.latencies = append(s.latencies, latency)
+	})
+	return true
+}
+
+//split mode, random fragmentation or one write
+func writePacket(conn net.Conn, conf simConfig, pkg []byte, rnd *rand.Rand, stat *simStat) error {
+	if conf.split > 0 && len(pkg) > conf.split {
+		stat.add(func(s *simStat) { s.fragmented++ })
+		for len(pkg) > 0 {
+			n := conf.split
+			if n > len(pkg) {
+				n = len(pkg)
+			}
+			if _, err := conn.Write(pkg[:n]); err != nil {
+				return err
+			}
+			pkg = pkg[n:]
+		}
+		return nil
+	}
+	if len(pkg) > 1 && rnd.Float64() < conf.fragment {
+		stat.add(func(s *simStat) { s.fragmented++ })
+		split := 1 + rnd.Intn(len(pkg) - 1)
+		if _, err := conn.Write(pkg[:split]); err != nil {
+			return err
+		}
+		time.Sleep(time.Duration(FRAGMENT_PAUSE_MS) * time.Millisecond)
+		_, err := conn.Write(pkg[split:])
+		return err
+	}
+	_, err := conn.Write(pkg)
+	return err
+}
+
+func readAck(conn net.Conn, ackLen int, timeout time.Duration) ([]byte, error) {
+	buf := make([]byte, ackLen)
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	_, err := io.ReadFull(conn, buf)
+	return buf, err
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+func newSimStat() *simStat {
+	return &simStat{ackedIMEI: make(map[uint64]int)}
+}
+
+func (s *simStat) add(f func(*simStat)) {
+	s.mx.Lock()
+	f(s)
+	s.mx.Unlock()
+}
+
+func (s *simStat) print(final bool) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	fmt.Printf("connected=%d connErrors=%d sent=%d acked=%d lost=%d corrupt=%d/%d acked fragmented=%d\n",
+		s.connected, s.connErrors, s.sent, s.acked, s.lost, s.corruptSent, s.corruptAcked, s.fragmented)
+	if !final {
+		return
+	}
+	if s.sent > 0 {
+		fmt.Printf("loss: %.2f%%\n", float64(s.lost) * 100 / float64(s.sent))
+	}
+	if len(s.latencies) == 0 {
+		return
+	}
+	sort.Slice(s.latencies, func(i, j int) bool { return s.latencies[i] < s.latencies[j] })
+	var total time.Duration
+	for _, l := range s.latencies {
+		total += l
+	}
+	perc := func(p float64) time.Duration {
+		return s.latencies[int(p * float64(len(s.latencies) - 1))]
+	}
+	fmt.Printf("ack latency: min=%v avg=%v p50=%v p95=%v p99=%v max=%v\n",
+		s.latencies[0], total / time.Duration(len(s.latencies)), perc(0.5), perc(0.95), perc(0.99), s.latencies[len(s.latencies)-1])
+}
@@ -0,0 +1,136 @@
+package main
+
+import(
+	"io"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"context"
+	"testing"
+	"log/slog"
+
+	"telsrv/app"
+	"telsrv/arnavi"
+	"telsrv/reportsyst"
+)
+
+//records written by server, by IMEI
+type countStorage struct {
+	mx sync.Mutex
+	records map[string]int
+}
+
+func (s *countStorage) Init(string, *slog.Logger, int) error {
+	return nil
+}
+
+func (s *countStorage) Write(data *app.TelematicsData) {
+	s.mx.Lock()
+	s.records[data.IMEI]++
+	s.mx.Unlock()
+}
+
+func (s *countStorage) GetDescr() string {
+	return "count"
+}
+
+func (s *countStorage) Close(context.Context) (int, error) {
+	return 0, nil
+}
+
+var serverSockets = map[string]app.NewSocketFunc{
+	"arnavi": func() app.ClientSocketer {
+		return app.NewCodecSocket(arnavi.NewCodec())
+	},
+	"reportsyst": func() app.ClientSocketer {
+		return app.NewCodecSocket(reportsyst.NewCodec())
+	},
+}
+
+//server with counting storage, returns address
+func startServer(t *testing.T, protocol string) (string, *countStorage) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	st := &countStorage{records: make(map[string]int)}
+	a := &app.Application{Logger: slog.New(slog.NewTextHandler(io.Discard, nil)), Storage: st}
+	if err := a.StartServer(protocol, protocol, "127.0.0.1", port, 10, serverSockets[protocol], nil); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		a.Shutdown(time.Second, time.Second)
+	})
+	return fmt.Sprintf("127.0.0.1:%d", port), st
+}
+
+//every acknowledged packet is written to storage once
+func TestSimulatorDelivery(t *testing.T) {
+	modes := []struct {
+		name string
+		fragment float64
+		split int
+		corrupt float64
+	}{
+		{"plain", 0, 0, 0},
+		{"fragment", 0.5, 0, 0},
+		{"split", 0, 3, 0},
+		{"split by byte", 0, 1, 0},
+		{"corrupt", 0, 0, 0.3},
+		{"corrupt fragment", 0.5, 0, 0.3},
+	}
+	for _, protocol := range []string{"arnavi", "reportsyst"} {
+		for _, m := range modes {
+			t.Run(protocol+" "+m.name, func(t *testing.T) {
+				addr, st := startServer(t, protocol)
+				conf := simConfig{addr: addr,
+					protocol: protocol,
+					devices: 5,
+					imeiStart: 100,
+					interval: 20 * time.Millisecond,
+					duration: 700 * time.Millisecond,
+					ackTimeout: 2 * time.Second,
+					fragment: m.fragment,
+					split: m.split,
+					corrupt: m.corrupt,
+					route: circleRoute(55.75, 37.61, 5, ROUTE_POINT_CNT),
+				}
+				ctx, cancel := context.WithTimeout(context.Background(), conf.duration)
+				defer cancel()
+				stat := newSimStat()
+				var wg sync.WaitGroup
+				for i := 0; i < conf.devices; i++ {
+					wg.Add(1)
+					go func(ind int) {
+						defer wg.Done()
+						runDevice(ctx, conf, ind, stat)
+					}(i)
+				}
+				wg.Wait()
+
+				if stat.lost > 0 || stat.connErrors > 0 {
+					t.Fatalf("lost %d, connection errors %d", stat.lost, stat.connErrors)
+				}
+				if stat.acked == 0 {
+					t.Fatal("nothing acknowledged")
+				}
+				if m.corrupt > 0 && (stat.corruptSent == 0 || stat.corruptAcked > 0) {
+					t.Errorf("corrupt sent %d, acknowledged %d", stat.corruptSent, stat.corruptAcked)
+				}
+				st.mx.Lock()
+				defer st.mx.Unlock()
+				for i := 0; i < conf.devices; i++ {
+					imei := conf.imeiStart + uint64(i)
+					stored := st.records[fmt.Sprint(imei)]
+					if stored != stat.ackedIMEI[imei] {
+						t.Errorf("IMEI %d: acknowledged %d, stored %d", imei, stat.ackedIMEI[imei], stored)
+					}
+				}
+			})
+		}
+	}
+}
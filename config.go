@@ -1,28 +1,70 @@
 package main
 
 import (
+	"fmt"
 	"encoding/json"
 	"io/ioutil"
 	"bytes"	
+	"log/slog"
 	
-	"github.com/labstack/gommon/log"
+	"telsrv/app"
+)
+
+const (
+	DEF_SHUTDOWN_TIMEOUT_SEC = 30
+	
+	PROT_ARNAVI = "arnavi"
+	PROT_REPORTSYST = "reportsyst"
+	
+	SRV_ID_ARNAVI = "Arnavi"
+	SRV_ID_REPORTSYST = "ReportSystems"
 )
 
 type SrvConfig struct {
+	ID string `json:"id"` //servers list only
+	Protocol string `json:"protocol"` //servers list only
 	Host string `json:"host"`
 	Port int `json:"port"`
 	ConLiveSec int `json:"conLiveSec"`	
+	TLS *app.TLSConfig `json:"tls"`
+}
+
+type RegistryConfig struct {
+	Source string `json:"source"` //file or storage, empty - registry is not used
+	File string `json:"file"`
+	Query string `json:"query"` //storage only, see storage_pg.DEVICES_QUERY
+	Policy string `json:"policy"` //accept, quarantine, reject
+	RefreshSec int `json:"refreshSec"`
 }
 
 type AppConfig struct {
 	ArnaviSrv SrvConfig `json:"arnavi"`
 	ReportSystSrv SrvConfig `json:"reportsyst"`
+	Servers []SrvConfig `json:"servers"`
+	HTTPAdminSrv SrvConfig `json:"httpAdmin"`
+	AdminSrv SrvConfig `json:"admin"`
+	DisableDeviceSysPackage bool `json:"disableDeviceSysPackage"`
+	MetricsAuth bool `json:"metricsAuth"`
+	SessionHistory bool `json:"sessionHistory"` //storage must have session table
+	ReadySpoolMaxBytes int64 `json:"readySpoolMaxBytes"`
+	DuplicateIMEIPolicy string `json:"duplicateIMEIPolicy"`
 	StorageConnection string `json:"storageConnection"`
+	Sinks []app.SinkConfig `json:"sinks"` //additional storages, data is written to all
 	LogLevel string `json:"logLevel"`
+	LogFormat string `json:"logFormat"` //text or json
 	CommandKey string `json:"commandKey"`
+	APIKeys []app.APIKey `json:"apiKeys"`
 	DbProcessCount int `json:"dbProcessCount"`
 	ConnMaxIdleTime int `json:"connMaxIdleTime"`
 	ConnMaxTime int `json:"connMaxTime"`
+	CommandQueueFile string `json:"commandQueueFile"`
+	CommandQueueTTLSec int `json:"commandQueueTTLSec"`
+	CommandQueueMaxAttempts int `json:"commandQueueMaxAttempts"`
+	ShutdownTimeoutSec int `json:"shutdownTimeoutSec"` //connections drain
+	ShutdownStorageTimeoutSec int `json:"shutdownStorageTimeoutSec"` //storage flush after drain
+	DeviceRegistry RegistryConfig `json:"deviceRegistry"`
+	Capture *app.CaptureConfig `json:"capture"` //raw traffic capture, disabled if not set
+	DeviceState *app.DeviceStateConfig `json:"deviceState"` //current device state, disabled if not set
 }
 
 func (c *AppConfig) ReadConf(fileName string) error{
@@ -42,25 +84,70 @@ func (c *AppConfig) WriteConf(fileName string) error{
 	return err
 }
 
-func (c AppConfig) getLogLevel() log.Lvl {
-	var lvl log.Lvl
+//named admin keys, commandKey is the key with default name.
+//Keys must not be empty, device port sys packages are ignored without commandKey.
+func (c AppConfig) getAPIKeys() ([]app.APIKey, error) {
+	keys := make([]app.APIKey, 0, len(c.APIKeys)+1)
+	def_found := false
+	for _, k := range c.APIKeys {
+		if k.Key == "" {
+			return nil, fmt.Errorf("apiKeys: key %s is empty", k.Name)
+		}
+		if k.Name == app.DEF_API_KEY_NAME {
+			def_found = true
+		}
+		keys = append(keys, k)
+	}
+	if !def_found && c.CommandKey != "" {
+		keys = append(keys, app.APIKey{Name: app.DEF_API_KEY_NAME, Key: c.CommandKey, Role: app.ROLE_CONTROL})
+	}
+	return keys, nil
+}
 
-	switch c.LogLevel {
-	case "debug":
-		lvl = log.DEBUG
-		break
-	case "info":
-		lvl = log.INFO
-		break
-	case "warn":
-		lvl = log.WARN
-		break
-	case "error":
-		lvl = log.ERROR
-		break
-	default:
-		lvl = log.INFO
+//device servers: arnavi, reportsyst structures and servers list
+func (c AppConfig) getServers() []SrvConfig {
+	list := make([]SrvConfig, 0, len(c.Servers)+2)
+	if c.ArnaviSrv.Port > 0 {
+		srv := c.ArnaviSrv
+		srv.ID = SRV_ID_ARNAVI
+		srv.Protocol = PROT_ARNAVI
+		list = append(list, srv)
 	}
-	return lvl
+	if c.ReportSystSrv.Port > 0 {
+		srv := c.ReportSystSrv
+		srv.ID = SRV_ID_REPORTSYST
+		srv.Protocol = PROT_REPORTSYST
+		list = append(list, srv)
+	}
+	return append(list, c.Servers...)
+}
 
+func (c AppConfig) getDuplicateIMEIPolicy() string {
+	if c.DuplicateIMEIPolicy == "" {
+		return app.DUP_IMEI_CLOSE_OLD
+	}
+	return c.DuplicateIMEIPolicy
+}
+
+func (c AppConfig) getShutdownTimeoutSec() int {
+	if c.ShutdownTimeoutSec == 0 {
+		return DEF_SHUTDOWN_TIMEOUT_SEC
+	}
+	return c.ShutdownTimeoutSec
+}
+
+func (c AppConfig) getShutdownStorageTimeoutSec() int {
+	if c.ShutdownStorageTimeoutSec == 0 {
+		return DEF_SHUTDOWN_TIMEOUT_SEC
+	}
+	return c.ShutdownStorageTimeoutSec
+}
+
+//info on empty or unknown level
+func (c AppConfig) getLogLevel() slog.Level {
+	lvl, err := app.ParseLogLevel(c.LogLevel)
+	if err != nil {
+		return slog.LevelInfo
+	}
+	return lvl
 }
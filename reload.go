@@ -0,0 +1,262 @@
+package main
+
+import(
+	"sync"
+	"reflect"
+	"fmt"
+	
+	"telsrv/app"
+)
+
+//running configuration is guarded
+var confMx sync.Mutex
+
+//Rereads configuration file, applies changes where possible.
+//config is updated with applied values only.
+func reloadConfig(App *app.Application, iniFile string, config *AppConfig) app.ReloadReport {
+	confMx.Lock()
+	defer confMx.Unlock()
+	
+	report := app.NewReloadReport()
+	new_conf := AppConfig{}
+	if err := new_conf.ReadConf(iniFile); err != nil {
+		report.AddError(fmt.Sprintf("ReadConf: %v", err))
+		logReloadReport(App, report)
+		return report
+	}
+	
+	running := *config
+	
+	if new_conf.LogLevel != running.LogLevel {
+		App.LogLevels.Level.Set(new_conf.getLogLevel())
+		running.LogLevel = new_conf.LogLevel
+		report.AddApplied("logLevel")
+	}
+	
+	if new_conf.CommandKey != running.CommandKey || !reflect.DeepEqual(new_conf.APIKeys, running.APIKeys) {
+		if api_keys, err := new_conf.getAPIKeys(); err != nil {
+			report.AddError(fmt.Sprintf("commandKey/apiKeys: %v", err))
+		}else{
+			App.SetAPIKeys(new_conf.CommandKey, api_keys)
+			running.CommandKey = new_conf.CommandKey
+			running.APIKeys = new_conf.APIKeys
+			report.AddApplied("commandKey/apiKeys")
+		}
+	}
+	
+	if new_conf.DbProcessCount != running.DbProcessCount {
+		if st, ok := App.Storage.(app.ProcessCountSetter); ok {
+			st.SetProcessCount(new_conf.DbProcessCount)
+			running.DbProcessCount = new_conf.DbProcessCount
+			report.AddApplied("dbProcessCount")
+		}else{
+			report.AddRestartRequired("dbProcessCount")
+		}
+	}
+	
+	if new_conf.DuplicateIMEIPolicy != running.DuplicateIMEIPolicy {
+		if err := App.SetDuplicateIMEIPolicy(new_conf.getDuplicateIMEIPolicy()); err != nil {
+			report.AddError(err.Error())
+		}else{
+			running.DuplicateIMEIPolicy = new_conf.DuplicateIMEIPolicy
+			report.AddApplied("duplicateIMEIPolicy")
+		}
+	}
+	
+	if new_conf.ShutdownTimeoutSec != running.ShutdownTimeoutSec {
+		running.ShutdownTimeoutSec = new_conf.ShutdownTimeoutSec
+		report.AddApplied("shutdownTimeoutSec")
+	}
+	if new_conf.ShutdownStorageTimeoutSec != running.ShutdownStorageTimeoutSec {
+		running.ShutdownStorageTimeoutSec = new_conf.ShutdownStorageTimeoutSec
+		report.AddApplied("shutdownStorageTimeoutSec")
+	}
+	
+	//device registry list is reread, policy is applied
+	if App.Devices != nil {
+		if new_conf.DeviceRegistry.Policy != running.DeviceRegistry.Policy {
+			if err := App.Devices.SetPolicy(new_conf.DeviceRegistry.Policy); err != nil {
+				report.AddError(err.Error())
+			}else{
+				running.DeviceRegistry.Policy = new_conf.DeviceRegistry.Policy
+				report.AddApplied("deviceRegistry policy")
+			}
+		}
+		if err := App.Devices.Refresh(); err != nil {
+			report.AddError(fmt.Sprintf("DeviceRegistry Refresh: %v", err))
+		}else{
+			report.AddApplied("deviceRegistry refreshed")
+		}
+	}
+	
+	if !reflect.DeepEqual(new_conf.Capture, running.Capture) {
+		if new_conf.Capture == nil {
+			App.SetCapture(nil)
+			running.Capture = nil
+			report.AddApplied("capture stopped")
+			
+		}else if rec, err := app.NewCaptureRecorder(*new_conf.Capture); err != nil {
+			report.AddError(fmt.Sprintf("NewCaptureRecorder: %v", err))
+			
+		}else{
+			App.SetCapture(rec)
+			running.Capture = new_conf.Capture
+			report.AddApplied("capture")
+		}
+	}
+	
+	//device servers
+	old_srv := make(map[string]SrvConfig)
+	for _, srv := range running.getServers() {
+		old_srv[srv.ID] = srv
+	}
+	new_srv := make(map[string]SrvConfig)
+	for _, srv := range new_conf.getServers() {
+		new_srv[srv.ID] = srv
+	}
+	for id := range old_srv {
+		if _, ok := new_srv[id]; !ok {
+			App.StopServer(id)
+			report.AddApplied("server "+id+" stopped")
+		}
+	}
+	failed := make(map[string]bool) //servers not started with new settings, running settings are kept
+	for id, srv := range new_srv {
+		old, ok := old_srv[id]
+		if ok && old.ConLiveSec != srv.ConLiveSec {
+			if running_srv := App.GetServer(id); running_srv != nil {
+				running_srv.SetConLiveSec(srv.ConLiveSec)
+				report.AddApplied("server "+id+" conLiveSec")
+			}
+		}
+		old.ConLiveSec = srv.ConLiveSec
+		//server not started by previous reload is started again
+		if ok && reflect.DeepEqual(old, srv) && App.GetServer(id) != nil {
+			continue
+		}
+		new_socket, prot_ok := protocols[srv.Protocol]
+		if !prot_ok {
+			report.AddError(fmt.Sprintf("server %s: unknown protocol %s", id, srv.Protocol))
+			failed[id] = true
+			continue
+		}
+		if ok {
+			//address, protocol or TLS changed, port is released before start
+			App.StopServer(id)
+		}
+		if err := App.StartServer(srv.ID, srv.Protocol, srv.Host, srv.Port, srv.ConLiveSec, new_socket, srv.TLS); err != nil {
+			report.AddError(fmt.Sprintf("server %s: %v", id, err))
+			failed[id] = true
+			if ok {
+				restoreServer(App, old, &report)
+			}
+		}else if ok {
+			report.AddApplied("server "+id+" restarted")
+		}else{
+			report.AddApplied("server "+id+" started")
+		}
+	}
+	running.setServers(&new_conf, failed)
+	
+	//not applied while running
+	if new_conf.StorageConnection != running.StorageConnection {
+		report.AddRestartRequired("storageConnection")
+	}
+	if !reflect.DeepEqual(new_conf.Sinks, running.Sinks) {
+		report.AddRestartRequired("sinks")
+	}
+	if new_conf.ConnMaxIdleTime != running.ConnMaxIdleTime || new_conf.ConnMaxTime != running.ConnMaxTime {
+		report.AddRestartRequired("connMaxIdleTime/connMaxTime")
+	}
+	if !reflect.DeepEqual(new_conf.AdminSrv, running.AdminSrv) {
+		report.AddRestartRequired("admin")
+	}
+	if !reflect.DeepEqual(new_conf.HTTPAdminSrv, running.HTTPAdminSrv) {
+		report.AddRestartRequired("httpAdmin")
+	}
+	if new_conf.DisableDeviceSysPackage != running.DisableDeviceSysPackage {
+		report.AddRestartRequired("disableDeviceSysPackage")
+	}
+	if !reflect.DeepEqual(new_conf.DeviceState, running.DeviceState) {
+		App.SetDeviceStateConfig(new_conf.DeviceState)
+		running.DeviceState = new_conf.DeviceState
+		report.AddApplied("deviceState")
+	}
+	if new_conf.ReadySpoolMaxBytes != running.ReadySpoolMaxBytes {
+		App.SetReadySpoolMaxBytes(new_conf.ReadySpoolMaxBytes)
+		running.ReadySpoolMaxBytes = new_conf.ReadySpoolMaxBytes
+		report.AddApplied("readySpoolMaxBytes")
+	}
+	if new_conf.LogFormat != running.LogFormat {
+		report.AddRestartRequired("logFormat")
+	}
+	if new_conf.MetricsAuth != running.MetricsAuth {
+		report.AddRestartRequired("metricsAuth")
+	}
+	if new_conf.SessionHistory != running.SessionHistory {
+		report.AddRestartRequired("sessionHistory")
+	}
+	if new_conf.CommandQueueFile != running.CommandQueueFile || new_conf.CommandQueueTTLSec != running.CommandQueueTTLSec ||
+	new_conf.CommandQueueMaxAttempts != running.CommandQueueMaxAttempts {
+		report.AddRestartRequired("commandQueueFile/commandQueueTTLSec/commandQueueMaxAttempts")
+	}
+	
+	reg_conf := running.DeviceRegistry
+	reg_conf.Policy = new_conf.DeviceRegistry.Policy
+	if !reflect.DeepEqual(new_conf.DeviceRegistry, reg_conf) && (App.Devices != nil || new_conf.DeviceRegistry.Source != "") {
+		report.AddRestartRequired("deviceRegistry")
+	}
+	
+	*config = running
+	logReloadReport(App, report)
+	return report
+}
+
+func logReloadReport(App *app.Application, report app.ReloadReport) {
+	for _, s := range report.Applied {
+		App.Logger.Info("Reload: applied", "setting", s)
+	}
+	for _, s := range report.RestartRequired {
+		App.Logger.Warn("Reload: changed, restart required", "setting", s)
+	}
+	for _, s := range report.Errors {
+		App.Logger.Error("Reload failed", app.LOG_KEY_ERR, s)
+	}
+}
+
+//starts server with previous settings after failed restart
+func restoreServer(App *app.Application, srv SrvConfig, report *app.ReloadReport) {
+	new_socket, ok := protocols[srv.Protocol]
+	if !ok {
+		return
+	}
+	if err := App.StartServer(srv.ID, srv.Protocol, srv.Host, srv.Port, srv.ConLiveSec, new_socket, srv.TLS); err != nil {
+		report.AddError(fmt.Sprintf("server %s: previous settings: %v", srv.ID, err))
+	}else{
+		report.AddApplied("server "+srv.ID+" kept previous settings")
+	}
+}
+
+//Device servers of running configuration: new settings,
+//running settings of failed servers, so that the next reload retries them
+func (c *AppConfig) setServers(newConf *AppConfig, failed map[string]bool) {
+	if !failed[SRV_ID_ARNAVI] {
+		c.ArnaviSrv = newConf.ArnaviSrv
+	}
+	if !failed[SRV_ID_REPORTSYST] {
+		c.ReportSystSrv = newConf.ReportSystSrv
+	}
+	servers := make([]SrvConfig, 0, len(newConf.Servers))
+	for _, srv := range newConf.Servers {
+		if !failed[srv.ID] {
+			servers = append(servers, srv)
+			continue
+		}
+		for _, old := range c.Servers {
+			if old.ID == srv.ID {
+				servers = append(servers, old)
+			}
+		}
+	}
+	c.Servers = servers
+}
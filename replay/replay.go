@@ -0,0 +1,196 @@
+package main
+
+/**
+ * Replays capture file, see app.CaptureRecorder.
+ * Decoder mode: frames from devices are fed into protocol codec, results are printed.
+ * Live mode: frames from devices are sent to server, answers are printed.
+ */
+
+import (
+	"os"
+	"fmt"
+	"net"
+	"time"
+	"sync"
+	"flag"
+	"encoding/hex"
+
+	"telsrv/app"
+	"telsrv/arnavi"
+	"telsrv/reportsyst"
+)
+
+const ANSWER_WAIT_SEC = 2 //live mode, waiting for answers after last frame
+
+var codecs = map[string]app.NewCodecFunc{
+	"arnavi": arnavi.NewCodec,
+	"reportsyst": reportsyst.NewCodec,
+}
+
+//frames of one captured connection
+type connFrames struct {
+	key string
+	frames []app.CaptureFrame
+}
+
+func main() {
+	protocol := flag.String("protocol", "", "decoder mode: protocol codec (arnavi/reportsyst)")
+	addr := flag.String("addr", "", "live mode: server address host:port")
+	imei := flag.String("imei", "", "replay only connections of IMEI")
+	serverID := flag.String("server", "", "replay only connections of server ID")
+	speed := flag.Float64("speed", 0, "live mode: timing factor, 1 - captured timing, 0 - no pauses")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s -protocol arnavi|-addr host:port [flags] capture_file\n", os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() != 1 || (*protocol == "") == (*addr == "") {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	file, err := os.Open(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	frames, err := app.ReadCapture(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+	conns := groupConnections(frames, *serverID, *imei)
+	fmt.Printf("%d frames, %d connections\n", len(frames), len(conns))
+
+	if *protocol != "" {
+		new_codec, ok := codecs[*protocol]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown protocol %s\n", *protocol)
+			os.Exit(1)
+		}
+		for _, c := range conns {
+			decodeConnection(c, new_codec())
+		}
+		return
+	}
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func(c connFrames) {
+			defer wg.Done()
+			if err := sendConnection(c, *addr, *speed); err != nil {
+				fmt.Printf("[%s] %v\n", c.key, err)
+			}
+		}(c)
+	}
+	wg.Wait()
+}
+
+//frames by connection in capture order, connection is selected if any frame matches filter
+func groupConnections(frames []app.CaptureFrame, serverID string, imei string) []connFrames {
+	var list []connFrames
+	ind := make(map[string]int)
+	matched := make(map[string]bool)
+	for _, fr := range frames {
+		key := fr.ServerID + "/" + fr.Remote
+		i, ok := ind[key]
+		if !ok {
+			i = len(list)
+			ind[key] = i
+			list = append(list, connFrames{key: key})
+		}
+		list[i].frames = append(list[i].frames, fr)
+		if (serverID == "" || fr.ServerID == serverID) && (imei == "" || fr.IMEI == imei) {
+			matched[key] = true
+		}
+	}
+	res := make([]connFrames, 0, len(list))
+	for _, c := range list {
+		if matched[c.key] {
+			res = append(res, c)
+		}
+	}
+	return res
+}
+
+//feeds device frames into codec the same way as app.CodecSocket does
+func decodeConnection(c connFrames, codec app.Codec) {
+	fmt.Printf("=== %s\n", c.key)
+	var buf []byte
+	for _, fr := range c.frames {
+		if fr.Dir != app.CAPTURE_DIR_IN {
+			fmt.Printf("%s captured out: %s\n", fr.Time.Format(time.RFC3339Nano), hex.EncodeToString(fr.Data))
+			continue
+		}
+		fmt.Printf("%s in %d bytes: %s\n", fr.Time.Format(time.RFC3339Nano), len(fr.Data), hex.EncodeToString(fr.Data))
+		buf = append(buf, fr.Data...)
+		res, err := codec.Decode(buf)
+		if err != nil {
+			fmt.Printf("  decode error: %v\n", err)
+		}
+		if res.IMEI != "" {
+			fmt.Printf("  IMEI=%s handshake=%v\n", res.IMEI, res.Handshake)
+		}
+		for _, rec := range res.Records {
+			fmt.Printf("  record: %+v\n", rec)
+		}
+		for _, reply := range res.Replies {
+			fmt.Printf("  reply: %s\n", hex.EncodeToString(reply))
+		}
+		for _, code := range res.Answers {
+			fmt.Printf("  command answer: %d\n", code)
+		}
+		if res.Consumed >= len(buf) {
+			buf = nil
+		}else if res.Consumed > 0 {
+			buf = buf[res.Consumed:]
+		}
+		if len(buf) > 0 {
+			fmt.Printf("  %d bytes kept\n", len(buf))
+		}
+	}
+}
+
+func sendConnection(c connFrames, addr string, speed float64) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		buf := make([]byte, app.CODEC_READ_BUFFER_LEN)
+		for {
+			n, err := conn.Read(buf)
+			if n > 0 {
+				fmt.Printf("[%s] answer: %s\n", c.key, hex.EncodeToString(buf[:n]))
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	var prev time.Time
+	for _, fr := range c.frames {
+		if fr.Dir != app.CAPTURE_DIR_IN {
+			continue
+		}
+		if speed > 0 && !prev.IsZero() {
+			time.Sleep(time.Duration(float64(fr.Time.Sub(prev)) * speed))
+		}
+		prev = fr.Time
+		if _, err := conn.Write(fr.Data); err != nil {
+			return err
+		}
+		fmt.Printf("[%s] sent %d bytes\n", c.key, len(fr.Data))
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Duration(ANSWER_WAIT_SEC) * time.Second))
+	<-done
+	return nil
+}
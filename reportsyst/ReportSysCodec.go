@@ -0,0 +1,158 @@
+package reportsyst
+
+import(
+	"bytes"
+	"time"
+	"math"
+	"fmt"
+	"strconv"
+	
+	"telsrv/app"
+)
+
+const(
+	DATA_PACKAGE_LEN = 59
+	YEAR_START = 2000
+	
+	BACK_REPORT_CADR = 6
+	
+	COORD_STATUS_NE	= 5
+	COORD_STATUS_SE = 6
+	COORD_STATUS_NW	= 7
+	COORD_STATUS_SW	= 8
+
+	DIR_N = "n"
+	DIR_S = "s"
+	DIR_E = "e"
+	DIR_W = "w"
+	
+	VALID_LAT_LEN = 9
+	VALID_LON_LEN = 10
+		
+)
+
+//Report Systems protocol codec, every packet carries IMEI
+type ReportSysCodec struct {
+}
+
+func NewCodec() app.Codec {
+	return &ReportSysCodec{}
+}
+
+//commands are sent as is
+func (c *ReportSysCodec) EncodeCommand(payload []byte) []byte {
+	return payload
+}
+
+//Fixed length packets, incomplete packet is kept for next read,
+//bytes before packet start are skipped
+func (c *ReportSysCodec) Decode(buf []byte) (app.DecodeResult, error) {
+	var res app.DecodeResult
+	var err error
+	
+	for res.Consumed < len(buf) {
+		p := buf[res.Consumed:]
+		if p[0] != 0xAF || (len(p) > 1 && p[1] != 0x84) {
+			skip := bytes.Index(p[1:], []byte{0xAF, 0x84})
+			if skip < 0 {
+				//packet start can be the last byte
+				skip = len(p) - 1
+				if p[skip] != 0xAF {
+					skip++
+				}
+			}else{
+				skip++
+			}
+			err = app.NewDecodeError(app.DECODE_ERR_STRUCTURE, "wrong package start, %d bytes skipped", skip)
+			res.Consumed += skip
+			continue
+		}
+		if len(p) < DATA_PACKAGE_LEN {
+			break
+		}
+		p = p[:DATA_PACKAGE_LEN]
+		if p[DATA_PACKAGE_LEN-2] != 0x0D || p[DATA_PACKAGE_LEN-1] != 0x0A {
+			err = app.NewDecodeError(app.DECODE_ERR_STRUCTURE, "wrong package structrure, [DATA_PACKAGE_LEN-2]=%d, [DATA_PACKAGE_LEN-1]=%d",
+				p[DATA_PACKAGE_LEN-2], p[DATA_PACKAGE_LEN-1])
+			//next packet can start inside
+			res.Consumed++
+			continue
+		}
+		res.Consumed += DATA_PACKAGE_LEN
+		res.Frames++
+		res.Records = append(res.Records, decodePacket(p))
+		
+		if (p[2] - 0x20) == BACK_REPORT_CADR {
+			res.Replies = append(res.Replies, []byte{0x54, 0x53, 0x41, 0x0D, 0x0A})
+		}			
+	}
+	return res, err
+}
+
+func decodePacket(p []byte) app.TelematicsData {
+	imei := strconv.FormatUint(uint64(p[24] - 0x20) * 100000000 + uint64(p[25] - 0x20) * 1000000 + uint64(p[26] - 0x20) * 10000 + uint64(p[27] - 0x20) * 100 + uint64(p[28] - 0x20), 10)
+	
+	tracker_time := time.Date(int(p[9] - 0x20) + YEAR_START, time.Month(p[8] - 0x20), int(p[7] - 0x20), int(p[4] - 0x20), int(p[5] - 0x20), int(p[6] - 0x20), 0, time.UTC)
+	//!!! временно !!!
+	tracker_time = tracker_time.Add(time.Hour * time.Duration(1))
+	
+	/*ns := ""
+	ew := ""
+	switch p[10] - 0x20 {
+	case COORD_STATUS_NE:
+		ns = DIR_N
+		ew = DIR_E
+	case COORD_STATUS_SE:
+		ns = DIR_S
+		ew = DIR_E
+	case COORD_STATUS_NW:
+		ns = DIR_N
+		ew = DIR_W
+	case COORD_STATUS_SW:
+		ns = DIR_S
+		ew = DIR_W
+	default :	
+		ns = DIR_S
+		ew = DIR_W
+	}
+	*/
+	
+	lat_deg := int(p[11] - 0x20)
+	lat_min := int(p[12] - 0x20)
+	lat_min_dec := int(p[13] - 0x20) * 100 + int(p[14] - 0x20)
+	lat_s := fmt.Sprintf("%d%02d.%d", lat_deg, lat_min, lat_min_dec)				
+	
+	lon_deg := int(p[15] - 0x20) * 100 + int(p[16] - 0x20)
+	lon_min := int(p[17] - 0x20)
+	lon_min_dec := int(p[18] - 0x20) * 100 + int(p[19] - 0x20)
+	lon_s := fmt.Sprintf("%03d%02d.%d", lon_deg, lon_min, lon_min_dec)				
+
+	tel_data := app.TelematicsData{ID: imei,
+			GPSTime: tracker_time,
+			GPSValid: false,
+			ReceivedTime: time.Now(),
+			Lon_s: lon_s,
+			Lon: convertDegreeToFloat(lon_deg, lon_min, lon_min_dec),
+			Lat_s: lat_s,
+			Lat: convertDegreeToFloat(lat_deg, lat_min, lat_min_dec),
+			
+			Speed: (int(p[20] - 0x20) * 100 + int(p[21] - 0x20) ) / 10,
+			Heading: int(p[22] - 0x20) * 100 + int(p[23] - 0x20),
+			SattlliteNum: 0,
+			Height: 0,
+			VoltExt: int16(p[47] - 0x20) + int16(p[48] - 0x20) /100,
+			VoltInt: 0,
+			SignalLevel: 0,
+			Odom: uint32(p[49] - 0x20) * 1000000 + uint32(p[50] - 0x20) * 10000 + uint32(p[51] - 0x20) * 100 + uint32(p[52] - 0x20),
+			FromMemory: (p[3] - 0x20) > 0,						
+	}
+	if len(lat_s) == VALID_LAT_LEN && len(lon_s) == VALID_LON_LEN && tel_data.Lon > 0 && tel_data.Lat > 0 {
+		tel_data.GPSValid = true
+	}	
+	return tel_data
+}
+
+func convertDegreeToFloat(degree int, min int, minDec int) float32 {	
+	pw := math.Pow(10, float64(len(strconv.Itoa(minDec))))
+	return float32(degree) + (float32(min) + float32(float64(minDec)/pw) )/60.0
+}
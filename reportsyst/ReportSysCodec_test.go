@@ -0,0 +1,142 @@
+package reportsyst
+
+import(
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"telsrv/app"
+)
+
+//Synthetic frames built by the protocol description for device 123456789,
+//not captured from a device
+const (
+	//back report frame, 2023-11-15 10:20:30, 5545.1234 N 03737.5000 E, 60.5 km/h, heading 270
+	PKT_BACK_REPORT = "af8426202a343e2f2b3725574d2c4220454552202625226621374d63792020202020202020202020202020202020202c202021374d202020200d0a"
+	//current frame, not acknowledged
+	PKT_CURRENT = "af8421202a34482f2b3725574d2c4820454553202620226b21374d63792020202020202020202020202020202020202c202021374d202020200d0a"
+
+	ACK_BACK_REPORT = "5453410d0a"
+)
+
+type decodeTotal struct {
+	records []app.TelematicsData
+	replies []string
+	frames int
+	errors int
+	pending int //not consumed bytes after the last read
+}
+
+//reads are decoded the same way as app.CodecSocket does
+func decodeReads(t *testing.T, reads ...string) decodeTotal {
+	t.Helper()
+	codec := NewCodec()
+	var tot decodeTotal
+	var buf []byte
+	for _, r := range reads {
+		b, err := hex.DecodeString(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf = append(buf, b...)
+		res, err := codec.Decode(buf)
+		if err != nil {
+			tot.errors++
+		}
+		if res.Consumed < 0 || res.Consumed > len(buf) {
+			t.Fatalf("consumed %d of %d bytes", res.Consumed, len(buf))
+		}
+		buf = buf[res.Consumed:]
+		tot.records = append(tot.records, res.Records...)
+		for _, reply := range res.Replies {
+			tot.replies = append(tot.replies, hex.EncodeToString(reply))
+		}
+		tot.frames += res.Frames
+	}
+	tot.pending = len(buf)
+	return tot
+}
+
+func TestReportSysDecode(t *testing.T) {
+	cases := []struct {
+		name string
+		reads []string
+		records int
+		replies int
+		errors int
+		pending int
+	}{
+		{"back report", []string{PKT_BACK_REPORT}, 1, 1, 0, 0},
+		{"current", []string{PKT_CURRENT}, 1, 0, 0, 0},
+		{"concatenated", []string{PKT_BACK_REPORT + PKT_CURRENT + PKT_BACK_REPORT}, 3, 2, 0, 0},
+		{"split in packet", []string{PKT_BACK_REPORT[:40], PKT_BACK_REPORT[40:]}, 1, 1, 0, 0},
+		{"split after start", []string{PKT_BACK_REPORT[:2], PKT_BACK_REPORT[2:]}, 1, 1, 0, 0},
+		{"split across packets", []string{PKT_CURRENT + PKT_BACK_REPORT[:60], PKT_BACK_REPORT[60:] + PKT_CURRENT[:10], PKT_CURRENT[10:]}, 3, 1, 0, 0},
+		{"incomplete", []string{PKT_CURRENT[:100]}, 0, 0, 0, 50},
+		{"garbage before packet", []string{"0d0a3132" + PKT_CURRENT}, 1, 0, 1, 0},
+		{"garbage only", []string{"010203"}, 0, 0, 1, 0},
+		{"broken packet resync", []string{PKT_CURRENT[:80] + PKT_BACK_REPORT}, 1, 1, 1, 0},
+		{"wrong end", []string{PKT_CURRENT[:len(PKT_CURRENT)-4] + "0000" + PKT_BACK_REPORT}, 1, 1, 1, 0},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			tot := decodeReads(t, tc.reads...)
+			if len(tot.records) != tc.records {
+				t.Errorf("records %d, expected %d", len(tot.records), tc.records)
+			}
+			if len(tot.replies) != tc.replies {
+				t.Errorf("replies %v, expected %d", tot.replies, tc.replies)
+			}
+			for _, r := range tot.replies {
+				if r != ACK_BACK_REPORT {
+					t.Errorf("reply %s", r)
+				}
+			}
+			if tot.errors != tc.errors {
+				t.Errorf("errors %d, expected %d", tot.errors, tc.errors)
+			}
+			if tot.pending != tc.pending {
+				t.Errorf("pending %d bytes, expected %d", tot.pending, tc.pending)
+			}
+		})
+	}
+}
+
+func TestReportSysDecodeRecord(t *testing.T) {
+	tot := decodeReads(t, PKT_BACK_REPORT)
+	if len(tot.records) != 1 {
+		t.Fatalf("records %d", len(tot.records))
+	}
+	r := tot.records[0]
+	if r.ID != "123456789" {
+		t.Errorf("IMEI %s", r.ID)
+	}
+	//decoder adds one hour to tracker time
+	if !r.GPSTime.Equal(time.Date(2023, 11, 15, 11, 20, 30, 0, time.UTC)) {
+		t.Errorf("time %v", r.GPSTime)
+	}
+	if r.Lat_s != "5545.1234" || r.Lon_s != "03737.5000" || r.Lon != 37.625 || !r.GPSValid {
+		t.Errorf("position %s %s %v %v", r.Lat_s, r.Lon_s, r.Lat, r.Lon)
+	}
+	if r.Speed != 60 || r.Heading != 270 || r.VoltExt != 12 || r.Odom != 12345 || r.FromMemory {
+		t.Errorf("attributes %+v", r)
+	}
+}
+
+func FuzzReportSysDecode(f *testing.F) {
+	for _, seed := range []string{PKT_BACK_REPORT, PKT_CURRENT + PKT_BACK_REPORT, PKT_CURRENT[:80] + PKT_BACK_REPORT, "0d0a" + PKT_CURRENT[:100]} {
+		b, _ := hex.DecodeString(seed)
+		f.Add(b, 30)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, split int) {
+		whole := decodeReads(t, hex.EncodeToString(data))
+		if split < 0 || split > len(data) {
+			return
+		}
+		//the same result if data comes in two reads
+		parts := decodeReads(t, hex.EncodeToString(data[:split]), hex.EncodeToString(data[split:]))
+		if len(whole.records) != len(parts.records) || len(whole.replies) != len(parts.replies) || whole.pending != parts.pending {
+			t.Fatalf("whole %+v, split at %d %+v", whole, split, parts)
+		}
+	})
+}
@@ -0,0 +1,97 @@
+package main
+
+import(
+	"os"
+	"fmt"
+	"path/filepath"
+	"encoding/json"
+
+	"telsrv/app"
+	"telsrv/storage_pg"
+	"telsrv/storage_clickhouse"
+	"telsrv/storage_file"
+	"telsrv/storage_nats"
+	"telsrv/storage_retranslator"
+)
+
+const (
+	SINK_TYPE_POSTGRES = "postgres"
+	SINK_TYPE_CLICKHOUSE = "clickhouse"
+	SINK_TYPE_FILE = "file"
+	SINK_TYPE_NATS = "nats"
+	SINK_TYPE_RETRANSLATOR = "retranslator"
+	SINK_PRIMARY_NAME = "postgres" //storageConnection database when sinks are set
+)
+
+//supported sink types
+var sinkTypes = map[string]func(AppConfig, app.SinkConfig) (app.Storager, error){
+	SINK_TYPE_POSTGRES: func(conf AppConfig, sink app.SinkConfig) (app.Storager, error){
+		st := &storage_pg.StoragePG{ConnMaxIdleTime: conf.ConnMaxIdleTime, ConnMaxTime: conf.ConnMaxTime}
+		if sink.Name != "" && sink.Name != SINK_PRIMARY_NAME {
+			//query spool of its own
+			st.SpoolFile = filepath.Dir(os.Args[0]) + "/queries_" + sink.Name + ".sql"
+		}
+		return st, nil
+	},
+	SINK_TYPE_CLICKHOUSE: func(conf AppConfig, sink app.SinkConfig) (app.Storager, error){
+		st := &storage_clickhouse.StorageClickHouse{Retry: sink.Retry,
+			SpoolFile: filepath.Dir(os.Args[0]) + "/clickhouse_" + sink.Name + ".jsonl",
+		}
+		return st, sinkOptions(sink, &st.Conf)
+	},
+	SINK_TYPE_FILE: func(conf AppConfig, sink app.SinkConfig) (app.Storager, error){
+		st := &storage_file.StorageFile{}
+		return st, sinkOptions(sink, &st.Conf)
+	},
+	SINK_TYPE_NATS: func(conf AppConfig, sink app.SinkConfig) (app.Storager, error){
+		st := &storage_nats.StorageNATS{}
+		return st, sinkOptions(sink, &st.Conf)
+	},
+	SINK_TYPE_RETRANSLATOR: func(conf AppConfig, sink app.SinkConfig) (app.Storager, error){
+		st := &storage_retranslator.StorageRetranslator{}
+		return st, sinkOptions(sink, &st.Conf)
+	},
+}
+
+//type parameters of sink
+func sinkOptions(sink app.SinkConfig, v interface{}) error {
+	if len(sink.Options) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(sink.Options, v); err != nil {
+		return fmt.Errorf("sink %s options: %v", sink.Name, err)
+	}
+	return nil
+}
+
+//StoragePG of storageConnection, MultiStorage if sinks are set. Storage is not initialized.
+func newStorage(conf AppConfig) (app.Storager, error) {
+	if len(conf.Sinks) == 0 {
+		return sinkTypes[SINK_TYPE_POSTGRES](conf, app.SinkConfig{})
+	}
+	st := &app.MultiStorage{}
+	if conf.StorageConnection != "" {
+		primary := app.SinkConfig{Name: SINK_PRIMARY_NAME, Type: SINK_TYPE_POSTGRES, Connection: conf.StorageConnection}
+		primary_st, err := sinkTypes[SINK_TYPE_POSTGRES](conf, primary)
+		if err != nil {
+			return nil, err
+		}
+		if err := st.AddSink(primary, primary_st); err != nil {
+			return nil, err
+		}
+	}
+	for _, sink_conf := range conf.Sinks {
+		new_sink, ok := sinkTypes[sink_conf.Type]
+		if !ok {
+			return nil, fmt.Errorf("sink %s: unknown type %s", sink_conf.Name, sink_conf.Type)
+		}
+		sink_st, err := new_sink(conf, sink_conf)
+		if err != nil {
+			return nil, err
+		}
+		if err := st.AddSink(sink_conf, sink_st); err != nil {
+			return nil, err
+		}
+	}
+	return st, nil
+}
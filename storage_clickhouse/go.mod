@@ -0,0 +1,3 @@
+module telsrv/storage_clickhouse
+
+go 1.21
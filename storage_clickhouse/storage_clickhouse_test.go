@@ -0,0 +1,181 @@
+package storage_clickhouse
+
+import(
+	"io"
+	"os"
+	"sync"
+	"time"
+	"sync/atomic"
+	"bytes"
+	"context"
+	"testing"
+	"net/http"
+	"path/filepath"
+	"net/http/httptest"
+
+	"telsrv/app"
+	"telsrv/app/apptest"
+)
+
+//ClickHouse HTTP interface: SELECT 1 and inserts, rows by request
+type testServer struct {
+	mx sync.Mutex
+	fail int //inserts to fail
+	block []byte //inserts containing block wait for release
+	release chan struct{}
+	batches []int
+	rows map[string]int //by car_id
+	user string
+	query string
+}
+
+func (ts *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet {
+		io.WriteString(w, "1\n")
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if ts.block != nil && bytes.Contains(body, ts.block) {
+		<-ts.release
+	}
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	ts.user = r.Header.Get("X-ClickHouse-User")
+	ts.query = r.URL.Query().Get("query")
+	if ts.fail > 0 {
+		ts.fail--
+		http.Error(w, "Code: 210. DB::Exception: test", http.StatusInternalServerError)
+		return
+	}
+	lines := bytes.Split(body, []byte("\n"))
+	ts.batches = append(ts.batches, len(lines))
+	for _, line := range lines {
+		for _, id := range []string{"old", "new", "1"} {
+			if bytes.Contains(line, []byte(`"car_id":"`+id+`"`)) {
+				ts.rows[id]++
+			}
+		}
+	}
+}
+
+func (ts *testServer) count(id string) int {
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	return ts.rows[id]
+}
+
+func startTestServer(t *testing.T, fail int) (*testServer, string) {
+	ts := &testServer{fail: fail, rows: make(map[string]int), release: make(chan struct{})}
+	srv := httptest.NewServer(ts)
+	t.Cleanup(srv.Close)
+	return ts, "http://user:pwd@" + srv.Listener.Addr().String() + "/?database=test"
+}
+
+func newTestStorage(t *testing.T, connStr string, spool string, batchSize int) *StorageClickHouse {
+	st := &StorageClickHouse{Conf: Config{BatchSize: batchSize, FlushMs: 60000},
+		Retry: app.SinkRetryConfig{Attempts: 3, BackoffMs: 1},
+		SpoolFile: spool,
+	}
+	if err := st.Init(connStr, apptest.Logger(), 1); err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func writeRecords(t *testing.T, st *StorageClickHouse, id string, cnt int) {
+	for i := 0; i < cnt; i++ {
+		if err := st.WriteRecord(context.Background(), &app.TelematicsData{ID: id, GPSTime: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+//full batches are inserted at once, the rest on Close
+func TestBatching(t *testing.T) {
+	ts, conn := startTestServer(t, 0)
+	st := newTestStorage(t, conn, filepath.Join(t.TempDir(), "ch.jsonl"), 3)
+	writeRecords(t, st, "1", 7)
+	apptest.WaitFor(t, "two batches", func() bool { return ts.count("1") == 6 })
+	if cnt, err := st.Close(context.Background()); err != nil || cnt != 0 {
+		t.Fatalf("spooled %d %v", cnt, err)
+	}
+	ts.mx.Lock()
+	defer ts.mx.Unlock()
+	if len(ts.batches) != 3 || ts.batches[0] != 3 || ts.batches[1] != 3 || ts.batches[2] != 1 {
+		t.Fatalf("batches %v", ts.batches)
+	}
+	if ts.user != "user" || ts.query != "INSERT INTO car_tracking (car_id, from_memory, gps_valid, heading, lat, lon, odometer, period, recieved_dt, sat_num, speed, voltage) FORMAT JSONEachRow" {
+		t.Fatalf("user %q, query %q", ts.user, ts.query)
+	}
+}
+
+//failed inserts are retried
+func TestRetry(t *testing.T) {
+	ts, conn := startTestServer(t, 2)
+	spool := filepath.Join(t.TempDir(), "ch.jsonl")
+	st := newTestStorage(t, conn, spool, 2)
+	writeRecords(t, st, "1", 2)
+	apptest.WaitFor(t, "retried batch", func() bool { return ts.count("1") == 2 })
+	if cnt, err := st.Close(context.Background()); err != nil || cnt != 0 {
+		t.Fatalf("spooled %d %v", cnt, err)
+	}
+	if m := st.GetStorageMetrics()[0]; m.WriteErrors != 2 {
+		t.Fatalf("write errors %d", m.WriteErrors)
+	}
+}
+
+//batch failed after retries is spooled, replay does not block new batches
+func TestSpoolReplay(t *testing.T) {
+	ts, conn := startTestServer(t, 3)
+	spool := filepath.Join(t.TempDir(), "ch.jsonl")
+	st := newTestStorage(t, conn, spool, 2)
+	writeRecords(t, st, "old", 2)
+	apptest.WaitFor(t, "spooled batch", func() bool {
+		_, err := os.Stat(spool)
+		return err == nil
+	})
+	if cnt, err := st.Close(context.Background()); err != nil || cnt != 2 {
+		t.Fatalf("spooled %d %v", cnt, err)
+	}
+
+	ts.block = []byte(`"car_id":"old"`)
+	st = newTestStorage(t, conn, spool, 2)
+	writeRecords(t, st, "new", 2)
+	apptest.WaitFor(t, "new batch while replay is blocked", func() bool { return ts.count("new") == 2 })
+	close(ts.release)
+	apptest.WaitFor(t, "replayed batch", func() bool { return ts.count("old") == 2 })
+	if cnt, err := st.Close(context.Background()); err != nil || cnt != 0 {
+		t.Fatalf("spooled after replay %d %v", cnt, err)
+	}
+}
+
+//rows written concurrently with Close are inserted or spooled, later writes fail
+func TestWriteOnClose(t *testing.T) {
+	ts, conn := startTestServer(t, 0)
+	st := newTestStorage(t, conn, filepath.Join(t.TempDir(), "ch.jsonl"), 1000)
+	var accepted int64
+	var writers sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func() {
+			defer writers.Done()
+			for i := 0; i < 1000; i++ {
+				if st.WriteRecord(context.Background(), &app.TelematicsData{ID: "1", GPSTime: time.Now()}) == nil {
+					atomic.AddInt64(&accepted, 1)
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond)
+	cnt, err := st.Close(context.Background())
+	writers.Wait()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inserted := ts.count("1"); int64(inserted + cnt) != atomic.LoadInt64(&accepted) {
+		t.Fatalf("accepted %d, inserted %d, spooled %d", accepted, inserted, cnt)
+	}
+	if err := st.WriteRecord(context.Background(), &app.TelematicsData{ID: "1"}); err == nil {
+		t.Fatal("write after close accepted")
+	}
+}
@@ -0,0 +1,3 @@
+module telsrv/storage_file
+
+go 1.21
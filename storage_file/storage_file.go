@@ -0,0 +1,363 @@
+package storage_file
+
+/**
+ * Append-only file storage for standalone deployments without database.
+ * Records are appended to daily files (UTC day of GPS time) in the directory
+ * given as connection: tracks_2006-01-02.jsonl, one json row per line with
+ * car_tracking columns. As in car_tracking, (car_id, period) is unique:
+ * the first written row is returned by GetTrack, duplicates are skipped.
+ * Files older than RetentionDays are removed.
+ */
+
+import(
+	"os"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+	"bytes"
+	"bufio"
+	"errors"
+	"context"
+	"strings"
+	"sync/atomic"
+	"path/filepath"
+	"encoding/json"
+	"log/slog"
+
+	"telsrv/app"
+)
+
+const (
+	STORAGE_DESCR = "File storage"
+
+	FILE_PREFIX = "tracks_"
+	FILE_EXT = ".jsonl"
+	DAY_LAYOUT = "2006-01-02"
+
+	DEF_FLUSH_MS = 1000
+	FILE_IDLE_CLOSE_SEC = 60 //file not written is closed
+	RETENTION_CHECK_MIN = 60
+	MAX_LINE_LEN = 64 * 1024
+)
+
+//Sink options
+type Config struct {
+	RetentionDays int `json:"retentionDays"` //0 - files are kept
+	FlushMs int `json:"flushMs"` //buffered rows are written to file after
+}
+
+//car_tracking columns
+type row struct {
+	CarID string `json:"car_id"`
+	Period time.Time `json:"period"`
+	RecievedDt time.Time `json:"recieved_dt"`
+	Lon float32 `json:"lon"`
+	Lat float32 `json:"lat"`
+	Speed int `json:"speed"`
+	Heading int `json:"heading"`
+	SatNum byte `json:"sat_num"`
+	Odometer uint32 `json:"odometer"`
+	Voltage int16 `json:"voltage"`
+	GPSValid bool `json:"gps_valid"`
+	FromMemory bool `json:"from_memory"`
+}
+
+type dayFile struct {
+	file *os.File
+	w *bufio.Writer
+	lastWrite time.Time
+}
+
+type StorageFile struct {
+	Conf Config
+	Dir string
+	Logger *slog.Logger
+	mx sync.Mutex
+	files map[string]*dayFile //by day
+	closed bool
+	done chan struct{}
+	stopped chan struct{}
+	writeErrors uint64 //atomic
+	writeLatency *app.Histogram
+}
+
+func (s *StorageFile) GetDescr() string {
+	return STORAGE_DESCR
+}
+
+//connStr is the directory, processCount is not used
+func (s *StorageFile) Init(connStr string, logger *slog.Logger, processCount int) error {
+	if connStr == "" {
+		return errors.New("directory is not set")
+	}
+	s.Dir = connStr
+	s.Logger = logger
+	if s.Conf.FlushMs <= 0 {
+		s.Conf.FlushMs = DEF_FLUSH_MS
+	}
+	if err := os.MkdirAll(s.Dir, 0755); err != nil {
+		return err
+	}
+	s.files = make(map[string]*dayFile)
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	s.writeLatency = app.NewHistogram(app.DB_WRITE_BUCKETS)
+	s.removeOld()
+	go s.run()
+	s.Logger.Info("StorageFile: initialized", "dir", s.Dir, "retention_days", s.Conf.RetentionDays)
+	return nil
+}
+
+func (s *StorageFile) Write(data *app.TelematicsData) {
+	if err := s.WriteRecord(context.Background(), data); err != nil {
+		s.Logger.Error("StorageFile: write failed", app.LOG_KEY_ERR, err)
+	}
+}
+
+//Appends record to the file of GPS day, see app.RecordWriter
+func (s *StorageFile) WriteRecord(ctx context.Context, data *app.TelematicsData) error {
+	start := time.Now()
+	defer s.writeLatency.ObserveDuration(start)
+
+	period := data.GPSTime
+	if period.IsZero() {
+		period = data.ReceivedTime
+	}
+	line, err := json.Marshal(row{CarID: data.ID,
+		Period: period.UTC(),
+		RecievedDt: data.ReceivedTime.UTC(),
+		Lon: data.Lon,
+		Lat: data.Lat,
+		Speed: data.Speed,
+		Heading: data.Heading,
+		SatNum: data.SattlliteNum,
+		Odometer: data.Odom,
+		Voltage: data.VoltExt,
+		GPSValid: data.GPSValid,
+		FromMemory: data.FromMemory,
+	})
+	if err != nil {
+		return err
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.closed {
+		return errors.New("storage is closed")
+	}
+	f, err := s.dayFile(period.UTC().Format(DAY_LAYOUT))
+	if err == nil {
+		_, err = f.w.Write(append(line, '\n'))
+		f.lastWrite = start
+	}
+	if err != nil {
+		atomic.AddUint64(&s.writeErrors, 1)
+	}
+	return err
+}
+
+//opened file, s.mx must be locked
+func (s *StorageFile) dayFile(day string) (*dayFile, error) {
+	if f, ok := s.files[day]; ok {
+		return f, nil
+	}
+	file, err := os.OpenFile(s.fileName(day), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	f := &dayFile{file: file, w: bufio.NewWriter(file)}
+	s.files[day] = f
+	return f, nil
+}
+
+func (s *StorageFile) fileName(day string) string {
+	return filepath.Join(s.Dir, FILE_PREFIX + day + FILE_EXT)
+}
+
+//flushes buffers, closes idle files, removes old files
+func (s *StorageFile) run() {
+	defer close(s.stopped)
+	flush := time.NewTicker(time.Duration(s.Conf.FlushMs) * time.Millisecond)
+	defer flush.Stop()
+	retention := time.NewTicker(time.Duration(RETENTION_CHECK_MIN) * time.Minute)
+	defer retention.Stop()
+	for {
+		select {
+		case <-flush.C:
+			s.mx.Lock()
+			s.flushLocked(time.Duration(FILE_IDLE_CLOSE_SEC) * time.Second)
+			s.mx.Unlock()
+		case <-retention.C:
+			s.removeOld()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//files idle for closeIdle are closed, 0 - all files, s.mx must be locked
+func (s *StorageFile) flushLocked(closeIdle time.Duration) {
+	for day, f := range s.files {
+		if err := f.w.Flush(); err != nil {
+			atomic.AddUint64(&s.writeErrors, 1)
+			s.Logger.Error("StorageFile: flush failed", "day", day, app.LOG_KEY_ERR, err)
+		}
+		if closeIdle == 0 || time.Since(f.lastWrite) >= closeIdle {
+			f.file.Close()
+			delete(s.files, day)
+		}
+	}
+}
+
+//files of days before retention period
+func (s *StorageFile) removeOld() {
+	if s.Conf.RetentionDays <= 0 {
+		return
+	}
+	list, err := filepath.Glob(filepath.Join(s.Dir, FILE_PREFIX + "*" + FILE_EXT))
+	if err != nil {
+		s.Logger.Error("StorageFile: filepath.Glob failed", app.LOG_KEY_ERR, err)
+		return
+	}
+	min_day := s.minDay()
+	for _, f_name := range list {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(f_name), FILE_PREFIX), FILE_EXT)
+		if _, err := time.Parse(DAY_LAYOUT, day); err != nil || day >= min_day {
+			continue
+		}
+		s.mx.Lock()
+		if f, ok := s.files[day]; ok {
+			f.w.Flush()
+			f.file.Close()
+			delete(s.files, day)
+		}
+		err := os.Remove(f_name)
+		s.mx.Unlock()
+		if err != nil {
+			s.Logger.Error("StorageFile: os.Remove failed", "file", f_name, app.LOG_KEY_ERR, err)
+		}else{
+			s.Logger.Info("StorageFile: file removed by retention", "file", f_name)
+		}
+	}
+}
+
+//the first day kept by retention, empty if files are kept
+func (s *StorageFile) minDay() string {
+	if s.Conf.RetentionDays <= 0 {
+		return ""
+	}
+	return time.Now().UTC().AddDate(0, 0, -s.Conf.RetentionDays).Format(DAY_LAYOUT)
+}
+
+//Track of device ID, see app.TrackReader.
+//Files are read by days till limit points are found.
+func (s *StorageFile) GetTrack(ctx context.Context, id string, from, to time.Time, limit int) ([]app.TrackPoint, error) {
+	from, to = from.UTC(), to.UTC()
+	if min_day := s.minDay(); min_day != "" && from.Format(DAY_LAYOUT) < min_day {
+		return nil, fmt.Errorf("%w: files are kept from %s", app.ErrTrackRetention, min_day)
+	}
+	//buffered rows must be in files
+	s.mx.Lock()
+	for _, f := range s.files {
+		f.w.Flush()
+	}
+	s.mx.Unlock()
+
+	//quick filter before unmarshal
+	id_b, err := json.Marshal(id)
+	if err != nil {
+		return nil, err
+	}
+	id_field := append([]byte(`"car_id":`), id_b...)
+
+	track := make([]app.TrackPoint, 0)
+	periods := make(map[time.Time]bool)
+	first_day, _ := time.Parse(DAY_LAYOUT, from.Format(DAY_LAYOUT))
+	for day := first_day; !day.After(to) && len(track) < limit; day = day.AddDate(0, 0, 1) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		day_start := len(track)
+		file, err := os.Open(s.fileName(day.Format(DAY_LAYOUT)))
+		if os.IsNotExist(err) {
+			continue
+		}else if err != nil {
+			return nil, err
+		}
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 4 * 1024), MAX_LINE_LEN)
+		for scanner.Scan() {
+			line := scanner.Bytes()
+			if !bytes.Contains(line, id_field) {
+				continue
+			}
+			var r row
+			if err := json.Unmarshal(line, &r); err != nil {
+				//incomplete line of interrupted write
+				continue
+			}
+			if r.CarID != id || r.Period.Before(from) || r.Period.After(to) || periods[r.Period] {
+				continue
+			}
+			periods[r.Period] = true
+			track = append(track, app.TrackPoint{ID: r.CarID,
+				GPSTime: r.Period,
+				ReceivedTime: r.RecievedDt,
+				Lon: r.Lon,
+				Lat: r.Lat,
+				Speed: r.Speed,
+				Heading: r.Heading,
+				SatNum: r.SatNum,
+				Odometer: r.Odometer,
+				Voltage: r.Voltage,
+				GPSValid: r.GPSValid,
+				FromMemory: r.FromMemory,
+			})
+		}
+		err = scanner.Err()
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file.Name(), err)
+		}
+		//day files are in GPS time order, rows of day are not
+		sort.SliceStable(track[day_start:], func(i, j int) bool {
+			return track[day_start+i].GPSTime.Before(track[day_start+j].GPSTime)
+		})
+	}
+	if len(track) > limit {
+		track = track[:limit]
+	}
+	return track, nil
+}
+
+//Directory exists, see app.StorageChecker
+func (s *StorageFile) CheckStorage(ctx context.Context) error {
+	fi, err := os.Stat(s.Dir)
+	if err != nil {
+		return err
+	}
+	if !fi.IsDir() {
+		return errors.New(s.Dir + " is not a directory")
+	}
+	return nil
+}
+
+//Write errors and latency, see app.StorageMetricser
+func (s *StorageFile) GetStorageMetrics() []app.StorageMetrics {
+	return []app.StorageMetrics{{Storage: STORAGE_DESCR,
+		WriteErrors: atomic.LoadUint64(&s.writeErrors),
+		WriteLatency: s.writeLatency,
+	}}
+}
+
+//Flushes and closes files, nothing is spooled
+func (s *StorageFile) Close(ctx context.Context) (int, error) {
+	close(s.done)
+	<-s.stopped
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.closed = true
+	s.flushLocked(0)
+	return 0, nil
+}
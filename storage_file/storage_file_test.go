@@ -0,0 +1,187 @@
+package storage_file
+
+import(
+	"io"
+	"os"
+	"time"
+	"bytes"
+	"errors"
+	"context"
+	"testing"
+	"log/slog"
+
+	"telsrv/app"
+)
+
+func newTestStorage(t *testing.T, retentionDays int) *StorageFile {
+	s := &StorageFile{Conf: Config{RetentionDays: retentionDays, FlushMs: 60000}}
+	if err := s.Init(t.TempDir(), slog.New(slog.NewTextHandler(io.Discard, nil)), 1); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func writeRecord(t *testing.T, s *StorageFile, id string, gpsTime time.Time, lat float32) {
+	t.Helper()
+	if err := s.WriteRecord(context.Background(), &app.TelematicsData{ID: id, GPSTime: gpsTime, ReceivedTime: gpsTime, Lat: lat}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+//rows in day file
+func fileRows(t *testing.T, s *StorageFile, day time.Time) int {
+	t.Helper()
+	cont, err := os.ReadFile(s.fileName(day.Format(DAY_LAYOUT)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bytes.Count(cont, []byte("\n"))
+}
+
+func TestGetTrackLimit(t *testing.T) {
+	s := newTestStorage(t, 2)
+	defer s.Close(context.Background())
+
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	//rows of day are not ordered
+	times := []time.Time{today.Add(time.Minute), yesterday.Add(2 * time.Minute), yesterday.Add(time.Minute), today, yesterday.Add(time.Minute)}
+	for _, tm := range times {
+		if err := s.WriteRecord(context.Background(), &app.TelematicsData{ID: "1", GPSTime: tm, ReceivedTime: tm}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	track, err := s.GetTrack(context.Background(), "1", yesterday, today.Add(time.Hour), 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []time.Time{yesterday.Add(time.Minute), yesterday.Add(2 * time.Minute), today}
+	if len(track) != len(expected) {
+		t.Fatalf("track %+v", track)
+	}
+	for i, tm := range expected {
+		if !track[i].GPSTime.Equal(tm) {
+			t.Errorf("point %d: %v, expected %v", i, track[i].GPSTime, tm)
+		}
+	}
+
+	if _, err := s.GetTrack(context.Background(), "1", today.AddDate(0, 0, -5), today, 10); !errors.Is(err, app.ErrTrackRetention) {
+		t.Fatalf("track before retention: %v", err)
+	}
+}
+
+//records are written to file of GPS day
+func TestDailyFiles(t *testing.T) {
+	s := newTestStorage(t, 0)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	yesterday := today.AddDate(0, 0, -1)
+	writeRecord(t, s, "1", yesterday.Add(23 * time.Hour), 1)
+	writeRecord(t, s, "1", today, 2)
+	writeRecord(t, s, "1", today.Add(time.Hour), 3)
+	if _, err := s.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if y, d := fileRows(t, s, yesterday), fileRows(t, s, today); y != 1 || d != 2 {
+		t.Fatalf("rows of yesterday %d, today %d", y, d)
+	}
+}
+
+//idle file is flushed and closed, next write opens it again
+func TestIdleClose(t *testing.T) {
+	s := newTestStorage(t, 0)
+	defer s.Close(context.Background())
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	writeRecord(t, s, "1", today, 1)
+
+	s.mx.Lock()
+	s.flushLocked(time.Duration(FILE_IDLE_CLOSE_SEC) * time.Second)
+	open_cnt := len(s.files)
+	s.files[today.Format(DAY_LAYOUT)].lastWrite = time.Now().Add(-time.Duration(FILE_IDLE_CLOSE_SEC) * time.Second)
+	s.flushLocked(time.Duration(FILE_IDLE_CLOSE_SEC) * time.Second)
+	idle_cnt := len(s.files)
+	s.mx.Unlock()
+	if open_cnt != 1 || idle_cnt != 0 {
+		t.Fatalf("open files %d, after idle time %d", open_cnt, idle_cnt)
+	}
+	if rows := fileRows(t, s, today); rows != 1 {
+		t.Fatalf("rows of closed file %d", rows)
+	}
+
+	writeRecord(t, s, "1", today.Add(time.Minute), 2)
+	track, err := s.GetTrack(context.Background(), "1", today, today.Add(time.Hour), 10)
+	if err != nil || len(track) != 2 {
+		t.Fatalf("track after reopen %+v %v", track, err)
+	}
+}
+
+//the first row of (car_id, period) is returned, other devices are skipped
+func TestReadDuplicates(t *testing.T) {
+	s := newTestStorage(t, 0)
+	defer s.Close(context.Background())
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	writeRecord(t, s, "1", today, 1)
+	writeRecord(t, s, "2", today, 2)
+	writeRecord(t, s, "1", today, 3)
+	writeRecord(t, s, "1", today.Add(time.Minute), 4)
+
+	track, err := s.GetTrack(context.Background(), "1", today, today.Add(time.Hour), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(track) != 2 || track[0].Lat != 1 || track[1].Lat != 4 {
+		t.Fatalf("track %+v", track)
+	}
+}
+
+//files of days before retention period are removed, open file is closed
+func TestRemoveOld(t *testing.T) {
+	s := newTestStorage(t, 2)
+	defer s.Close(context.Background())
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	kept := []time.Time{today, today.AddDate(0, 0, -2)}
+	removed := []time.Time{today.AddDate(0, 0, -3), today.AddDate(0, 0, -30)}
+	for _, day := range append(kept, removed...) {
+		writeRecord(t, s, "1", day, 1)
+	}
+	other := s.fileName("other")
+	if err := os.WriteFile(other, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	s.removeOld()
+	for _, day := range kept {
+		if _, err := os.Stat(s.fileName(day.Format(DAY_LAYOUT))); err != nil {
+			t.Errorf("file of %v: %v", day, err)
+		}
+	}
+	for _, day := range removed {
+		if _, err := os.Stat(s.fileName(day.Format(DAY_LAYOUT))); !os.IsNotExist(err) {
+			t.Errorf("file of %v is not removed: %v", day, err)
+		}
+		s.mx.Lock()
+		_, open := s.files[day.Format(DAY_LAYOUT)]
+		s.mx.Unlock()
+		if open {
+			t.Errorf("file of %v is open", day)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Errorf("file without day: %v", err)
+	}
+}
+
+//written rows are flushed on Close, later writes fail
+func TestWriteAfterClose(t *testing.T) {
+	s := newTestStorage(t, 0)
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	writeRecord(t, s, "1", today, 1)
+	if cnt, err := s.Close(context.Background()); err != nil || cnt != 0 {
+		t.Fatalf("close %d %v", cnt, err)
+	}
+	if err := s.WriteRecord(context.Background(), &app.TelematicsData{ID: "1", GPSTime: today}); err == nil {
+		t.Fatal("write after close accepted")
+	}
+	if rows := fileRows(t, s, today); rows != 1 {
+		t.Fatalf("rows %d", rows)
+	}
+}
@@ -0,0 +1,200 @@
+package storage_nats
+
+import(
+	"net"
+	"time"
+	"context"
+	"strconv"
+	"testing"
+	"path/filepath"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nats-server/v2/server"
+
+	"telsrv/app"
+	"telsrv/app/apptest"
+)
+
+//Embedded server with JetStream, port -1 for random port
+func startTestServer(t *testing.T, port int, storeDir string) *server.Server {
+	ns, err := server.NewServer(&server.Options{Host: "127.0.0.1",
+		Port: port,
+		JetStream: true,
+		StoreDir: storeDir,
+		NoLog: true,
+		NoSigs: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go ns.Start()
+	if !ns.ReadyForConnections(5 * time.Second) {
+		t.Fatal("server is not ready")
+	}
+	t.Cleanup(ns.Shutdown)
+	return ns
+}
+
+/**
+ * Streams: TELSRV for subjects telsrv.>, FULL for full.> accepts one message.
+ * Subjects of other protocols have no stream.
+ */
+func addStreams(t *testing.T, url string) jetstream.JetStream {
+	conn, err := nats.Connect(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(conn.Close)
+	js, err := jetstream.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, conf := range []jetstream.StreamConfig{{Name: "TELSRV", Subjects: []string{"telsrv.>"}},
+		{Name: "FULL", Subjects: []string{"full.>"}, MaxMsgs: 1, Discard: jetstream.DiscardNew},
+	} {
+		if _, err := js.CreateStream(context.Background(), conf); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return js
+}
+
+func streamMsgs(t *testing.T, js jetstream.JetStream) uint64 {
+	stream, err := js.Stream(context.Background(), "TELSRV")
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := stream.Info(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return info.State.Msgs
+}
+
+func newTestStorage(t *testing.T, url string, jetStream bool) *StorageNATS {
+	s := &StorageNATS{Conf: Config{Subject: "{protocol}.{imei}", JetStream: jetStream, AckTimeoutMs: 500}}
+	if err := s.Init(url, apptest.Logger(), 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close(context.Background())
+	})
+	return s
+}
+
+func testRecord(protocol, imei string) *app.TelematicsData {
+	now := time.Now()
+	return &app.TelematicsData{Protocol: protocol, IMEI: imei, GPSTime: now, ReceivedTime: now}
+}
+
+//every record gets acknowledgement or error of its stream
+func TestWriteRecords(t *testing.T) {
+	ns := startTestServer(t, -1, t.TempDir())
+	js := addStreams(t, ns.ClientURL())
+	s := newTestStorage(t, ns.ClientURL(), true)
+
+	errs := s.WriteRecords(context.Background(), []*app.TelematicsData{testRecord("telsrv", "1"),
+		testRecord("telsrv", "2"),
+		testRecord("full", "1"),
+		testRecord("full", "2"),
+		testRecord("nostream", "1"),
+		testRecord("telsrv", "3"),
+	})
+	for i, failed := range []bool{false, false, false, true, true, false} {
+		if (errs[i] != nil) != failed {
+			t.Errorf("record %d: %v", i, errs[i])
+		}
+	}
+	if msgs := streamMsgs(t, js); msgs != 3 {
+		t.Fatalf("stream messages %d", msgs)
+	}
+}
+
+//records of the same GPS time are kept, repeated record is dropped by stream
+func TestMsgID(t *testing.T) {
+	ns := startTestServer(t, -1, t.TempDir())
+	js := addStreams(t, ns.ClientURL())
+	s := newTestStorage(t, ns.ClientURL(), true)
+
+	first := &app.TelematicsData{Protocol: "telsrv", IMEI: "1", ReceivedTime: time.Now()}
+	second := &app.TelematicsData{Protocol: "telsrv", IMEI: "1", ReceivedTime: first.ReceivedTime.Add(time.Millisecond)}
+	for _, r := range []*app.TelematicsData{first, second, first} {
+		if err := s.WriteRecord(context.Background(), r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if msgs := streamMsgs(t, js); msgs != 2 {
+		t.Fatalf("stream messages %d", msgs)
+	}
+}
+
+//without JetStream records are published to subscribers
+func TestPublish(t *testing.T) {
+	ns := startTestServer(t, -1, t.TempDir())
+	conn, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sub, err := conn.SubscribeSync("telsrv.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Flush()
+
+	s := newTestStorage(t, ns.ClientURL(), false)
+	for i, err := range s.WriteRecords(context.Background(), []*app.TelematicsData{testRecord("telsrv", "1"), testRecord("telsrv", "2")}) {
+		if err != nil {
+			t.Fatalf("record %d: %v", i, err)
+		}
+	}
+	for _, subject := range []string{"telsrv.1", "telsrv.2"} {
+		msg, err := sub.NextMsg(time.Second)
+		if err != nil || msg.Subject != subject || msg.Header.Get(nats.MsgIdHdr) == "" {
+			t.Fatalf("message %v %v", msg, err)
+		}
+	}
+}
+
+//publish fails while server is down, client reconnects to restarted server
+func TestReconnect(t *testing.T) {
+	store := t.TempDir()
+	ns := startTestServer(t, -1, store)
+	addStreams(t, ns.ClientURL())
+	port := ns.Addr().(*net.TCPAddr).Port
+	s := newTestStorage(t, ns.ClientURL(), true)
+	if err := s.WriteRecord(context.Background(), testRecord("telsrv", "1")); err != nil {
+		t.Fatal(err)
+	}
+
+	ns.Shutdown()
+	if err := s.WriteRecord(context.Background(), testRecord("telsrv", "2")); err == nil {
+		t.Fatal("published without server")
+	}
+	startTestServer(t, port, store)
+	apptest.WaitFor(t, "publish after restart", func() bool {
+		return s.WriteRecord(context.Background(), testRecord("telsrv", "3")) == nil
+	})
+}
+
+//MultiStorage passes queued records by batches
+func TestSinkBatches(t *testing.T) {
+	const RECORD_CNT = 1000
+	ns := startTestServer(t, -1, t.TempDir())
+	js := addStreams(t, ns.ClientURL())
+	m := &app.MultiStorage{}
+	if err := m.AddSink(app.SinkConfig{Name: "stream", Connection: ns.ClientURL(), BatchSize: 100, SpoolFile: filepath.Join(t.TempDir(), "sink.jsonl")}, &StorageNATS{Conf: Config{Subject: "telsrv.{imei}", JetStream: true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Init("", apptest.Logger(), 1); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < RECORD_CNT; i++ {
+		m.Write(testRecord("telsrv", strconv.Itoa(i)))
+	}
+	apptest.WaitFor(t, "published records", func() bool { return streamMsgs(t, js) == RECORD_CNT })
+	if cnt, err := m.Close(context.Background()); err != nil || cnt != 0 {
+		t.Fatalf("spooled %d %v", cnt, err)
+	}
+}
@@ -0,0 +1,100 @@
+package storage_pg
+
+/**
+ * Current device state, see app.DeviceStateWriter.
+ * Queries are executed by several processes and from spool, older state
+ * (state_time) and older position (gps_time) do not overwrite newer ones.
+ *
+ * CREATE TABLE device_state (
+ *	imei text PRIMARY KEY,
+ *	device_id text,
+ *	online bool NOT NULL,
+ *	server_id text,
+ *	protocol text,
+ *	remote_addr text,
+ *	state_time timestamp NOT NULL,
+ *	last_packet_time timestamp,
+ *	voltage int,
+ *	gps_time timestamp,
+ *	lon double precision,
+ *	lat double precision,
+ *	speed int,
+ *	heading int,
+ *	sat_num int
+ * );
+ */
+
+import(
+	"context"
+	"fmt"
+
+	"telsrv/app"
+)
+
+//newer position condition
+const STATE_POS_NEWER = `EXCLUDED.gps_time IS NOT NULL AND (st.gps_time IS NULL OR EXCLUDED.gps_time >= st.gps_time)`
+
+func (s *StoragePG) WriteDeviceState(state *app.DeviceState) {
+	s.writeQuery(getDeviceStateQuery(state))
+}
+
+//Executes state query, see app.DeviceStateRecordWriter
+func (s *StoragePG) WriteDeviceStateRecord(ctx context.Context, state *app.DeviceState) error {
+	return s.execQuery(ctx, getDeviceStateQuery(state))
+}
+
+func getDeviceStateQuery(state *app.DeviceState) string {
+	last_packet, voltage := "NULL", "NULL"
+	if rec := state.LastRecord; rec != nil {
+		last_packet = fmt.Sprintf(`'%s' At time zone 'utc'`, rec.ReceivedTime.Format(TIME_LAYOUT))
+		voltage = fmt.Sprintf("%d", rec.VoltExt)
+	}
+	gps_time, lon, lat, speed, heading, sat_num := "NULL", "NULL", "NULL", "NULL", "NULL", "NULL"
+	if pos := state.LastPosition; pos != nil {
+		gps_time = fmt.Sprintf(`'%s' At time zone 'utc'`, pos.GPSTime.Format(TIME_LAYOUT))
+		lon = fmt.Sprintf("%f", pos.Lon)
+		lat = fmt.Sprintf("%f", pos.Lat)
+		speed = fmt.Sprintf("%d", pos.Speed)
+		heading = fmt.Sprintf("%d", pos.Heading)
+		sat_num = fmt.Sprintf("%d", pos.SattlliteNum)
+	}
+	return fmt.Sprintf(`INSERT INTO device_state AS st
+		(imei, device_id, online, server_id, protocol, remote_addr,
+		state_time, last_packet_time, voltage,
+		gps_time, lon, lat, speed, heading, sat_num)
+		VALUES(%s, %s, %t, %s, %s, %s,
+		'%s' At time zone 'utc', %s, %s,
+		%s, %s, %s, %s, %s, %s)
+		ON CONFLICT (imei) DO UPDATE SET
+		device_id = EXCLUDED.device_id,
+		online = EXCLUDED.online,
+		server_id = EXCLUDED.server_id,
+		protocol = EXCLUDED.protocol,
+		remote_addr = EXCLUDED.remote_addr,
+		state_time = EXCLUDED.state_time,
+		last_packet_time = coalesce(EXCLUDED.last_packet_time, st.last_packet_time),
+		voltage = coalesce(EXCLUDED.voltage, st.voltage),
+		gps_time = CASE WHEN %[16]s THEN EXCLUDED.gps_time ELSE st.gps_time END,
+		lon = CASE WHEN %[16]s THEN EXCLUDED.lon ELSE st.lon END,
+		lat = CASE WHEN %[16]s THEN EXCLUDED.lat ELSE st.lat END,
+		speed = CASE WHEN %[16]s THEN EXCLUDED.speed ELSE st.speed END,
+		heading = CASE WHEN %[16]s THEN EXCLUDED.heading ELSE st.heading END,
+		sat_num = CASE WHEN %[16]s THEN EXCLUDED.sat_num ELSE st.sat_num END
+		WHERE st.state_time <= EXCLUDED.state_time`,
+		sqlString(state.IMEI),
+		sqlString(state.DeviceID),
+		state.Online,
+		sqlString(state.ServerID),
+		sqlString(state.Protocol),
+		sqlString(state.RemoteAddr),
+		state.Time.Format(TIME_LAYOUT),
+		last_packet,
+		voltage,
+		gps_time,
+		lon,
+		lat,
+		speed,
+		heading,
+		sat_num,
+		STATE_POS_NEWER)
+}
@@ -0,0 +1,51 @@
+package storage_pg
+
+import(
+	"context"
+	"time"
+
+	"telsrv/app"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const DEVICES_QUERY = `SELECT imei::text, coalesce(vehicle_id::text, ''), coalesce(owner::text, ''),
+	coalesce(protocol::text, ''), coalesce(timezone::text, '') FROM devices`
+const DEVICES_LOAD_TIMEOUT_SEC = 30
+
+//Device registry from database, Query must return imei, vehicle_id, owner, protocol, timezone
+type DeviceLoaderPG struct {
+	ConnStr string
+	Query string
+}
+
+func (l *DeviceLoaderPG) LoadDevices() ([]app.Device, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(DEVICES_LOAD_TIMEOUT_SEC) * time.Second)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, l.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	query := l.Query
+	if query == "" {
+		query = DEVICES_QUERY
+	}
+	rows, err := conn.Query(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]app.Device, 0)
+	for rows.Next() {
+		var dev app.Device
+		if err := rows.Scan(&dev.IMEI, &dev.VehicleID, &dev.Owner, &dev.Protocol, &dev.Timezone); err != nil {
+			return nil, err
+		}
+		list = append(list, dev)
+	}
+	return list, rows.Err()
+}
@@ -1,3 +1,3 @@
 module telsrv/storage_pg
 
-go 1.15
+go 1.21
@@ -0,0 +1,118 @@
+package storage_pg
+
+/**
+ * Device connection history, see app.SessionWriter, app.SessionReader.
+ *
+ * CREATE TABLE device_sessions (
+ *	id bigserial PRIMARY KEY,
+ *	conn_id text NOT NULL,
+ *	imei text NOT NULL,
+ *	device_id text,
+ *	server_id text,
+ *	protocol text,
+ *	remote_addr text,
+ *	start_time timestamp NOT NULL,
+ *	end_time timestamp NOT NULL,
+ *	bytes_in bigint,
+ *	bytes_out bigint,
+ *	records bigint,
+ *	decode_errors bigint,
+ *	close_reason text,
+ *	UNIQUE (conn_id)
+ * );
+ * CREATE INDEX device_sessions_imei_idx ON device_sessions (imei, start_time DESC);
+ *
+ * Existing table:
+ * ALTER TABLE device_sessions ADD CONSTRAINT device_sessions_conn_id_key UNIQUE (conn_id);
+ *
+ * Session is written once on connection close, replayed spool query updates the same row.
+ */
+
+import(
+	"context"
+	"fmt"
+	"strings"
+
+	"telsrv/app"
+
+	"github.com/jackc/pgx/v5"
+)
+
+//string literal, no line breaks as spool file separates queries with empty lines
+func sqlString(s string) string {
+	s = strings.NewReplacer("'", "''", "\r", " ", "\n", " ").Replace(s)
+	return "'" + s + "'"
+}
+
+func getSessionQuery(sess *app.Session) string {
+	return fmt.Sprintf(`INSERT INTO device_sessions
+		(conn_id, imei, device_id, server_id, protocol, remote_addr,
+		start_time, end_time,
+		bytes_in, bytes_out, records, decode_errors, close_reason)
+		VALUES(%s, %s, %s, %s, %s, %s,
+		'%s' At time zone 'utc',
+		'%s' At time zone 'utc',
+		%d, %d, %d, %d, %s)
+		ON CONFLICT (conn_id) DO UPDATE SET
+		end_time = EXCLUDED.end_time,
+		bytes_in = EXCLUDED.bytes_in, bytes_out = EXCLUDED.bytes_out,
+		records = EXCLUDED.records, decode_errors = EXCLUDED.decode_errors,
+		close_reason = EXCLUDED.close_reason`,
+		sqlString(sess.ConnID),
+		sqlString(sess.IMEI),
+		sqlString(sess.DeviceID),
+		sqlString(sess.ServerID),
+		sqlString(sess.Protocol),
+		sqlString(sess.RemoteAddr),
+		sess.Start.Format(TIME_LAYOUT),
+		sess.End.Format(TIME_LAYOUT),
+		sess.BytesIn,
+		sess.BytesOut,
+		sess.Records,
+		sess.DecodeErrors,
+		sqlString(sess.CloseReason))
+}
+
+//Recent sessions of IMEI, the newest first
+func (s *StoragePG) GetSessions(ctx context.Context, imei string, limit int) ([]app.Session, error) {
+	conn, err := pgx.Connect(ctx, s.ConnStr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close(context.Background())
+
+	rows, err := conn.Query(ctx, `SELECT
+			conn_id, imei, coalesce(device_id, ''), coalesce(server_id, ''),
+			coalesce(protocol, ''), coalesce(remote_addr, ''),
+			start_time, end_time,
+			coalesce(bytes_in, 0), coalesce(bytes_out, 0),
+			coalesce(records, 0), coalesce(decode_errors, 0),
+			coalesce(close_reason, '')
+		FROM device_sessions
+		WHERE imei = $1
+		ORDER BY start_time DESC
+		LIMIT $2`, imei, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := make([]app.Session, 0)
+	for rows.Next() {
+		var sess app.Session
+		var bytes_in, bytes_out, records, decode_errors int64
+		if err := rows.Scan(&sess.ConnID, &sess.IMEI, &sess.DeviceID, &sess.ServerID,
+			&sess.Protocol, &sess.RemoteAddr,
+			&sess.Start, &sess.End,
+			&bytes_in, &bytes_out, &records, &decode_errors,
+			&sess.CloseReason); err != nil {
+			return nil, err
+		}
+		sess.BytesIn = uint64(bytes_in)
+		sess.BytesOut = uint64(bytes_out)
+		sess.Records = uint64(records)
+		sess.DecodeErrors = uint64(decode_errors)
+		list = append(list, sess)
+	}
+	return list, rows.Err()
+}
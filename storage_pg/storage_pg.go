@@ -6,12 +6,15 @@ import(
 	"os"
 	"path/filepath"
 	"bufio"
+	"errors"
+	"io"
 	"sync"
+	"sync/atomic"
 	"time"
+	"log/slog"
 	
 	"telsrv/app"
 	
-	"github.com/labstack/gommon/log"
 	"github.com/jackc/pgx/v5"
 )
 
@@ -20,146 +23,346 @@ const QUERY_FILE_NAME = "queries.sql"
 const QUERY_FILE_EXEC_PAUSE_MIN = 5
 const STORAGE_DESCR = "Postgresql storage"
 
+//query for process, execution result is sent to res if set,
+//failed query without res is spooled
+type pgQuery struct {
+	text string
+	res chan error
+}
+
 type StoragePG struct {
 	ConnStr string
-	Logger *log.Logger
+	Logger *slog.Logger
 	FileLock sync.Mutex
-	TelData chan *app.TelematicsData
+	queries chan pgQuery //telematics data, session and state queries for processes
 	ConnMaxIdleTime int
 	ConnMaxTime int
+	SpoolFile string //QUERY_FILE_NAME in program directory by default
+	done chan struct{} //closed on shutdown
+	workers sync.WaitGroup
+	execCtx context.Context //canceled when shutdown deadline is exceeded
+	execCancel context.CancelFunc
+	procMx sync.Mutex
+	procQuit []chan struct{} //one per process
+	queued int64 //Write calls waiting for process, atomic
+	replayed int64 //spool bytes replayed, atomic
+	writeErrors uint64 //atomic
+	writeLatency *app.Histogram
 }
 
 func (s *StoragePG) GetDescr() string {
 	return STORAGE_DESCR
 }
 
-func (s *StoragePG) Init(connStr string, logger *log.Logger, processCount int) error {
+func (s *StoragePG) Init(connStr string, logger *slog.Logger, processCount int) error {
 	if processCount == 0 {
 		processCount = 1
 	}		
 	s.ConnStr = connStr
 	s.Logger = logger	
-	s.TelData = make(chan *app.TelematicsData)
+	s.queries = make(chan pgQuery)
+	s.done = make(chan struct{})
+	s.execCtx, s.execCancel = context.WithCancel(context.Background())
+	s.writeLatency = app.NewHistogram(app.DB_WRITE_BUCKETS)
 	
-	for i:=0; i<processCount; i++ {
-		go s.WaitForData(i)
-	}
+	s.SetProcessCount(processCount)
 	//File		
+	s.workers.Add(1)
 	go (func(storage *StoragePG) {
+		defer storage.workers.Done()
 		for {			
 			storage.queryFromFile()
-			time.Sleep(time.Duration(QUERY_FILE_EXEC_PAUSE_MIN) * time.Minute)
+			select {
+			case <-storage.done:
+				return
+			case <-time.After(time.Duration(QUERY_FILE_EXEC_PAUSE_MIN) * time.Minute):
+			}
 		}
 	})(s)
-	s.Logger.Infof("StoragePG: %s initialized. ProcessCount=%d, connMaxIdleTime=%d, connMaxTime=%d", s.GetDescr(), processCount, s.ConnMaxIdleTime, s.ConnMaxTime)
+	s.Logger.Info("StoragePG: initialized", "storage", s.GetDescr(), "process_count", processCount, "conn_max_idle_time", s.ConnMaxIdleTime, "conn_max_time", s.ConnMaxTime)
 	
+	//data is spooled while database is not reachable, start is not prevented
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(app.STORAGE_CHECK_TIMEOUT_SEC) * time.Second)
+	defer cancel()
+	if err := s.CheckStorage(ctx); err != nil {
+		s.Logger.Warn("StoragePG: database is not reachable, data is spooled", app.LOG_KEY_ERR, err)
+	}
 	return nil	
 }
 
-//never exists
-func (s *StoragePG) WaitForData(procId int)  {	
-	var data *app.TelematicsData
+//Starts or stops processes, can be called while running
+func (s *StoragePG) SetProcessCount(processCount int) {
+	if processCount == 0 {
+		processCount = 1
+	}
+	s.procMx.Lock()
+	defer s.procMx.Unlock()
+	
+	for len(s.procQuit) < processCount {
+		quit := make(chan struct{})
+		s.procQuit = append(s.procQuit, quit)
+		s.workers.Add(1)
+		go s.WaitForData(len(s.procQuit)-1, quit)
+	}
+	for len(s.procQuit) > processCount {
+		last := len(s.procQuit)-1
+		close(s.procQuit[last])
+		s.procQuit = s.procQuit[:last]
+	}
+}
+
+//exits on shutdown or when quit is closed
+func (s *StoragePG) WaitForData(procId int, quit chan struct{})  {	
+	defer s.workers.Done()
+	
+	var query pgQuery
 	var conn_dead_time time.Time
 	var conn *pgx.Conn
 	for {
 		if s.ConnMaxIdleTime == 0 || conn == nil {
 			//blocking
-			data = <- s.TelData
-			//s.processData(conn, data, &conn_dead_time, procId)
-			
-			s.Logger.Debugf("StoragePG WaitForData: Got query to execute, procId=%d", procId)			
-			if conn == nil {
-				var err error
-				conn, err = pgx.Connect(context.Background(), s.ConnStr)
-				if err == nil {
-					if s.ConnMaxTime > 0 {
-						conn_dead_time = time.Now().Add(time.Duration(s.ConnMaxTime) * time.Millisecond)
-					}
-					s.Logger.Debugf("StoragePG WaitForData: Acquired DB connection, procId=%d", procId)
-				}else{
-					s.Logger.Errorf("StoragePG WaitForData pgx.Connect():%v", err)			
+			select {
+			case query = <- s.queries:
+				conn = s.processQuery(conn, query, &conn_dead_time, procId)
+				
+			case <-s.done:
+				if conn != nil {
+					conn.Close(context.Background())
 				}
-			}						
-			query := getQuery(data)				
-			if conn == nil {
-				s.queryToFile(query)
+				s.Logger.Debug("StoragePG WaitForData: stopped", "proc_id", procId)
+				return
 				
-			}else if _, err := conn.Exec(context.Background(), query); err != nil {
-				s.Logger.Errorf("StoragePG WaitForData: %v",err)
-				s.queryToFile(query)
-				conn.Close(context.Background())
-				conn = nil
+			case <-quit:
+				if conn != nil {
+					conn.Close(context.Background())
+				}
+				s.Logger.Debug("StoragePG WaitForData: process removed", "proc_id", procId)
+				return
 			}
 			
 		}else{
 			select {
-			case data = <- s.TelData:
-				//s.processData(conn, data, &conn_dead_time, procId)
-				s.Logger.Debugf("StoragePG WaitForData: Got query to execute, procId=%d", procId)			
-				if conn == nil {
-					var err error
-					conn, err = pgx.Connect(context.Background(), s.ConnStr)
-					if err == nil {
-						if s.ConnMaxTime > 0 {
-							conn_dead_time = time.Now().Add(time.Duration(s.ConnMaxTime) * time.Millisecond)
-						}
-						s.Logger.Debugf("StoragePG WaitForData: Acquired DB connection, procId=%d", procId)
-					}else{
-						s.Logger.Errorf("StoragePG WaitForData DbPool.Acquire():%v", err)			
-					}
-				}						
-				query := getQuery(data)				
-				if conn == nil {
-					s.queryToFile(query)
-					
-				}else if _, err := conn.Exec(context.Background(), query); err != nil {
-					s.Logger.Errorf("StoragePG WaitForData: %v",err)
-					s.queryToFile(query)
-					conn.Close(context.Background())
-					conn = nil
-				}
+			case query = <- s.queries:
+				conn = s.processQuery(conn, query, &conn_dead_time, procId)
 				
 			case <-time.After(time.Millisecond * time.Duration(s.ConnMaxIdleTime)):
 				if conn != nil {					
 					conn.Close(context.Background())
 					conn = nil
-					s.Logger.Debugf("StoragePG WaitForData: conn killed on idle timeout, procId=%d", procId)
+					s.Logger.Debug("StoragePG WaitForData: conn killed on idle timeout", "proc_id", procId)
 				}
+				
+			case <-s.done:
+				conn.Close(context.Background())
+				s.Logger.Debug("StoragePG WaitForData: stopped", "proc_id", procId)
+				return
+				
+			case <-quit:
+				conn.Close(context.Background())
+				s.Logger.Debug("StoragePG WaitForData: process removed", "proc_id", procId)
+				return
 			}
 		}
 		if s.ConnMaxTime > 0 && conn != nil && time.Now().After(conn_dead_time) {			
 			conn.Close(context.Background())
 			conn = nil		
-			s.Logger.Debugf("StoragePG WaitForData: conn killed on max timeout, procId=%d", procId)
+			s.Logger.Debug("StoragePG WaitForData: conn killed on max timeout", "proc_id", procId)
 		}
 		time.Sleep(time.Duration(50) * time.Millisecond)		
 	}
+}
+
+//executes query, returns connection or nil if connection is lost
+func (s *StoragePG) processQuery(conn *pgx.Conn, query pgQuery, connDeadTime *time.Time, procId int) *pgx.Conn {
+	s.Logger.Debug("StoragePG WaitForData: got query to execute", "proc_id", procId)			
+	var err error
+	if conn == nil {
+		conn, err = pgx.Connect(s.execCtx, s.ConnStr)
+		if err == nil {
+			if s.ConnMaxTime > 0 {
+				*connDeadTime = time.Now().Add(time.Duration(s.ConnMaxTime) * time.Millisecond)
+			}
+			s.Logger.Debug("StoragePG WaitForData: acquired DB connection", "proc_id", procId)
+		}else{
+			s.Logger.Error("StoragePG WaitForData: pgx.Connect failed", app.LOG_KEY_ERR, err)			
+			atomic.AddUint64(&s.writeErrors, 1)
+			conn = nil
+		}
+	}						
 	if conn != nil {
-		conn.Close(context.Background())
+		start := time.Now()
+		_, err = conn.Exec(s.execCtx, query.text)
+		s.writeLatency.ObserveDuration(start)
+		if err != nil {
+			s.Logger.Error("StoragePG WaitForData: query failed", app.LOG_KEY_ERR, err)
+			atomic.AddUint64(&s.writeErrors, 1)
+			conn.Close(context.Background())
+			conn = nil
+		}
+	}
+	if query.res != nil {
+		query.res <- err
+	}else if err != nil {
+		s.queryToFile(query.text)
 	}
+	return conn
 }
 
 func (s *StoragePG) Write(data *app.TelematicsData) {
-	s.TelData <- data
+	s.writeQuery(getQuery(data))
+}
+
+//Passes record to a process, see app.RecordWriter.
+//Error is returned if no process accepts query till ctx is done,
+//accepted query is spooled to SpoolFile on failure.
+func (s *StoragePG) WriteRecord(ctx context.Context, data *app.TelematicsData) error {
+	return s.sendQuery(ctx, pgQuery{text: getQuery(data)})
+}
+
+//Session record at device disconnect, see app.SessionWriter
+func (s *StoragePG) WriteSession(sess *app.Session) {
+	s.writeQuery(getSessionQuery(sess))
+}
+
+//Executes session query, see app.SessionRecordWriter
+func (s *StoragePG) WriteSessionRecord(ctx context.Context, sess *app.Session) error {
+	return s.execQuery(ctx, getSessionQuery(sess))
+}
+
+//spools query if storage is closed
+func (s *StoragePG) writeQuery(query string) {
+	if err := s.sendQuery(context.Background(), pgQuery{text: query}); err != nil {
+		//workers are stopped
+		s.queryToFile(query)
+	}
+}
+
+func (s *StoragePG) sendQuery(ctx context.Context, query pgQuery) error {
+	atomic.AddInt64(&s.queued, 1)
+	defer atomic.AddInt64(&s.queued, -1)
+	select {
+	case s.queries <- query:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-s.done:
+		return errors.New("storage is closed")
+	}
+}
+
+//waits for query result, query is not spooled.
+//Query canceled by ctx may be executed later, queries must be idempotent.
+func (s *StoragePG) execQuery(ctx context.Context, query string) error {
+	res := make(chan error, 1)
+	if err := s.sendQuery(ctx, pgQuery{text: query, res: res}); err != nil {
+		return err
+	}
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+//Stops workers, queries not executed till ctx deadline are spooled.
+//Returns number of queries in spool file.
+func (s *StoragePG) Close(ctx context.Context) (int, error) {
+	close(s.done)
+	
+	stopped := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		s.Logger.Warn("StoragePG Close: deadline exceeded, canceling queries")
+		s.execCancel()
+		<-stopped
+	}
+	s.execCancel()
+	
+	return s.spoolCount()
+}
+
+//number of queries in spool file
+func (s *StoragePG) spoolCount() (int, error) {
+	s.FileLock.Lock()
+	defer s.FileLock.Unlock()
+	
+	file, err := os.Open(s.spoolFileName())
+	if os.IsNotExist(err) {
+		return 0, nil
+	}else if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	
+	cnt := 0
+	query := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if scanner.Text() == "" && query {
+			cnt++
+			query = false
+		}else if scanner.Text() != "" {
+			query = true
+		}
+	}
+	return cnt, scanner.Err()
+}
+
+//Connects and pings database, see app.StorageChecker
+func (s *StoragePG) CheckStorage(ctx context.Context) error {
+	conn, err := pgx.Connect(ctx, s.ConnStr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	return conn.Ping(ctx)
+}
+
+//Queue, spool and write latency, see app.StorageMetricser
+func (s *StoragePG) GetStorageMetrics() []app.StorageMetrics {
+	var spool_bytes int64
+	if fi, err := os.Stat(s.spoolFileName()); err == nil {
+		spool_bytes = fi.Size()
+	}
+	return []app.StorageMetrics{{Storage: STORAGE_DESCR,
+		QueueLen: int(atomic.LoadInt64(&s.queued)),
+		SpoolBytes: spool_bytes,
+		ReplayedBytes: atomic.LoadInt64(&s.replayed),
+		WriteErrors: atomic.LoadUint64(&s.writeErrors),
+		WriteLatency: s.writeLatency,
+	}}
+}
+
+func (s *StoragePG) spoolFileName() string {
+	if s.SpoolFile != "" {
+		return s.SpoolFile
+	}
+	return filepath.Dir(os.Args[0]) + "/" +QUERY_FILE_NAME
 }
 
 func (s *StoragePG) queryToFile(str string) {
-	f_name:= filepath.Dir(os.Args[0]) + "/" +QUERY_FILE_NAME
-	s.Logger.Warnf("StoragePG: queryToFile %s", f_name)	
+	f_name:= s.spoolFileName()
+	s.Logger.Warn("StoragePG: queryToFile", "file", f_name)	
 	s.FileLock.Lock()
 	file, err := os.OpenFile(f_name, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
 	if err == nil {
 		file.WriteString(str+"\n\n") //empty string separator
 		file.Close()
 	}else{
-		s.Logger.Errorf("StoragePG queryToFile: failed os.OpenFile() %v",err)
+		s.Logger.Error("StoragePG queryToFile: os.OpenFile failed", app.LOG_KEY_ERR, err)
 	}	
 	s.FileLock.Unlock()
 }
 
 func (s *StoragePG) queryFromFile() {
-	f_name:= filepath.Dir(os.Args[0]) + "/" +QUERY_FILE_NAME	
-	s.Logger.Warnf("StoragePG: queryFromFile %s", f_name)	
+	f_name:= s.spoolFileName()
+	s.Logger.Warn("StoragePG: queryFromFile", "file", f_name)	
 	s.FileLock.Lock()
 	defer s.FileLock.Unlock()
 	
@@ -167,24 +370,41 @@ func (s *StoragePG) queryFromFile() {
 	if err != nil {
 		return
 	}
+	defer file.Close()
 	
-	conn, err := pgx.Connect(context.Background(), s.ConnStr)
+	conn, err := pgx.Connect(s.execCtx, s.ConnStr)
 	if err != nil {
-		s.Logger.Errorf("StoragePG queryFromFile: DbPool.Acquire() failed %v",err)
+		s.Logger.Error("StoragePG queryFromFile: pgx.Connect failed", app.LOG_KEY_ERR, err)
 		return
 	}
 	defer conn.Close(context.Background())
 
+	defer atomic.StoreInt64(&s.replayed, 0)
+
 	scanner := bufio.NewScanner(file)
 	scanner.Split(bufio.ScanLines)
 	query := ""
+	var read_bytes, executed_bytes int64 //executed - file offset after the last executed query
 	for scanner.Scan() {
 		str := scanner.Text()
+		read_bytes += int64(len(str)) + 1
+		atomic.AddInt64(&s.replayed, int64(len(str)) + 1)
 		if str == "" && query != "" {
-			if _, err = conn.Exec(context.Background(), query); err != nil {
-				s.Logger.Errorf("StoragePG queryFromFile: failed conn.Exec() %v",err)
+			select {
+			case <-s.done:
+				s.Logger.Warn("StoragePG queryFromFile: interrupted on shutdown")
+				file.Close()
+				s.dropExecuted(f_name, executed_bytes)
+				return
+			default:
+			}
+			if _, err = conn.Exec(s.execCtx, query); err != nil {
+				s.Logger.Error("StoragePG queryFromFile: conn.Exec failed", app.LOG_KEY_ERR, err)
+				file.Close()
+				s.dropExecuted(f_name, executed_bytes)
 				return
 			}
+			executed_bytes = read_bytes
 			query = ""
 			s.Logger.Debug("StoragePG queryFromFile: query executed")		
 		}else{
@@ -194,13 +414,57 @@ func (s *StoragePG) queryFromFile() {
 	 	
 	file.Close()
 	if err := os.Remove(f_name); err != nil {
-		s.Logger.Debug("StoragePG queryFromFile: file remove error %v", err)			
+		s.Logger.Debug("StoragePG queryFromFile: file remove failed", app.LOG_KEY_ERR, err)			
 	}else{
 		s.Logger.Warn("StoragePG queryFromFile: file removed")			
 	}
 }
 
 
+/**
+ * Executed queries are removed from spool file when replay stops,
+ * the next replay starts with the first failed query.
+ * s.FileLock must be locked.
+ */
+func (s *StoragePG) dropExecuted(fName string, offset int64) {
+	if offset == 0 {
+		return
+	}
+	src, err := os.Open(fName)
+	if err != nil {
+		s.Logger.Error("StoragePG dropExecuted: os.Open failed", app.LOG_KEY_ERR, err)
+		return
+	}
+	defer src.Close()
+	if _, err := src.Seek(offset, io.SeekStart); err != nil {
+		s.Logger.Error("StoragePG dropExecuted: Seek failed", app.LOG_KEY_ERR, err)
+		return
+	}
+	tmp_name := fName + ".tmp"
+	dst, err := os.OpenFile(tmp_name, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		s.Logger.Error("StoragePG dropExecuted: os.OpenFile failed", app.LOG_KEY_ERR, err)
+		return
+	}
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+	if cl_err := dst.Close(); err == nil {
+		err = cl_err
+	}
+	src.Close()
+	if err == nil {
+		err = os.Rename(tmp_name, fName)
+	}
+	if err != nil {
+		os.Remove(tmp_name)
+		s.Logger.Error("StoragePG dropExecuted: spool rewrite failed", app.LOG_KEY_ERR, err)
+		return
+	}
+	s.Logger.Warn("StoragePG queryFromFile: executed queries removed from file", "bytes", offset)
+}
+
 func getQuery(data *app.TelematicsData) string{
 	from_mem := 0
 	if data.FromMemory {
@@ -0,0 +1,30 @@
+package storage_pg
+
+import(
+	"io"
+	"os"
+	"testing"
+	"log/slog"
+	"path/filepath"
+)
+
+func TestDropExecuted(t *testing.T) {
+	f_name := filepath.Join(t.TempDir(), QUERY_FILE_NAME)
+	s := &StoragePG{SpoolFile: f_name, Logger: slog.New(slog.NewTextHandler(io.Discard, nil))}
+	s.queryToFile("INSERT 1\n\t\tVALUES(1)")
+	s.queryToFile("INSERT 2")
+	s.queryToFile("INSERT 3")
+
+	//the first query and its separator are executed
+	s.dropExecuted(f_name, int64(len("INSERT 1\n\t\tVALUES(1)\n\n")))
+	b, err := os.ReadFile(f_name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "INSERT 2\n\nINSERT 3\n\n" {
+		t.Fatalf("spool %q", string(b))
+	}
+	if _, err := os.Stat(f_name + ".tmp"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left: %v", err)
+	}
+}
@@ -0,0 +1,412 @@
+package storage_retranslator
+
+/**
+ * EGTS (GOST R 56360-2015, GOST 33472-2015), retranslation to regulator
+ * platforms. Session is authorized with dispatcher identity
+ * (EGTS_AUTH_SERVICE, EGTS_SR_DISPATCHER_IDENTITY), records are sent with
+ * EGTS_TELEDATA_SERVICE, EGTS_SR_POS_DATA for object ID of IMEI.
+ * Every transport packet is acknowledged with EGTS_PT_RESPONSE,
+ * the result of every record with EGTS_SR_RECORD_RESPONSE.
+ * Application packets of the target are answered with EGTS_PT_RESPONSE,
+ * authorization result EGTS_SR_RESULT_CODE is checked.
+ */
+
+import(
+	"fmt"
+	"math"
+	"time"
+	"strconv"
+	"encoding/binary"
+
+	"telsrv/app"
+)
+
+const (
+	EGTS_PRV byte = 0x01
+	EGTS_HEADER_LEN = 11
+
+	//packet types
+	EGTS_PT_RESPONSE byte = 0
+	EGTS_PT_APPDATA byte = 1
+
+	//services
+	EGTS_AUTH_SERVICE byte = 1
+	EGTS_TELEDATA_SERVICE byte = 2
+
+	//subrecord types
+	EGTS_SR_RECORD_RESPONSE byte = 0
+	EGTS_SR_DISPATCHER_IDENTITY byte = 5
+	EGTS_SR_RESULT_CODE byte = 9
+	EGTS_SR_POS_DATA byte = 16
+
+	//record flags
+	EGTS_RFL_OBFE byte = 0x01 //object ID is set
+	EGTS_RFL_TMFE byte = 0x04 //time is set
+	EGTS_RFL_SSOD byte = 0x80 //source service on device
+
+	//EGTS_SR_POS_DATA flags
+	EGTS_POS_VLD byte = 0x01
+	EGTS_POS_BB byte = 0x08
+	EGTS_POS_MV byte = 0x10
+	EGTS_POS_LAHS byte = 0x20
+	EGTS_POS_LOHS byte = 0x40
+	EGTS_POS_ALTE byte = 0x80
+
+	EGTS_PC_OK byte = 0
+	EGTS_OBJECT_ID_DIGITS = 9 //IMEI digits used as object ID
+)
+
+//time of EGTS fields is seconds from 2010-01-01 UTC
+var egtsEpoch = time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type egts struct {
+	dispatcherID uint32
+	objectIDs map[string]uint32
+}
+
+func (p *egts) login(c *session, imei string) error {
+	sr := []byte{0} //dispatcher type
+	sr = binary.LittleEndian.AppendUint32(sr, p.dispatcherID)
+	rec := egtsRecord(c, 0, time.Time{}, EGTS_AUTH_SERVICE, EGTS_SR_DISPATCHER_IDENTITY, sr)
+	//authorization result EGTS_SR_RESULT_CODE may follow, it is checked on the next request
+	return p.request(c, rec)
+}
+
+func (p *egts) send(c *session, data *app.TelematicsData) error {
+	oid, err := p.objectID(data.IMEI)
+	if err != nil {
+		return err
+	}
+	t := data.GPSTime
+	if t.IsZero() {
+		t = data.ReceivedTime
+	}
+	rec := egtsRecord(c, oid, t, EGTS_TELEDATA_SERVICE, EGTS_SR_POS_DATA, egtsPosData(data, t))
+	return p.request(c, rec)
+}
+
+//Object ID from objectIds, last EGTS_OBJECT_ID_DIGITS digits of IMEI by default
+func (p *egts) objectID(imei string) (uint32, error) {
+	if oid, ok := p.objectIDs[imei]; ok {
+		return oid, nil
+	}
+	digits := imei
+	if len(digits) > EGTS_OBJECT_ID_DIGITS {
+		digits = digits[len(digits) - EGTS_OBJECT_ID_DIGITS:]
+	}
+	oid, err := strconv.ParseUint(digits, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("no object ID for IMEI %s", imei)
+	}
+	return uint32(oid), nil
+}
+
+//sends APPDATA packet with one record, waits for packet and record responses
+func (p *egts) request(c *session, rec []byte) error {
+	c.pid++
+	pid := c.pid
+	rn := binary.LittleEndian.Uint16(rec[2:4])
+	if err := c.write(egtsPacket(pid, EGTS_PT_APPDATA, rec)); err != nil {
+		return err
+	}
+	pt_ok, rec_ok := false, false
+	for !pt_ok || !rec_ok {
+		pt, data, err := egtsReadPacket(c)
+		if err != nil {
+			return err
+		}
+		switch pt {
+		case EGTS_PT_RESPONSE:
+			if len(data) < 3 {
+				return fmt.Errorf("malformed response")
+			}
+			if binary.LittleEndian.Uint16(data[0:2]) != pid {
+				//response to packet of previous session state
+				continue
+			}
+			if data[2] != EGTS_PC_OK {
+				return fmt.Errorf("packet is rejected, code %d", data[2])
+			}
+			pt_ok = true
+			//record responses can be in the same packet
+			ok, err := egtsRecordResult(data[3:], rn)
+			if err != nil {
+				return err
+			}
+			rec_ok = rec_ok || ok
+
+		case EGTS_PT_APPDATA:
+			//response record of target or authorization result
+			ok, err := p.targetAppData(c, data, rn)
+			if err != nil {
+				return err
+			}
+			rec_ok = rec_ok || ok
+		}
+	}
+	return nil
+}
+
+//answers application data of target, checks result code and response to record rn
+func (p *egts) targetAppData(c *session, data []byte, rn uint16) (bool, error) {
+	records, rpid := data[:len(data) - 2], binary.LittleEndian.Uint16(data[len(data) - 2:])
+	resp := binary.LittleEndian.AppendUint16(nil, rpid)
+	resp = append(resp, EGTS_PC_OK)
+	found := false
+	err := egtsEachRecord(records, func(recNum uint16, service byte, srt byte, srd []byte) error {
+		switch srt {
+		case EGTS_SR_RECORD_RESPONSE:
+			if len(srd) >= 3 && binary.LittleEndian.Uint16(srd[0:2]) == rn {
+				if srd[2] != EGTS_PC_OK {
+					return fmt.Errorf("record is rejected, code %d", srd[2])
+				}
+				found = true
+			}
+		case EGTS_SR_RESULT_CODE:
+			if len(srd) >= 1 && srd[0] != EGTS_PC_OK {
+				return fmt.Errorf("authorization is rejected, code %d", srd[0])
+			}
+		}
+		return nil
+	}, func(recNum uint16, service byte) {
+		sr := binary.LittleEndian.AppendUint16(nil, recNum)
+		sr = append(sr, EGTS_PC_OK)
+		resp = append(resp, egtsRecordBody(recNum, 0, time.Time{}, service, EGTS_SR_RECORD_RESPONSE, sr)...)
+	})
+	if err != nil {
+		return false, err
+	}
+	c.pid++
+	if err := c.write(egtsPacket(c.pid, EGTS_PT_RESPONSE, resp)); err != nil {
+		return false, err
+	}
+	return found, nil
+}
+
+//result of record rn in records of response packet
+func egtsRecordResult(records []byte, rn uint16) (bool, error) {
+	found := false
+	err := egtsEachRecord(records, func(recNum uint16, service byte, srt byte, srd []byte) error {
+		if srt == EGTS_SR_RECORD_RESPONSE && len(srd) >= 3 && binary.LittleEndian.Uint16(srd[0:2]) == rn {
+			if srd[2] != EGTS_PC_OK {
+				return fmt.Errorf("record is rejected, code %d", srd[2])
+			}
+			found = true
+		}
+		return nil
+	}, nil)
+	return found, err
+}
+
+//calls onSubrecord for every subrecord and onRecord after every record
+func egtsEachRecord(records []byte, onSubrecord func(uint16, byte, byte, []byte) error, onRecord func(uint16, byte)) error {
+	for len(records) > 0 {
+		if len(records) < 5 {
+			return fmt.Errorf("malformed record")
+		}
+		rl := int(binary.LittleEndian.Uint16(records[0:2]))
+		rn := binary.LittleEndian.Uint16(records[2:4])
+		rfl := records[4]
+		pos := 5
+		if rfl & EGTS_RFL_OBFE != 0 {
+			pos += 4
+		}
+		if rfl & 0x02 != 0 { //EVFE
+			pos += 4
+		}
+		if rfl & EGTS_RFL_TMFE != 0 {
+			pos += 4
+		}
+		pos += 2 //SST, RST
+		if len(records) < pos + rl {
+			return fmt.Errorf("malformed record")
+		}
+		service := records[pos - 2]
+		rd := records[pos:pos + rl]
+		for len(rd) > 0 {
+			if len(rd) < 3 {
+				return fmt.Errorf("malformed subrecord")
+			}
+			srl := int(binary.LittleEndian.Uint16(rd[1:3]))
+			if len(rd) < 3 + srl {
+				return fmt.Errorf("malformed subrecord")
+			}
+			if err := onSubrecord(rn, service, rd[0], rd[3:3 + srl]); err != nil {
+				return err
+			}
+			rd = rd[3 + srl:]
+		}
+		if onRecord != nil {
+			onRecord(rn, service)
+		}
+		records = records[pos + rl:]
+	}
+	return nil
+}
+
+//reads transport packet, returns packet type and frame data
+//(APPDATA frame is returned with packet identifier in the last 2 bytes)
+func egtsReadPacket(c *session) (byte, []byte, error) {
+	if err := c.fill(EGTS_HEADER_LEN); err != nil {
+		return 0, nil, err
+	}
+	if c.buf[0] != EGTS_PRV {
+		return 0, nil, fmt.Errorf("unsupported protocol version %d", c.buf[0])
+	}
+	hl := int(c.buf[3])
+	if hl < EGTS_HEADER_LEN {
+		return 0, nil, fmt.Errorf("malformed header")
+	}
+	if err := c.fill(hl); err != nil {
+		return 0, nil, err
+	}
+	if egtsCRC8(c.buf[:hl - 1]) != c.buf[hl - 1] {
+		return 0, nil, fmt.Errorf("header checksum error")
+	}
+	fdl := int(binary.LittleEndian.Uint16(c.buf[5:7]))
+	pid := binary.LittleEndian.Uint16(c.buf[7:9])
+	pt := c.buf[9]
+	size := hl
+	if fdl > 0 {
+		size += fdl + 2
+	}
+	if err := c.fill(size); err != nil {
+		return 0, nil, err
+	}
+	packet := c.consume(size)
+	frame := packet[hl:hl + fdl]
+	if fdl > 0 && egtsCRC16(frame) != binary.LittleEndian.Uint16(packet[hl + fdl:]) {
+		return 0, nil, fmt.Errorf("frame checksum error")
+	}
+	if pt == EGTS_PT_APPDATA {
+		frame = binary.LittleEndian.AppendUint16(frame, pid)
+	}
+	return pt, frame, nil
+}
+
+//transport packet without routing
+func egtsPacket(pid uint16, pt byte, frame []byte) []byte {
+	p := make([]byte, 0, EGTS_HEADER_LEN + len(frame) + 2)
+	p = append(p, EGTS_PRV, 0, 0, EGTS_HEADER_LEN, 0) //PRV, SKID, flags, HL, HE
+	p = binary.LittleEndian.AppendUint16(p, uint16(len(frame)))
+	p = binary.LittleEndian.AppendUint16(p, pid)
+	p = append(p, pt)
+	p = append(p, egtsCRC8(p))
+	if len(frame) == 0 {
+		return p
+	}
+	p = append(p, frame...)
+	return binary.LittleEndian.AppendUint16(p, egtsCRC16(frame))
+}
+
+//record with the next record number of session
+func egtsRecord(c *session, oid uint32, t time.Time, service byte, srt byte, srd []byte) []byte {
+	c.rn++
+	return egtsRecordBody(c.rn, oid, t, service, srt, srd)
+}
+
+//record with one subrecord, oid and t are optional
+func egtsRecordBody(rn uint16, oid uint32, t time.Time, service byte, srt byte, srd []byte) []byte {
+	rfl := EGTS_RFL_SSOD
+	if oid != 0 {
+		rfl |= EGTS_RFL_OBFE
+	}
+	if !t.IsZero() {
+		rfl |= EGTS_RFL_TMFE
+	}
+	r := binary.LittleEndian.AppendUint16(nil, uint16(3 + len(srd)))
+	r = binary.LittleEndian.AppendUint16(r, rn)
+	r = append(r, rfl)
+	if oid != 0 {
+		r = binary.LittleEndian.AppendUint32(r, oid)
+	}
+	if !t.IsZero() {
+		r = binary.LittleEndian.AppendUint32(r, egtsTime(t))
+	}
+	r = append(r, service, service, srt)
+	r = binary.LittleEndian.AppendUint16(r, uint16(len(srd)))
+	return append(r, srd...)
+}
+
+func egtsPosData(data *app.TelematicsData, t time.Time) []byte {
+	var flg byte
+	if data.GPSValid {
+		flg |= EGTS_POS_VLD
+	}
+	if data.FromMemory {
+		flg |= EGTS_POS_BB
+	}
+	if data.Speed > 0 {
+		flg |= EGTS_POS_MV
+	}
+	if data.Lat < 0 {
+		flg |= EGTS_POS_LAHS
+	}
+	if data.Lon < 0 {
+		flg |= EGTS_POS_LOHS
+	}
+	flg |= EGTS_POS_ALTE
+
+	sr := binary.LittleEndian.AppendUint32(nil, egtsTime(t))
+	sr = binary.LittleEndian.AppendUint32(sr, uint32(math.Abs(float64(data.Lat)) / 90 * 0xFFFFFFFF))
+	sr = binary.LittleEndian.AppendUint32(sr, uint32(math.Abs(float64(data.Lon)) / 180 * 0xFFFFFFFF))
+	sr = append(sr, flg)
+	//speed 0.1 km/h in 14 bits, altitude sign bit, heading high bit
+	spd := uint16(data.Speed * 10) & 0x3FFF
+	if data.Height < 0 {
+		spd |= 0x4000
+	}
+	heading := uint16(data.Heading) % 360
+	if heading > 0xFF {
+		spd |= 0x8000
+	}
+	sr = binary.LittleEndian.AppendUint16(sr, spd)
+	sr = append(sr, byte(heading))
+	//odometer 0.1 km, as received from tracker
+	sr = append(sr, byte(data.Odom), byte(data.Odom >> 8), byte(data.Odom >> 16))
+	sr = append(sr, 0, 0) //digital inputs, source: timer
+	alt := uint32(data.Height)
+	if data.Height < 0 {
+		alt = uint32(-data.Height)
+	}
+	return append(sr, byte(alt), byte(alt >> 8), byte(alt >> 16))
+}
+
+func egtsTime(t time.Time) uint32 {
+	if t.Before(egtsEpoch) {
+		return 0
+	}
+	return uint32(t.Sub(egtsEpoch) / time.Second)
+}
+
+//CRC-8, polynomial 0x31, initial value 0xFF
+func egtsCRC8(b []byte) byte {
+	crc := byte(0xFF)
+	for _, v := range b {
+		crc ^= v
+		for i := 0; i < 8; i++ {
+			if crc & 0x80 != 0 {
+				crc = crc << 1 ^ 0x31
+			}else{
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+//CRC-16 CCITT, polynomial 0x1021, initial value 0xFFFF
+func egtsCRC16(b []byte) uint16 {
+	crc := uint16(0xFFFF)
+	for _, v := range b {
+		crc ^= uint16(v) << 8
+		for i := 0; i < 8; i++ {
+			if crc & 0x8000 != 0 {
+				crc = crc << 1 ^ 0x1021
+			}else{
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,189 @@
+package storage_retranslator
+
+import(
+	"net"
+	"sync"
+	"time"
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"sync/atomic"
+	"encoding/hex"
+	"encoding/binary"
+
+	"telsrv/app/apptest"
+)
+
+//EGTS target: packets are answered with EGTS_PT_RESPONSE with record results,
+//data records get recCode, EGTS_SR_RESULT_CODE follows authorization in APPDATA packet.
+//POS_DATA subrecords are sent to posData.
+type egtsTestTarget struct {
+	recCode byte
+	mx sync.Mutex
+	oids []uint32
+	posData [][]byte
+	responses int32 //responses of client, atomic
+}
+
+func (tg *egtsTestTarget) handle(conn net.Conn) {
+	c := &session{conn: conn}
+	var pid, rn uint16
+	for {
+		pt, frame, err := egtsReadPacket(c)
+		if err != nil {
+			return
+		}
+		if pt == EGTS_PT_RESPONSE {
+			atomic.AddInt32(&tg.responses, 1)
+			continue
+		}
+		records, cpid := frame[:len(frame) - 2], binary.LittleEndian.Uint16(frame[len(frame) - 2:])
+		resp := binary.LittleEndian.AppendUint16(nil, cpid)
+		resp = append(resp, EGTS_PC_OK)
+		auth := false
+		egtsEachRecord(records, func(recNum uint16, service byte, srt byte, srd []byte) error {
+			switch srt {
+			case EGTS_SR_DISPATCHER_IDENTITY:
+				auth = true
+			case EGTS_SR_POS_DATA:
+				tg.mx.Lock()
+				tg.posData = append(tg.posData, srd)
+				tg.mx.Unlock()
+			}
+			return nil
+		}, func(recNum uint16, service byte) {
+			code := tg.recCode
+			if service == EGTS_AUTH_SERVICE {
+				code = EGTS_PC_OK
+			}
+			rn++
+			sr := append(binary.LittleEndian.AppendUint16(nil, recNum), code)
+			resp = append(resp, egtsRecordBody(rn, 0, time.Time{}, service, EGTS_SR_RECORD_RESPONSE, sr)...)
+		})
+		if len(records) > 9 && records[4] & EGTS_RFL_OBFE != 0 {
+			tg.mx.Lock()
+			tg.oids = append(tg.oids, binary.LittleEndian.Uint32(records[5:9]))
+			tg.mx.Unlock()
+		}
+		pid++
+		conn.Write(egtsPacket(pid, EGTS_PT_RESPONSE, resp))
+		if auth {
+			rn++
+			pid++
+			conn.Write(egtsPacket(pid, EGTS_PT_APPDATA, egtsRecordBody(rn, 0, time.Time{}, EGTS_AUTH_SERVICE, EGTS_SR_RESULT_CODE, []byte{EGTS_PC_OK})))
+		}
+	}
+}
+
+const (
+	EGTS_POS_GOLDEN = "578fa41a" + "3de9939e" + "271d8035" + "91" + "5882" + "0e" + "40e201" + "00" + "00" + "960000"
+	EGTS_RECORD_GOLDEN = "0500" + "0100" + "85" + "29460f00" + "578fa41a" + "02" + "02" + "10" + "0200" + "0102"
+	EGTS_RESPONSE_GOLDEN = "0100000b00" + "0300" + "0100" + "00" + "16" + "010000" + "acfb"
+	EGTS_EMPTY_GOLDEN = "0100000b00" + "0000" + "0700" + "01" + "c6"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestEGTSChecksums(t *testing.T) {
+	//check values of CRC-8 (poly 0x31, init 0xFF) and CRC-16 CCITT-FALSE
+	if crc := egtsCRC8([]byte("123456789")); crc != 0xF7 {
+		t.Errorf("CRC-8 0x%02x", crc)
+	}
+	if crc := egtsCRC16([]byte("123456789")); crc != 0x29B1 {
+		t.Errorf("CRC-16 0x%04x", crc)
+	}
+}
+
+func TestEGTSEncode(t *testing.T) {
+	if p := egtsPosData(testRecord("1"), testTime); !bytes.Equal(p, decodeHex(t, EGTS_POS_GOLDEN)) {
+		t.Errorf("POS_DATA %x", p)
+	}
+	if r := egtsRecordBody(1, 1001001, testTime, EGTS_TELEDATA_SERVICE, EGTS_SR_POS_DATA, []byte{1, 2}); !bytes.Equal(r, decodeHex(t, EGTS_RECORD_GOLDEN)) {
+		t.Errorf("record %x", r)
+	}
+	if p := egtsPacket(1, EGTS_PT_RESPONSE, []byte{1, 0, EGTS_PC_OK}); !bytes.Equal(p, decodeHex(t, EGTS_RESPONSE_GOLDEN)) {
+		t.Errorf("packet %x", p)
+	}
+	if p := egtsPacket(7, EGTS_PT_APPDATA, nil); !bytes.Equal(p, decodeHex(t, EGTS_EMPTY_GOLDEN)) {
+		t.Errorf("empty packet %x", p)
+	}
+	p := &egts{objectIDs: map[string]uint32{"860000000000001": 1001001}}
+	for imei, oid := range map[string]uint32{"860000000000001": 1001001, "860000123456789": 123456789, "12": 12} {
+		if v, err := p.objectID(imei); err != nil || v != oid {
+			t.Errorf("object ID of %s: %d %v", imei, v, err)
+		}
+	}
+	if _, err := p.objectID("86000000000000x"); err == nil {
+		t.Error("object ID of wrong IMEI")
+	}
+}
+
+func TestEGTSReadPacket(t *testing.T) {
+	pt, frame, err := egtsReadPacket(&session{buf: decodeHex(t, EGTS_RESPONSE_GOLDEN + EGTS_EMPTY_GOLDEN)})
+	if err != nil || pt != EGTS_PT_RESPONSE || !bytes.Equal(frame, []byte{1, 0, 0}) {
+		t.Fatalf("response %d %x %v", pt, frame, err)
+	}
+	//APPDATA frame with packet identifier
+	rec := decodeHex(t, EGTS_RECORD_GOLDEN)
+	pt, frame, err = egtsReadPacket(&session{buf: egtsPacket(0x1234, EGTS_PT_APPDATA, rec)})
+	if err != nil || pt != EGTS_PT_APPDATA || !bytes.Equal(frame, append(rec, 0x34, 0x12)) {
+		t.Fatalf("appdata %d %x %v", pt, frame, err)
+	}
+	for i, descr := range map[int]string{10: "header checksum", 11: "frame checksum", 0: "protocol version"} {
+		p := decodeHex(t, EGTS_RESPONSE_GOLDEN)
+		p[i] ^= 0x01
+		if _, _, err := egtsReadPacket(&session{buf: p}); err == nil || !strings.Contains(err.Error(), descr) {
+			t.Errorf("%s: %v", descr, err)
+		}
+	}
+}
+
+func TestEGTSRecordResult(t *testing.T) {
+	resp := func(crn uint16, code byte) []byte {
+		sr := append(binary.LittleEndian.AppendUint16(nil, crn), code)
+		return egtsRecordBody(1, 0, time.Time{}, EGTS_TELEDATA_SERVICE, EGTS_SR_RECORD_RESPONSE, sr)
+	}
+	if ok, err := egtsRecordResult(append(resp(4, 0), resp(5, 0)...), 5); !ok || err != nil {
+		t.Errorf("accepted record %v %v", ok, err)
+	}
+	if ok, err := egtsRecordResult(resp(4, 0), 5); ok || err != nil {
+		t.Errorf("other record %v %v", ok, err)
+	}
+	if _, err := egtsRecordResult(resp(5, 128), 5); err == nil {
+		t.Error("rejected record")
+	}
+	if _, err := egtsRecordResult(resp(5, 0)[:8], 5); err == nil {
+		t.Error("truncated record")
+	}
+}
+
+func TestEGTSTarget(t *testing.T) {
+	tg := &egtsTestTarget{}
+	addr := startTestTarget(t, tg.handle).addr
+	s := newTestStorage(t, Config{Protocol: PROTOCOL_EGTS, DispatcherID: 1001, ObjectIDs: map[string]uint32{"860000000000001": 1001001}}, addr)
+	for i := 0; i < 2; i++ {
+		if err := s.WriteRecord(context.Background(), testRecord("860000000000001")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//authorization result is answered
+	apptest.WaitFor(t, "response to result code", func() bool { return atomic.LoadInt32(&tg.responses) == 1 })
+	tg.mx.Lock()
+	if len(tg.posData) != 2 || !bytes.Equal(tg.posData[0], decodeHex(t, EGTS_POS_GOLDEN)) || len(tg.oids) != 2 || tg.oids[0] != 1001001 {
+		t.Errorf("POS_DATA %x, object IDs %v", tg.posData, tg.oids)
+	}
+	tg.mx.Unlock()
+
+	tg = &egtsTestTarget{recCode: 1}
+	s = newTestStorage(t, Config{Protocol: PROTOCOL_EGTS, DispatcherID: 1001}, startTestTarget(t, tg.handle).addr)
+	if err := s.WriteRecord(context.Background(), testRecord("860000000000001")); err == nil || !strings.Contains(err.Error(), "record is rejected") {
+		t.Fatalf("rejected record: %v", err)
+	}
+}
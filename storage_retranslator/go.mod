@@ -0,0 +1,3 @@
+module telsrv/storage_retranslator
+
+go 1.21
@@ -0,0 +1,375 @@
+package storage_retranslator
+
+/**
+ * Retranslation of telematics data to upstream servers (regulators,
+ * customer platforms) with Wialon IPS, Wialon Retranslator or EGTS protocol.
+ * One sink is one target. TCP session is kept open between records,
+ * every record is sent after the previous one is acknowledged by the target.
+ * Failed record is returned as error, app.MultiStorage retries it and spools
+ * records to disk while the target is unreachable, so the storage is used
+ * in sinks list only.
+ * Wialon IPS authorizes connection by device, a session is opened for
+ * every IMEI up to MaxSessions, the least recently used session is closed
+ * for a new one. Other protocols use one session per target.
+ * Sending is serialized by mx, status and checks read the atomic
+ * session count and do not wait for the target.
+ */
+
+import(
+	"fmt"
+	"net"
+	"sync"
+	"time"
+	"errors"
+	"context"
+	"sync/atomic"
+	"log/slog"
+
+	"telsrv/app"
+)
+
+const (
+	STORAGE_DESCR = "Retranslator"
+
+	PROTOCOL_WIALON_IPS = "wialon_ips"
+	PROTOCOL_WIALON_RETRANSLATOR = "wialon_retranslator"
+	PROTOCOL_EGTS = "egts"
+
+	DEF_ACK_TIMEOUT_MS = 10000
+	DEF_CONNECT_TIMEOUT_SEC = 10
+	DEF_IDLE_CLOSE_SEC = 300 //session without data is closed
+	IDLE_CHECK_SEC = 30
+	DEF_MAX_SESSIONS = 1000
+)
+
+//Sink options
+type Config struct {
+	Protocol string `json:"protocol"`
+	IMEIs []string `json:"imeis"` //retranslated devices, empty - all
+	AckTimeoutMs int `json:"ackTimeoutMs"`
+	IdleCloseSec int `json:"idleCloseSec"`
+	MaxSessions int `json:"maxSessions"` //Wialon IPS sessions (one per IMEI)
+	Password string `json:"password"` //Wialon IPS device password, NA if empty
+	DispatcherID uint32 `json:"dispatcherId"` //EGTS dispatcher identity
+	ObjectIDs map[string]uint32 `json:"objectIds"` //EGTS object ID of IMEI, see egts.objectID
+}
+
+//protocol of session
+type protocol interface {
+	//authorization after connect, imei is empty for sessions of target
+	login(c *session, imei string) error
+	//sends record and waits for acknowledgement
+	send(c *session, data *app.TelematicsData) error
+}
+
+//connection to target
+type session struct {
+	conn net.Conn
+	buf []byte //received and not processed bytes
+	deadline time.Time
+	lastUse time.Time
+	pid uint16 //EGTS packet identifier
+	rn uint16 //EGTS record number
+}
+
+type StorageRetranslator struct {
+	Conf Config
+	Logger *slog.Logger
+	addr string
+	proto protocol
+	imeis map[string]bool
+	mx sync.Mutex //sessions and sending
+	sessions map[string]*session //by IMEI for Wialon IPS, by empty key for others
+	sessionCnt int32 //len(sessions), atomic
+	done chan struct{}
+	stopped chan struct{}
+	statusMx sync.Mutex
+	lastAck time.Time
+	pendingSince time.Time //received time of the oldest record not acknowledged since the last acknowledgement
+	lastAckReceived time.Time //received time of the last acknowledged record
+	sent uint64 //atomic
+	writeErrors uint64 //atomic
+	writeLatency *app.Histogram
+}
+
+func (s *StorageRetranslator) GetDescr() string {
+	return STORAGE_DESCR+" "+s.Conf.Protocol
+}
+
+//connStr is host:port of target, processCount is not used
+func (s *StorageRetranslator) Init(connStr string, logger *slog.Logger, processCount int) error {
+	if _, _, err := net.SplitHostPort(connStr); err != nil {
+		return fmt.Errorf("connection must be host:port: %v", err)
+	}
+	s.addr = connStr
+	s.Logger = logger
+	switch s.Conf.Protocol {
+	case PROTOCOL_WIALON_IPS:
+		s.proto = &wialonIPS{password: s.Conf.Password}
+	case PROTOCOL_WIALON_RETRANSLATOR:
+		s.proto = &wialonRetranslator{}
+	case PROTOCOL_EGTS:
+		if s.Conf.DispatcherID == 0 {
+			return errors.New("dispatcherId is not set")
+		}
+		s.proto = &egts{dispatcherID: s.Conf.DispatcherID, objectIDs: s.Conf.ObjectIDs}
+	default:
+		return fmt.Errorf("unknown protocol %s", s.Conf.Protocol)
+	}
+	if s.Conf.AckTimeoutMs <= 0 {
+		s.Conf.AckTimeoutMs = DEF_ACK_TIMEOUT_MS
+	}
+	if s.Conf.IdleCloseSec <= 0 {
+		s.Conf.IdleCloseSec = DEF_IDLE_CLOSE_SEC
+	}
+	if s.Conf.MaxSessions <= 0 {
+		s.Conf.MaxSessions = DEF_MAX_SESSIONS
+	}
+	if len(s.Conf.IMEIs) > 0 {
+		s.imeis = make(map[string]bool, len(s.Conf.IMEIs))
+		for _, imei := range s.Conf.IMEIs {
+			s.imeis[imei] = true
+		}
+	}
+	s.sessions = make(map[string]*session)
+	s.done = make(chan struct{})
+	s.stopped = make(chan struct{})
+	s.writeLatency = app.NewHistogram(app.DB_WRITE_BUCKETS)
+	go s.closeIdle()
+	s.Logger.Info("StorageRetranslator: initialized", "target", s.addr, "protocol", s.Conf.Protocol, "imei_count", len(s.imeis))
+	return nil
+}
+
+//Selected IMEIs only, see app.RecordFilter
+func (s *StorageRetranslator) AcceptRecord(data *app.TelematicsData) bool {
+	return s.imeis == nil || s.imeis[data.IMEI]
+}
+
+//Record not acknowledged by the target is dropped, in sinks list
+//app.MultiStorage resends failed WriteRecord calls
+func (s *StorageRetranslator) Write(data *app.TelematicsData) {
+	if err := s.WriteRecord(context.Background(), data); err != nil {
+		s.Logger.Error("StorageRetranslator: send failed", app.LOG_KEY_ERR, err)
+	}
+}
+
+//Sends record, returns after acknowledgement, see app.RecordWriter
+func (s *StorageRetranslator) WriteRecord(ctx context.Context, data *app.TelematicsData) error {
+	if !s.AcceptRecord(data) {
+		//spooled before IMEI list change
+		return nil
+	}
+	start := time.Now()
+	defer s.writeLatency.ObserveDuration(start)
+
+	s.statusMx.Lock()
+	if s.pendingSince.IsZero() || data.ReceivedTime.Before(s.pendingSince) {
+		s.pendingSince = data.ReceivedTime
+	}
+	s.statusMx.Unlock()
+
+	err := s.send(ctx, data)
+	if err != nil {
+		atomic.AddUint64(&s.writeErrors, 1)
+		return err
+	}
+	atomic.AddUint64(&s.sent, 1)
+	s.statusMx.Lock()
+	s.lastAck = time.Now()
+	s.lastAckReceived = data.ReceivedTime
+	s.pendingSince = time.Time{}
+	s.statusMx.Unlock()
+	return nil
+}
+
+func (s *StorageRetranslator) send(ctx context.Context, data *app.TelematicsData) error {
+	key := ""
+	if s.Conf.Protocol == PROTOCOL_WIALON_IPS {
+		key = data.IMEI
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	sess, reused := s.sessions[key]
+	if !reused {
+		var err error
+		if sess, err = s.openSession(ctx, key); err != nil {
+			return err
+		}
+	}
+	err := s.sendOnSession(ctx, sess, data)
+	if err != nil && reused {
+		//target could close idle session, the record is sent once more on new session
+		s.closeSession(key, sess)
+		s.Logger.Debug("StorageRetranslator: session failed, reconnecting", "imei", data.IMEI, app.LOG_KEY_ERR, err)
+		if sess, err = s.openSession(ctx, key); err != nil {
+			return err
+		}
+		err = s.sendOnSession(ctx, sess, data)
+	}
+	if err != nil {
+		s.closeSession(key, sess)
+	}
+	return err
+}
+
+//s.mx must be locked
+func (s *StorageRetranslator) openSession(ctx context.Context, key string) (*session, error) {
+	if len(s.sessions) >= s.Conf.MaxSessions {
+		s.closeLeastUsed()
+	}
+	d := net.Dialer{Timeout: time.Duration(DEF_CONNECT_TIMEOUT_SEC) * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return nil, err
+	}
+	sess := &session{conn: conn, lastUse: time.Now()}
+	sess.setDeadline(ctx, time.Duration(s.Conf.AckTimeoutMs) * time.Millisecond)
+	if err := s.proto.login(sess, key); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("login: %v", err)
+	}
+	s.sessions[key] = sess
+	atomic.StoreInt32(&s.sessionCnt, int32(len(s.sessions)))
+	s.Logger.Info("StorageRetranslator: session opened", "target", s.addr, "imei", key)
+	return sess, nil
+}
+
+//s.mx must be locked
+func (s *StorageRetranslator) sendOnSession(ctx context.Context, sess *session, data *app.TelematicsData) error {
+	sess.setDeadline(ctx, time.Duration(s.Conf.AckTimeoutMs) * time.Millisecond)
+	sess.lastUse = time.Now()
+	return s.proto.send(sess, data)
+}
+
+//s.mx must be locked
+func (s *StorageRetranslator) closeSession(key string, sess *session) {
+	sess.conn.Close()
+	if s.sessions[key] == sess {
+		delete(s.sessions, key)
+		atomic.StoreInt32(&s.sessionCnt, int32(len(s.sessions)))
+	}
+}
+
+//s.mx must be locked
+func (s *StorageRetranslator) closeLeastUsed() {
+	var lru_key string
+	var lru *session
+	for key, sess := range s.sessions {
+		if lru == nil || sess.lastUse.Before(lru.lastUse) {
+			lru_key, lru = key, sess
+		}
+	}
+	if lru != nil {
+		s.closeSession(lru_key, lru)
+		s.Logger.Debug("StorageRetranslator: least recently used session closed", "imei", lru_key)
+	}
+}
+
+//sessions without data are closed, Wialon IPS keeps session of every device
+func (s *StorageRetranslator) closeIdle() {
+	defer close(s.stopped)
+	ticker := time.NewTicker(time.Duration(IDLE_CHECK_SEC) * time.Second)
+	defer ticker.Stop()
+	idle := time.Duration(s.Conf.IdleCloseSec) * time.Second
+	for {
+		select {
+		case <-ticker.C:
+			s.mx.Lock()
+			for key, sess := range s.sessions {
+				if time.Since(sess.lastUse) >= idle {
+					s.closeSession(key, sess)
+					s.Logger.Debug("StorageRetranslator: idle session closed", "imei", key)
+				}
+			}
+			s.mx.Unlock()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+//Session state and lag of the record being sent,
+//lag of queued records is added by app.MultiStorage, see app.RetranslationStatuser
+func (s *StorageRetranslator) GetRetranslationStatus() []app.RetranslationStatus {
+	connected := atomic.LoadInt32(&s.sessionCnt) > 0
+	s.statusMx.Lock()
+	defer s.statusMx.Unlock()
+	st := app.RetranslationStatus{Protocol: s.Conf.Protocol,
+		Connected: connected,
+		LastAck: s.lastAck,
+		LastAckReceived: s.lastAckReceived,
+		Sent: atomic.LoadUint64(&s.sent),
+	}
+	if !s.pendingSince.IsZero() {
+		st.LagSec = time.Since(s.pendingSince).Seconds()
+	}
+	return []app.RetranslationStatus{st}
+}
+
+//Target is reachable, see app.StorageChecker
+func (s *StorageRetranslator) CheckStorage(ctx context.Context) error {
+	if atomic.LoadInt32(&s.sessionCnt) > 0 {
+		return nil
+	}
+	d := net.Dialer{Timeout: time.Duration(DEF_CONNECT_TIMEOUT_SEC) * time.Second}
+	conn, err := d.DialContext(ctx, "tcp", s.addr)
+	if err != nil {
+		return err
+	}
+	conn.Close()
+	return nil
+}
+
+//Write errors and latency, see app.StorageMetricser
+func (s *StorageRetranslator) GetStorageMetrics() []app.StorageMetrics {
+	return []app.StorageMetrics{{Storage: STORAGE_DESCR,
+		WriteErrors: atomic.LoadUint64(&s.writeErrors),
+		WriteLatency: s.writeLatency,
+	}}
+}
+
+//Closes sessions, nothing is queued by the storage
+func (s *StorageRetranslator) Close(ctx context.Context) (int, error) {
+	close(s.done)
+	<-s.stopped
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	for key, sess := range s.sessions {
+		s.closeSession(key, sess)
+	}
+	return 0, nil
+}
+
+func (c *session) setDeadline(ctx context.Context, timeout time.Duration) {
+	c.deadline = time.Now().Add(timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(c.deadline) {
+		c.deadline = d
+	}
+	c.conn.SetDeadline(c.deadline)
+}
+
+func (c *session) write(b []byte) error {
+	_, err := c.conn.Write(b)
+	return err
+}
+
+//reads at least n bytes into c.buf
+func (c *session) fill(n int) error {
+	tmp := make([]byte, 1024)
+	for len(c.buf) < n {
+		cnt, err := c.conn.Read(tmp)
+		c.buf = append(c.buf, tmp[:cnt]...)
+		if err != nil && len(c.buf) < n {
+			return err
+		}
+	}
+	return nil
+}
+
+//removes n processed bytes from c.buf
+func (c *session) consume(n int) []byte {
+	b := make([]byte, n)
+	copy(b, c.buf[:n])
+	c.buf = c.buf[n:]
+	return b
+}
@@ -0,0 +1,141 @@
+package storage_retranslator
+
+import(
+	"net"
+	"sync"
+	"time"
+	"context"
+	"testing"
+	"sync/atomic"
+
+	"telsrv/app"
+	"telsrv/app/apptest"
+)
+
+var testTime = time.Date(2024, 3, 1, 12, 30, 15, 0, time.UTC)
+
+func testRecord(imei string) *app.TelematicsData {
+	return &app.TelematicsData{IMEI: imei,
+		GPSTime: testTime,
+		Lat: 55.75,
+		Lon: 37.6175,
+		Speed: 60,
+		Heading: 270,
+		Height: 150,
+		SattlliteNum: 12,
+		GPSValid: true,
+		VoltExt: 12500,
+		VoltInt: 4100,
+		SignalLevel: 25,
+		Odom: 123456,
+	}
+}
+
+//target server, handle serves one connection
+type testTarget struct {
+	addr string
+	accepted int32 //atomic
+	open int32 //atomic
+}
+
+func startTestTarget(t *testing.T, handle func(conn net.Conn)) *testTarget {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tg := &testTarget{addr: l.Addr().String()}
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		l.Close()
+		wg.Wait()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&tg.accepted, 1)
+			atomic.AddInt32(&tg.open, 1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer atomic.AddInt32(&tg.open, -1)
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				handle(conn)
+			}()
+		}
+	}()
+	return tg
+}
+
+func newTestStorage(t *testing.T, conf Config, addr string) *StorageRetranslator {
+	if conf.AckTimeoutMs == 0 {
+		conf.AckTimeoutMs = 2000
+	}
+	s := &StorageRetranslator{Conf: conf}
+	if err := s.Init(addr, apptest.Logger(), 1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		s.Close(context.Background())
+	})
+	return s
+}
+
+//Wialon IPS sessions over MaxSessions close the least recently used one
+func TestMaxSessions(t *testing.T) {
+	tg := startTestTarget(t, ipsTarget("1"))
+	s := newTestStorage(t, Config{Protocol: PROTOCOL_WIALON_IPS, MaxSessions: 2}, tg.addr)
+	for _, imei := range []string{"1", "2", "1", "3"} {
+		if err := s.WriteRecord(context.Background(), testRecord(imei)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.mx.Lock()
+	_, ok1 := s.sessions["1"]
+	_, ok2 := s.sessions["2"]
+	cnt := len(s.sessions)
+	s.mx.Unlock()
+	if cnt != 2 || !ok1 || ok2 {
+		t.Fatalf("sessions %d, IMEI 1 %v, IMEI 2 %v", cnt, ok1, ok2)
+	}
+	if a := atomic.LoadInt32(&tg.accepted); a != 3 {
+		t.Fatalf("connections %d", a)
+	}
+	apptest.WaitFor(t, "closed connection", func() bool { return atomic.LoadInt32(&tg.open) == 2 })
+	if st := s.GetRetranslationStatus()[0]; !st.Connected || st.Sent != 4 {
+		t.Fatalf("status %+v", st)
+	}
+}
+
+//status and check do not wait for sending to silent target
+func TestStatusWhileSending(t *testing.T) {
+	release := make(chan struct{})
+	tg := startTestTarget(t, func(conn net.Conn) {
+		<-release
+	})
+	defer close(release)
+	s := newTestStorage(t, Config{Protocol: PROTOCOL_WIALON_IPS, AckTimeoutMs: 1000}, tg.addr)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- s.WriteRecord(context.Background(), testRecord("1"))
+	}()
+	apptest.WaitFor(t, "connection", func() bool { return atomic.LoadInt32(&tg.accepted) == 1 })
+
+	start := time.Now()
+	st := s.GetRetranslationStatus()[0]
+	if err := s.CheckStorage(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Fatalf("status and check took %v", d)
+	}
+	if st.Connected {
+		t.Fatal("connected before login")
+	}
+	if err := <-sent; err == nil {
+		t.Fatal("not acknowledged record is sent")
+	}
+}
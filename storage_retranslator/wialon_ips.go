@@ -0,0 +1,142 @@
+package storage_retranslator
+
+/**
+ * Wialon IPS 1.1, text protocol, session is authorized by device IMEI:
+ * #L#imei;password -> #AL#1
+ * #D#date;time;lat1;lat2;lon1;lon2;speed;course;height;sats;hdop;inputs;outputs;adc;ibutton;params -> #AD#1
+ * Values are not converted, params are passed as received from tracker.
+ */
+
+import(
+	"fmt"
+	"math"
+	"bytes"
+	"strings"
+
+	"telsrv/app"
+)
+
+const (
+	IPS_NA = "NA"
+	IPS_LINE_END = "\r\n"
+	IPS_MAX_ANSWER_LEN = 256
+)
+
+//data packet answer codes
+var ipsDataErrors = map[string]string{"-1": "packet structure error",
+	"0": "incorrect time",
+	"10": "coordinates error",
+	"11": "speed, course or height error",
+	"12": "satellites or hdop error",
+	"13": "inputs or outputs error",
+	"14": "adc error",
+	"15": "parameters error",
+	"16": "parameters error",
+}
+
+type wialonIPS struct {
+	password string
+}
+
+func (p *wialonIPS) login(c *session, imei string) error {
+	pwd := p.password
+	if pwd == "" {
+		pwd = IPS_NA
+	}
+	ans, err := p.request(c, "#L#"+imei+";"+pwd, "#AL#")
+	if err != nil {
+		return err
+	}
+	switch ans {
+	case "1":
+		return nil
+	case "01":
+		return fmt.Errorf("password is rejected for %s", imei)
+	default:
+		return fmt.Errorf("device %s is rejected, code %s", imei, ans)
+	}
+}
+
+func (p *wialonIPS) send(c *session, data *app.TelematicsData) error {
+	ans, err := p.request(c, ipsDataPacket(data), "#AD#")
+	if err != nil {
+		return err
+	}
+	if ans != "1" {
+		if descr, ok := ipsDataErrors[ans]; ok {
+			return fmt.Errorf("data packet is rejected: %s", descr)
+		}
+		return fmt.Errorf("data packet is rejected, code %s", ans)
+	}
+	return nil
+}
+
+//sends packet, returns answer code after prefix
+func (p *wialonIPS) request(c *session, packet string, ansPrefix string) (string, error) {
+	if err := c.write([]byte(packet + IPS_LINE_END)); err != nil {
+		return "", err
+	}
+	for {
+		ind := bytes.Index(c.buf, []byte(IPS_LINE_END))
+		if ind < 0 {
+			if len(c.buf) > IPS_MAX_ANSWER_LEN {
+				return "", fmt.Errorf("answer is too long")
+			}
+			if err := c.fill(len(c.buf) + 1); err != nil {
+				return "", err
+			}
+			continue
+		}
+		line := string(c.consume(ind + len(IPS_LINE_END)))
+		line = strings.TrimSuffix(line, IPS_LINE_END)
+		if strings.HasPrefix(line, ansPrefix) {
+			return line[len(ansPrefix):], nil
+		}
+		//server messages and commands are not supported
+	}
+}
+
+func ipsDataPacket(data *app.TelematicsData) string {
+	t := data.GPSTime.UTC()
+	if t.IsZero() {
+		t = data.ReceivedTime.UTC()
+	}
+	lat1, lat2, lon1, lon2 := IPS_NA, IPS_NA, IPS_NA, IPS_NA
+	speed, course, height, sats := IPS_NA, IPS_NA, IPS_NA, IPS_NA
+	if data.GPSValid {
+		lat1, lat2 = ipsCoord(float64(data.Lat), 2), "N"
+		if data.Lat < 0 {
+			lat2 = "S"
+		}
+		lon1, lon2 = ipsCoord(float64(data.Lon), 3), "E"
+		if data.Lon < 0 {
+			lon2 = "W"
+		}
+		speed = fmt.Sprintf("%d", data.Speed)
+		course = fmt.Sprintf("%d", data.Heading)
+		height = fmt.Sprintf("%d", data.Height)
+		sats = fmt.Sprintf("%d", data.SattlliteNum)
+	}
+	params := fmt.Sprintf("volt_ext:1:%d,volt_int:1:%d,gsm:1:%d,odometer:1:%d,from_memory:1:%d",
+		data.VoltExt, data.VoltInt, data.SignalLevel, data.Odom, boolInt(data.FromMemory))
+	return fmt.Sprintf("#D#%s;%s;%s;%s;%s;%s;%s;%s;%s;%s;%s;%s;%s;;%s;%s",
+		t.Format("020106"), t.Format("150405"),
+		lat1, lat2, lon1, lon2,
+		speed, course, height, sats,
+		IPS_NA, IPS_NA, IPS_NA, IPS_NA, params)
+}
+
+//degrees as DDMM.MMMM (DDDMM.MMMM for longitude)
+func ipsCoord(v float64, degDigits int) string {
+	//1/10000 of minute
+	units := int64(math.Round(math.Abs(v) * 60 * 10000))
+	deg, min := units / 600000, units % 600000
+	return fmt.Sprintf("%0*d%02d.%04d", degDigits, deg, min / 10000, min % 10000)
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,78 @@
+package storage_retranslator
+
+import(
+	"net"
+	"bufio"
+	"context"
+	"strings"
+	"testing"
+)
+
+//Wialon IPS target answering data packets with code
+func ipsTarget(dataCode string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch {
+			case strings.HasPrefix(line, "#L#"):
+				conn.Write([]byte("#AL#1\r\n"))
+			case strings.HasPrefix(line, "#D#"):
+				//server message before answer is skipped
+				conn.Write([]byte("#M#text\r\n#AD#" + dataCode + "\r\n"))
+			}
+		}
+	}
+}
+
+func TestIPSDataPacket(t *testing.T) {
+	const GOLDEN = "#D#010324;123015;5545.0000;N;03737.0500;E;60;270;150;12;NA;NA;NA;;NA;" +
+		"volt_ext:1:12500,volt_int:1:4100,gsm:1:25,odometer:1:123456,from_memory:1:0"
+	if p := ipsDataPacket(testRecord("1")); p != GOLDEN {
+		t.Fatalf("packet %q", p)
+	}
+	rec := testRecord("1")
+	rec.GPSValid = false
+	rec.FromMemory = true
+	const GOLDEN_NO_POS = "#D#010324;123015;NA;NA;NA;NA;NA;NA;NA;NA;NA;NA;NA;;NA;" +
+		"volt_ext:1:12500,volt_int:1:4100,gsm:1:25,odometer:1:123456,from_memory:1:1"
+	if p := ipsDataPacket(rec); p != GOLDEN_NO_POS {
+		t.Fatalf("packet without position %q", p)
+	}
+	for _, c := range []struct {
+		v float64
+		digits int
+		s string
+	}{
+		{55.75, 2, "5545.0000"},
+		{-33.8688, 2, "3352.1280"},
+		{7.5, 3, "00730.0000"},
+		{179.99999, 3, "17959.9994"},
+	} {
+		if s := ipsCoord(c.v, c.digits); s != c.s {
+			t.Errorf("%v: %s, expected %s", c.v, s, c.s)
+		}
+	}
+}
+
+func TestIPSTarget(t *testing.T) {
+	tg := startTestTarget(t, ipsTarget("1"))
+	s := newTestStorage(t, Config{Protocol: PROTOCOL_WIALON_IPS, Password: "pwd"}, tg.addr)
+	r := testRecord("1")
+	r.ReceivedTime = testTime
+	if err := s.WriteRecord(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if st := s.GetRetranslationStatus()[0]; st.LagSec != 0 || !st.LastAckReceived.Equal(testTime) {
+		t.Fatalf("lag %v, last acknowledged record received %v", st.LagSec, st.LastAckReceived)
+	}
+
+	tg = startTestTarget(t, ipsTarget("10"))
+	s = newTestStorage(t, Config{Protocol: PROTOCOL_WIALON_IPS}, tg.addr)
+	if err := s.WriteRecord(context.Background(), testRecord("1")); err == nil || !strings.Contains(err.Error(), "coordinates error") {
+		t.Fatalf("rejected packet: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package storage_retranslator
+
+/**
+ * Wialon Retranslator 1.0, binary protocol, no authorization,
+ * controller ID is IMEI. Every packet is acknowledged with 0x11 byte.
+ * Packet: size (4 bytes LE), controller ID\0, time (4 bytes BE), flags (4 bytes BE), blocks.
+ * Block: type 0x0BBB (2 bytes BE), size (4 bytes BE), hidden, data type, name\0, value.
+ */
+
+import(
+	"fmt"
+	"math"
+	"encoding/binary"
+
+	"telsrv/app"
+)
+
+const (
+	WR_ACK byte = 0x11
+	WR_FLAG_LOCATION uint32 = 0x00000001
+	WR_BLOCK_TYPE uint16 = 0x0BBB
+
+	//block data types
+	WR_TYPE_BINARY byte = 0x02
+	WR_TYPE_INT byte = 0x03
+)
+
+type wialonRetranslator struct {
+}
+
+func (p *wialonRetranslator) login(c *session, imei string) error {
+	return nil
+}
+
+func (p *wialonRetranslator) send(c *session, data *app.TelematicsData) error {
+	if err := c.write(wrPacket(data)); err != nil {
+		return err
+	}
+	if err := c.fill(1); err != nil {
+		return err
+	}
+	if ans := c.consume(1)[0]; ans != WR_ACK {
+		return fmt.Errorf("unexpected answer 0x%02x", ans)
+	}
+	return nil
+}
+
+func wrPacket(data *app.TelematicsData) []byte {
+	t := data.GPSTime
+	if t.IsZero() {
+		t = data.ReceivedTime
+	}
+	var flags uint32
+	body := append([]byte(data.IMEI), 0)
+	body = binary.BigEndian.AppendUint32(body, uint32(t.Unix()))
+	flags_ind := len(body)
+	body = binary.BigEndian.AppendUint32(body, 0)
+
+	if data.GPSValid {
+		flags |= WR_FLAG_LOCATION
+		pos := make([]byte, 0, 29)
+		pos = binary.LittleEndian.AppendUint64(pos, math.Float64bits(float64(data.Lon)))
+		pos = binary.LittleEndian.AppendUint64(pos, math.Float64bits(float64(data.Lat)))
+		pos = binary.LittleEndian.AppendUint64(pos, math.Float64bits(float64(data.Height)))
+		pos = binary.BigEndian.AppendUint16(pos, uint16(data.Speed))
+		pos = binary.BigEndian.AppendUint16(pos, uint16(data.Heading))
+		pos = append(pos, data.SattlliteNum)
+		body = wrBlock(body, "posinfo", WR_TYPE_BINARY, pos)
+	}
+	body = wrIntBlock(body, "volt_ext", int32(data.VoltExt))
+	body = wrIntBlock(body, "volt_int", int32(data.VoltInt))
+	body = wrIntBlock(body, "gsm", int32(data.SignalLevel))
+	body = wrIntBlock(body, "odometer", int32(data.Odom))
+	body = wrIntBlock(body, "from_memory", int32(boolInt(data.FromMemory)))
+	binary.BigEndian.PutUint32(body[flags_ind:], flags)
+
+	packet := binary.LittleEndian.AppendUint32(make([]byte, 0, 4 + len(body)), uint32(len(body)))
+	return append(packet, body...)
+}
+
+func wrIntBlock(body []byte, name string, v int32) []byte {
+	return wrBlock(body, name, WR_TYPE_INT, binary.BigEndian.AppendUint32(nil, uint32(v)))
+}
+
+//block size counts bytes after size field
+func wrBlock(body []byte, name string, dataType byte, value []byte) []byte {
+	body = binary.BigEndian.AppendUint16(body, WR_BLOCK_TYPE)
+	body = binary.BigEndian.AppendUint32(body, uint32(2 + len(name) + 1 + len(value)))
+	body = append(body, 0x01, dataType) //visible
+	body = append(body, name...)
+	body = append(body, 0)
+	return append(body, value...)
+}
@@ -0,0 +1,64 @@
+package storage_retranslator
+
+import(
+	"io"
+	"net"
+	"bytes"
+	"context"
+	"testing"
+	"encoding/hex"
+	"encoding/binary"
+)
+
+//Wialon Retranslator target, packets are answered with ans
+func wrTarget(ans byte, packets chan []byte) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		for {
+			size := make([]byte, 4)
+			if _, err := io.ReadFull(conn, size); err != nil {
+				return
+			}
+			body := make([]byte, binary.LittleEndian.Uint32(size))
+			if _, err := io.ReadFull(conn, body); err != nil {
+				return
+			}
+			packets <- append(size, body...)
+			conn.Write([]byte{ans})
+		}
+	}
+}
+
+const WR_GOLDEN = "ac000000" + "38363030303030303030303030303100" + "65e1ca57" + "00000001" +
+	"0bbb00000027" + "0102" + "706f73696e666f00" +
+	"000000400acf4240" + "0000000000e04b40" + "0000000000c06240" + "003c" + "010e" + "0c" +
+	"0bbb0000000f" + "0103" + "766f6c745f65787400" + "000030d4" +
+	"0bbb0000000f" + "0103" + "766f6c745f696e7400" + "00001004" +
+	"0bbb0000000a" + "0103" + "67736d00" + "00000019" +
+	"0bbb0000000f" + "0103" + "6f646f6d6574657200" + "0001e240" +
+	"0bbb00000012" + "0103" + "66726f6d5f6d656d6f727900" + "00000000"
+
+func TestWRPacket(t *testing.T) {
+	golden, _ := hex.DecodeString(WR_GOLDEN)
+	if p := wrPacket(testRecord("860000000000001")); !bytes.Equal(p, golden) {
+		t.Fatalf("packet %x", p)
+	}
+}
+
+func TestWRTarget(t *testing.T) {
+	packets := make(chan []byte, 1)
+	tg := startTestTarget(t, wrTarget(WR_ACK, packets))
+	s := newTestStorage(t, Config{Protocol: PROTOCOL_WIALON_RETRANSLATOR}, tg.addr)
+	if err := s.WriteRecord(context.Background(), testRecord("860000000000001")); err != nil {
+		t.Fatal(err)
+	}
+	golden, _ := hex.DecodeString(WR_GOLDEN)
+	if p := <-packets; !bytes.Equal(p, golden) {
+		t.Fatalf("packet %x", p)
+	}
+
+	tg = startTestTarget(t, wrTarget(0x00, packets))
+	s = newTestStorage(t, Config{Protocol: PROTOCOL_WIALON_RETRANSLATOR}, tg.addr)
+	if err := s.WriteRecord(context.Background(), testRecord("860000000000001")); err == nil {
+		t.Fatal("not acknowledged packet is sent")
+	}
+}
@@ -3,19 +3,31 @@ package main
 import(
 	"os"
 	"fmt"
+	"time"
+	"context"
+	"syscall"
+	"os/signal"
 	
 	"telsrv/app"
 	"telsrv/reportsyst"
 	"telsrv/arnavi"
 	"telsrv/storage_pg"
-	
-	"github.com/labstack/gommon/log"
 )
 
 //https://kodazm.ru/articles/go/tcp-server-clockwork/
 
 //var App *Application
 
+//supported protocols
+var protocols = map[string]app.NewSocketFunc{
+	PROT_ARNAVI: func() app.ClientSocketer{
+		return app.NewCodecSocket(arnavi.NewCodec())
+	},
+	PROT_REPORTSYST: func() app.ClientSocketer{
+		return app.NewCodecSocket(reportsyst.NewCodec())
+	},
+}
+
 func main() {
 
 	App := &app.Application{}
@@ -35,28 +47,118 @@ func main() {
 		panic(fmt.Sprintf("ReadConf: %v",err))
 	}
 
-	App.Logger = log.New("-")
-	App.Logger.SetHeader("${time_rfc3339_nano} ${short_file}:${line} ${level} -${message}")
-	App.Logger.SetLevel(config.getLogLevel()) //log.Lvl(1)
+	App.LogLevels = app.NewLogLevels(config.getLogLevel())
+	App.Logger, err = app.NewLogger(os.Stdout, config.LogFormat, App.LogLevels)
+	if err != nil {
+		panic(fmt.Sprintf("NewLogger: %v",err))
+	}
 
-	App.CommandKey = config.CommandKey	
+	api_keys, err := config.getAPIKeys()
+	if err != nil {
+		app.LogFatal(App.Logger, "admin keys", app.LOG_KEY_ERR, err)
+	}
+	App.SetAPIKeys(config.CommandKey, api_keys)
+	App.DisableDeviceSysPackage = config.DisableDeviceSysPackage
+	App.MetricsAuth = config.MetricsAuth
+	App.SessionHistory = config.SessionHistory
+	App.SetDeviceStateConfig(config.DeviceState)
+	App.SetReadySpoolMaxBytes(config.ReadySpoolMaxBytes)
+	if err := App.SetDuplicateIMEIPolicy(config.getDuplicateIMEIPolicy()); err != nil {
+		app.LogFatal(App.Logger, "App.SetDuplicateIMEIPolicy failed", app.LOG_KEY_ERR, err)
+	}
+	
+	App.CommandQueue = &app.CommandQueue{TTLSec: config.CommandQueueTTLSec, MaxAttempts: config.CommandQueueMaxAttempts}
+	err = App.CommandQueue.Init(config.CommandQueueFile, App.Logger)
+	if err != nil {
+		app.LogFatal(App.Logger, "App.CommandQueue.Init failed", app.LOG_KEY_ERR, err)
+	}
 		
-	App.Storage = &storage_pg.StoragePG{ConnMaxIdleTime: config.ConnMaxIdleTime, ConnMaxTime: config.ConnMaxTime}
+	App.Storage, err = newStorage(config)
+	if err != nil {
+		app.LogFatal(App.Logger, "newStorage failed", app.LOG_KEY_ERR, err)
+	}
 	err = App.Storage.Init(config.StorageConnection, App.Logger, config.DbProcessCount)
 	if err != nil {
-		App.Logger.Fatalf("App.Storage.Init %v",err)
+		app.LogFatal(App.Logger, "App.Storage.Init failed", app.LOG_KEY_ERR, err)
 	}
 	
-	//ReportSystems server
-	reportsyst_new_socket := func() app.ClientSocketer{
-		return &reportsyst.ReportSysClientSocket{}
+	//device registry
+	switch config.DeviceRegistry.Source {
+	case "":
+	case app.REG_SOURCE_FILE, app.REG_SOURCE_STORAGE:
+		var loader app.DeviceLoader
+		if config.DeviceRegistry.Source == app.REG_SOURCE_FILE {
+			loader = &app.FileDeviceLoader{FileName: config.DeviceRegistry.File}
+		}else{
+			loader = &storage_pg.DeviceLoaderPG{ConnStr: config.StorageConnection, Query: config.DeviceRegistry.Query}
+		}
+		App.Devices = &app.DeviceRegistry{Policy: config.DeviceRegistry.Policy,
+			Loader: loader,
+			RefreshSec: config.DeviceRegistry.RefreshSec,
+		}
+		if err := App.Devices.Init(App.Logger); err != nil {
+			app.LogFatal(App.Logger, "App.Devices.Init failed", app.LOG_KEY_ERR, err)
+		}
+	default:
+		app.LogFatal(App.Logger, "deviceRegistry: unknown source", "source", config.DeviceRegistry.Source)
 	}
-	go App.RunServer("ReportSystems", config.ReportSystSrv.Host, config.ReportSystSrv.Port, config.ReportSystSrv.ConLiveSec, reportsyst_new_socket)
 	
-	//Arnavi server
-	arnavi_new_sock := func() app.ClientSocketer{
-		return &arnavi.ArnaviClientSocket{}
+	//raw traffic capture
+	if config.Capture != nil {
+		rec, err := app.NewCaptureRecorder(*config.Capture)
+		if err != nil {
+			app.LogFatal(App.Logger, "NewCaptureRecorder failed", app.LOG_KEY_ERR, err)
+		}
+		App.SetCapture(rec)
 	}
-	App.RunServer("Arnavi", config.ArnaviSrv.Host, config.ArnaviSrv.Port, config.ArnaviSrv.ConLiveSec, arnavi_new_sock)
+	
+	//admin server
+	if config.AdminSrv.Port > 0 {
+		go App.RunAdminServer(config.AdminSrv.Host, config.AdminSrv.Port, config.AdminSrv.ConLiveSec, config.AdminSrv.TLS)
+	}
+	
+	//HTTP admin API
+	if config.HTTPAdminSrv.Port > 0 {
+		go App.RunHTTPAdmin(config.HTTPAdminSrv.Host, config.HTTPAdminSrv.Port, config.HTTPAdminSrv.TLS)
+	}
+	
+	//device servers
+	for _, srv := range config.getServers() {
+		new_socket, ok := protocols[srv.Protocol]
+		if !ok {
+			app.LogFatal(App.Logger, "unknown protocol", app.LOG_KEY_SERVER, srv.ID, app.LOG_KEY_PROTOCOL, srv.Protocol)
+		}
+		if err := App.StartServer(srv.ID, srv.Protocol, srv.Host, srv.Port, srv.ConLiveSec, new_socket, srv.TLS); err != nil {
+			app.LogFatal(App.Logger, "StartServer failed", app.LOG_KEY_SERVER, srv.ID, app.LOG_KEY_ERR, err)
+		}
+	}
+	
+	//systemd readiness and watchdog
+	App.RunSdNotify()
+	
+	//configuration reload on SIGHUP and admin command
+	App.Reloader = func() app.ReloadReport {
+		return reloadConfig(App, ini_file, &config)
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			App.Logger.Info("SIGHUP received, reloading configuration")
+			App.Reloader()
+		}
+	}()
+	
+	//waiting for SIGINT/SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+	
+	confMx.Lock()
+	shutdown_timeout := config.getShutdownTimeoutSec()
+	storage_timeout := config.getShutdownStorageTimeoutSec()
+	confMx.Unlock()
+	App.Logger.Info("Signal received, shutting down", "timeout_sec", shutdown_timeout, "storage_timeout_sec", storage_timeout)
+	os.Exit(App.Shutdown(time.Duration(shutdown_timeout) * time.Second, time.Duration(storage_timeout) * time.Second))
 }
-